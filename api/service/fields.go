@@ -0,0 +1,556 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"github.com/russross/blackfriday"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// Patterns used to validate form input.
+const (
+	floatPattern     = `[-+]?[0-9]*\.?[0-9]+([eE][-+]?[0-9]+)?`
+	emailPattern     = `[^@\s]+@[^@\s]+\.[^@\s]+`
+	urlPattern       = `https?://\S+`
+	datePattern      = `[0-9]{4}-[0-9]{2}-[0-9]{2}`
+	referencePattern = `/\S*`
+)
+
+var (
+	emailRegexp     = regexp.MustCompile("^" + emailPattern + "$")
+	urlRegexp       = regexp.MustCompile("^" + urlPattern + "$")
+	referenceRegexp = regexp.MustCompile("^" + referencePattern + "$")
+)
+
+// dateLayout is the format of dates stored by DateField.
+const dateLayout = "2006-01-02"
+
+// FieldOption is a selectable value of Select and MultiSelect fields.
+type FieldOption struct {
+	Value string
+	// The name of the option as shown in the web interface,
+	// specified as a translation map (language -> msg).
+	Name map[string]string
+}
+
+// GetLocalName returns the name of the option in the given language.
+//
+// Falls back to the "en" locale or the value of the option.
+func (o FieldOption) GetLocalName(locale string) string {
+	name, ok := o.Name[locale]
+	if !ok {
+		name, ok = o.Name["en"]
+	}
+	if !ok {
+		name = o.Value
+	}
+	return name
+}
+
+// hasOption returns true if the field has an option with the given
+// value.
+func (f NodeField) hasOption(value string) bool {
+	for _, option := range f.Options {
+		if option.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// addTextWidget adds a text widget which only accepts input matching
+// the given pattern. Empty input is accepted for optional fields.
+func addTextWidget(form *htmlwidgets.Form, field *NodeField, locale,
+	pattern, validationError string) {
+	widget := &htmlwidgets.TextWidget{ValidationError: validationError}
+	if field.Required {
+		widget.MinLength = 1
+		widget.Regexp = "^" + pattern + "$"
+	} else {
+		widget.Regexp = "^(" + pattern + ")?$"
+	}
+	form.AddWidget(widget, "Fields."+field.Id, field.Name[locale], "")
+}
+
+// formString returns the string submitted for the given field.
+func formString(data util.NestedMap, field *NodeField) string {
+	value, _ := data.Get(field.Id).(string)
+	return strings.TrimSpace(value)
+}
+
+// IntegerField holds an integer number.
+type IntegerField int
+
+func (t IntegerField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t IntegerField) String() string {
+	return strconv.Itoa(int(t))
+}
+
+func (t IntegerField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *IntegerField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t IntegerField) Dump() interface{} {
+	return int(t)
+}
+
+func (t IntegerField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, int(t))
+	form.AddWidget(new(htmlwidgets.IntegerWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+}
+
+func (t *IntegerField) FromFormField(data util.NestedMap, field *NodeField) {
+	switch value := data.Get(field.Id).(type) {
+	case int:
+		*t = IntegerField(value)
+	case string:
+		number, _ := strconv.Atoi(strings.TrimSpace(value))
+		*t = IntegerField(number)
+	}
+}
+
+// FloatField holds a floating point number.
+type FloatField float64
+
+func (t FloatField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t FloatField) String() string {
+	return strconv.FormatFloat(float64(t), 'f', -1, 64)
+}
+
+func (t FloatField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *FloatField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t FloatField) Dump() interface{} {
+	return float64(t)
+}
+
+func (t FloatField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, t.String())
+	addTextWidget(form, field, locale, floatPattern, G("Please enter a number."))
+}
+
+func (t *FloatField) FromFormField(data util.NestedMap, field *NodeField) {
+	number, _ := strconv.ParseFloat(formString(data, field), 64)
+	*t = FloatField(number)
+}
+
+// BoolField holds a boolean value.
+type BoolField bool
+
+func (t BoolField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t BoolField) String() string {
+	return strconv.FormatBool(bool(t))
+}
+
+// RenderHTML returns the boolean value to be used in template
+// conditions.
+func (t BoolField) RenderHTML() interface{} {
+	return bool(t)
+}
+
+func (t *BoolField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t BoolField) Dump() interface{} {
+	return bool(t)
+}
+
+func (t BoolField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, bool(t))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+}
+
+func (t *BoolField) FromFormField(data util.NestedMap, field *NodeField) {
+	value, _ := data.Get(field.Id).(bool)
+	*t = BoolField(value)
+}
+
+// SelectField holds the value of one of the field's options.
+type SelectField string
+
+func (t SelectField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t SelectField) String() string {
+	return string(t)
+}
+
+func (t SelectField) RenderHTML() interface{} {
+	return string(t)
+}
+
+func (t *SelectField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t SelectField) Dump() interface{} {
+	return string(t)
+}
+
+func (t SelectField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, string(t))
+	var options []htmlwidgets.SelectOption
+	if !field.Required {
+		options = append(options, htmlwidgets.SelectOption{})
+	}
+	for _, option := range field.Options {
+		options = append(options, htmlwidgets.SelectOption{
+			Value:       option.Value,
+			Description: option.GetLocalName(locale),
+			Selected:    option.Value == string(t),
+		})
+	}
+	form.AddWidget(&htmlwidgets.SelectWidget{Options: options},
+		"Fields."+field.Id, field.Name[locale], "")
+}
+
+func (t *SelectField) FromFormField(data util.NestedMap, field *NodeField) {
+	value := formString(data, field)
+	if !field.hasOption(value) {
+		value = ""
+	}
+	*t = SelectField(value)
+}
+
+// MultiSelectField holds the values of the selected options.
+type MultiSelectField []string
+
+func (t MultiSelectField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t MultiSelectField) String() string {
+	return strings.Join(t, ", ")
+}
+
+func (t MultiSelectField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *MultiSelectField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t MultiSelectField) Dump() interface{} {
+	if t == nil {
+		return []string{}
+	}
+	return []string(t)
+}
+
+// has returns true if the given value is selected.
+func (t MultiSelectField) has(value string) bool {
+	for _, selected := range t {
+		if selected == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ToFormField adds a checkbox for each of the field's options.
+func (t MultiSelectField) ToFormField(form *htmlwidgets.Form,
+	data util.NestedMap, field *NodeField, locale string) {
+	for i, option := range field.Options {
+		id := fmt.Sprintf("%v.%v", field.Id, i)
+		data.Set(id, t.has(option.Value))
+		form.AddWidget(new(htmlwidgets.BoolWidget), "Fields."+id,
+			fmt.Sprintf("%v: %v", field.Name[locale], option.GetLocalName(locale)),
+			"")
+	}
+}
+
+func (t *MultiSelectField) FromFormField(data util.NestedMap,
+	field *NodeField) {
+	var selected MultiSelectField
+	for i, option := range field.Options {
+		if value, _ := data.Get(fmt.Sprintf("%v.%v", field.Id, i)).(bool); value {
+			selected = append(selected, option.Value)
+		}
+	}
+	*t = selected
+}
+
+// EmailField holds an email address.
+type EmailField string
+
+func (t EmailField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t EmailField) String() string {
+	return string(t)
+}
+
+// RenderHTML returns a mailto link.
+func (t EmailField) RenderHTML() interface{} {
+	if len(t) == 0 {
+		return ""
+	}
+	address := template.HTMLEscapeString(string(t))
+	return template.HTML(fmt.Sprintf(`<a href="mailto:%v">%v</a>`, address,
+		address))
+}
+
+func (t *EmailField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t EmailField) Dump() interface{} {
+	return string(t)
+}
+
+func (t EmailField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, string(t))
+	addTextWidget(form, field, locale, emailPattern,
+		G("Please enter a valid email address."))
+}
+
+func (t *EmailField) FromFormField(data util.NestedMap, field *NodeField) {
+	value := formString(data, field)
+	if !emailRegexp.MatchString(value) {
+		value = ""
+	}
+	*t = EmailField(value)
+}
+
+// URLField holds an http or https URL.
+type URLField string
+
+func (t URLField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t URLField) String() string {
+	return string(t)
+}
+
+// RenderHTML returns a link to the URL.
+func (t URLField) RenderHTML() interface{} {
+	if len(t) == 0 {
+		return ""
+	}
+	url := template.HTMLEscapeString(string(t))
+	return template.HTML(fmt.Sprintf(`<a href="%v">%v</a>`, url, url))
+}
+
+func (t *URLField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t URLField) Dump() interface{} {
+	return string(t)
+}
+
+func (t URLField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, string(t))
+	addTextWidget(form, field, locale, urlPattern,
+		G("Please enter a URL starting with http:// or https://."))
+}
+
+func (t *URLField) FromFormField(data util.NestedMap, field *NodeField) {
+	value := formString(data, field)
+	if !urlRegexp.MatchString(value) {
+		value = ""
+	}
+	*t = URLField(value)
+}
+
+// DateField holds a date without time of day. The zero value is an
+// empty date.
+type DateField struct {
+	Time time.Time
+}
+
+func (t DateField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t DateField) String() string {
+	if t.Time.IsZero() {
+		return ""
+	}
+	return t.Time.Format(dateLayout)
+}
+
+func (t DateField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *DateField) Load(f func(interface{}) error) error {
+	var date string
+	if err := f(&date); err != nil {
+		return err
+	}
+	if len(date) == 0 {
+		t.Time = time.Time{}
+		return nil
+	}
+	val, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return fmt.Errorf("Could not parse the date value: %v", err)
+	}
+	t.Time = val
+	return nil
+}
+
+func (t DateField) Dump() interface{} {
+	return t.String()
+}
+
+func (t DateField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, t.String())
+	addTextWidget(form, field, locale, datePattern,
+		G("Please enter a date like 2014-12-31."))
+}
+
+func (t *DateField) FromFormField(data util.NestedMap, field *NodeField) {
+	date, _ := time.Parse(dateLayout, formString(data, field))
+	*t = DateField{date}
+}
+
+// MarkdownField holds text formatted using Markdown.
+type MarkdownField string
+
+func (t MarkdownField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t MarkdownField) String() string {
+	return string(t)
+}
+
+// RenderHTML returns the text converted to HTML.
+func (t MarkdownField) RenderHTML() interface{} {
+	return template.HTML(blackfriday.MarkdownCommon([]byte(t)))
+}
+
+func (t *MarkdownField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t MarkdownField) Dump() interface{} {
+	return string(t)
+}
+
+func (t MarkdownField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, string(t))
+	widget := &htmlwidgets.TextAreaWidget{}
+	if field.Required {
+		widget.MinLength = 1
+		widget.ValidationError = G("Required.")
+	}
+	form.AddWidget(widget, "Fields."+field.Id, field.Name[locale], "")
+	widget.Base().Classes = []string{"markdown-field"}
+}
+
+func (t *MarkdownField) FromFormField(data util.NestedMap, field *NodeField) {
+	value, _ := data.Get(field.Id).(string)
+	*t = MarkdownField(value)
+}
+
+// ReferenceField holds the path of another node of the site.
+type ReferenceField string
+
+func (t ReferenceField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t ReferenceField) String() string {
+	return string(t)
+}
+
+// RenderHTML returns a link to the referenced node.
+func (t ReferenceField) RenderHTML() interface{} {
+	if len(t) == 0 {
+		return ""
+	}
+	nodePath := template.HTMLEscapeString(string(t))
+	return template.HTML(fmt.Sprintf(`<a href="%v/">%v</a>`,
+		strings.TrimSuffix(nodePath, "/"), nodePath))
+}
+
+func (t *ReferenceField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t ReferenceField) Dump() interface{} {
+	return string(t)
+}
+
+func (t ReferenceField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, string(t))
+	addTextWidget(form, field, locale, referencePattern,
+		G("Please enter the path of a node, e.g. /about."))
+}
+
+func (t *ReferenceField) FromFormField(data util.NestedMap, field *NodeField) {
+	value := formString(data, field)
+	if !referenceRegexp.MatchString(value) {
+		value = ""
+	}
+	if value != "/" {
+		value = strings.TrimSuffix(value, "/")
+	}
+	*t = ReferenceField(value)
+}
@@ -0,0 +1,153 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestFieldsLoadDump(t *testing.T) {
+	tests := []struct {
+		Field Field
+		JSON  string
+	}{
+		{new(IntegerField), `42`},
+		{new(FloatField), `-1.5`},
+		{new(BoolField), `true`},
+		{new(SelectField), `"foo"`},
+		{new(MultiSelectField), `["foo","bar"]`},
+		{new(MultiSelectField), `[]`},
+		{new(EmailField), `"foo@example.com"`},
+		{new(URLField), `"http://example.com/"`},
+		{new(DateField), `"2014-12-31"`},
+		{new(DateField), `""`},
+		{new(MarkdownField), `"*foo*"`},
+		{new(ReferenceField), `"/foo/bar"`},
+	}
+	for _, test := range tests {
+		err := test.Field.Load(func(in interface{}) error {
+			return json.Unmarshal([]byte(test.JSON), in)
+		})
+		if err != nil {
+			t.Errorf("%T.Load(%v) returned error: %v", test.Field, test.JSON, err)
+			continue
+		}
+		dump, err := json.Marshal(test.Field.Dump())
+		if err != nil || string(dump) != test.JSON {
+			t.Errorf("%T: Load/Dump of %v returned %s, %v", test.Field, test.JSON,
+				dump, err)
+		}
+	}
+}
+
+func TestFieldsRenderHTML(t *testing.T) {
+	tests := []struct {
+		Field    interface{ RenderHTML() interface{} }
+		Expected interface{}
+	}{
+		{IntegerField(42), "42"},
+		{FloatField(0.25), "0.25"},
+		{BoolField(true), true},
+		{SelectField("foo"), "foo"},
+		{MultiSelectField{"foo", "bar"}, "foo, bar"},
+		{EmailField(`foo"@example.com`), template.HTML(
+			`<a href="mailto:foo&#34;@example.com">foo&#34;@example.com</a>`)},
+		{EmailField(""), ""},
+		{URLField("http://example.com/?a=1&b=2"), template.HTML(
+			`<a href="http://example.com/?a=1&amp;b=2">` +
+				`http://example.com/?a=1&amp;b=2</a>`)},
+		{MarkdownField("*foo*"), template.HTML("<p><em>foo</em></p>\n")},
+		{ReferenceField("/foo"), template.HTML(`<a href="/foo/">/foo</a>`)},
+		{ReferenceField("/"), template.HTML(`<a href="/">/</a>`)},
+	}
+	for _, test := range tests {
+		ret := test.Field.RenderHTML()
+		if !reflect.DeepEqual(ret, test.Expected) {
+			t.Errorf("%T(%v).RenderHTML() = %#v, should be %#v", test.Field,
+				test.Field, ret, test.Expected)
+		}
+	}
+}
+
+func TestFieldsFromFormField(t *testing.T) {
+	field := &NodeField{
+		Id: "foo.Field",
+		Options: []FieldOption{
+			{Value: "a"},
+			{Value: "b"},
+			{Value: "c"}},
+	}
+	tests := []struct {
+		Field    Field
+		Value    interface{}
+		Expected interface{}
+	}{
+		{new(IntegerField), 7, 7},
+		{new(FloatField), " 1.5e2 ", 150.0},
+		{new(BoolField), true, true},
+		{new(SelectField), "b", "b"},
+		{new(SelectField), "unknown", ""},
+		{new(MultiSelectField), map[string]interface{}{
+			"0": true, "1": false, "2": true}, []string{"a", "c"}},
+		{new(EmailField), "foo@example.com", "foo@example.com"},
+		{new(EmailField), "foo", ""},
+		{new(URLField), "https://example.com", "https://example.com"},
+		{new(URLField), "javascript:alert(1)", ""},
+		{new(DateField), "2014-02-03", "2014-02-03"},
+		{new(DateField), "", ""},
+		{new(ReferenceField), "/foo/", "/foo"},
+		{new(ReferenceField), "foo", ""},
+	}
+	for _, test := range tests {
+		data := make(util.NestedMap)
+		data.Set(field.Id, test.Value)
+		test.Field.FromFormField(data, field)
+		if ret := test.Field.Dump(); fmt.Sprint(ret) !=
+			fmt.Sprint(test.Expected) {
+			t.Errorf("%T.FromFormField(%v) = %v, should be %v", test.Field,
+				test.Value, ret, test.Expected)
+		}
+	}
+}
+
+func TestInitFields(t *testing.T) {
+	node := Node{Type: &NodeType{Fields: []*NodeField{
+		{Id: "foo.Integer", Type: "Integer"},
+		{Id: "foo.Float", Type: "Float"},
+		{Id: "foo.Bool", Type: "Bool"},
+		{Id: "foo.Select", Type: "Select"},
+		{Id: "foo.MultiSelect", Type: "MultiSelect"},
+		{Id: "foo.Email", Type: "Email"},
+		{Id: "foo.URL", Type: "URL"},
+		{Id: "foo.Date", Type: "Date"},
+		{Id: "foo.Markdown", Type: "Markdown"},
+		{Id: "foo.Reference", Type: "Reference"}}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("InitFields returned error: %v", err)
+	}
+	for _, field := range node.Type.Fields {
+		if node.Fields[field.Id] == nil {
+			t.Errorf("Field %v has not been initialized", field.Id)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func init() {
+	gob.RegisterName("monsti.FieldRequestArgs", FieldRequestArgs{})
+	gob.RegisterName("monsti.FieldRequestRet", FieldRequestRet{})
+	// Widgets which may be returned by fields of module field types.
+	gob.Register(&htmlwidgets.TextWidget{})
+	gob.Register(&htmlwidgets.TextAreaWidget{})
+	gob.Register(&htmlwidgets.HiddenWidget{})
+	gob.Register(&htmlwidgets.BoolWidget{})
+	gob.Register(&htmlwidgets.IntegerWidget{})
+	gob.Register(&htmlwidgets.SelectWidget{})
+	for id, factory := range map[string]FieldFactory{
+		"DateTime":    func() Field { return new(DateTimeField) },
+		"File":        func() Field { return new(FileField) },
+		"Text":        func() Field { return new(TextField) },
+		"HTMLArea":    func() Field { return new(HTMLField) },
+		"Integer":     func() Field { return new(IntegerField) },
+		"Float":       func() Field { return new(FloatField) },
+		"Bool":        func() Field { return new(BoolField) },
+		"Select":      func() Field { return new(SelectField) },
+		"MultiSelect": func() Field { return new(MultiSelectField) },
+		"Email":       func() Field { return new(EmailField) },
+		"URL":         func() Field { return new(URLField) },
+		"Date":        func() Field { return new(DateField) },
+		"Markdown":    func() Field { return new(MarkdownField) },
+		"Reference":   func() Field { return new(ReferenceField) },
+	} {
+		fieldTypes.factories[id] = factory
+	}
+}
+
+// FieldFactory returns a new, empty field of some field type.
+type FieldFactory func() Field
+
+// fieldTypes holds the factories of the field types known to this
+// process, i.e. the core field types and those registered via
+// RegisterFieldType.
+var fieldTypes = struct {
+	sync.RWMutex
+	factories map[string]FieldFactory
+}{factories: make(map[string]FieldFactory)}
+
+// newField returns a new field of the given type or nil if the type
+// is unknown to this process.
+func newField(fieldType string) Field {
+	fieldTypes.RLock()
+	defer fieldTypes.RUnlock()
+	if factory, ok := fieldTypes.factories[fieldType]; ok {
+		return factory()
+	}
+	return nil
+}
+
+// FormWidgetField is implemented by fields of module field types to
+// be edited in Monsti's node edit form.
+//
+// The edit form is rendered by Monsti, which can't call the module's
+// ToFormField method. Instead, it asks the module for the widget and
+// adds it to the form itself. The submitted value is passed to the
+// module's FromFormField method.
+type FormWidgetField interface {
+	// FormWidget returns the widget to edit the field and the
+	// widget's initial value.
+	//
+	// The widget must be one of the widgets registered with
+	// encoding/gob, i.e. TextWidget, TextAreaWidget, HiddenWidget,
+	// BoolWidget, IntegerWidget or SelectWidget.
+	FormWidget(field *NodeField, locale string) (htmlwidgets.Widget,
+		interface{})
+}
+
+// Operations of the monsti.FieldRequest signal.
+const (
+	fieldRender = "render"
+	fieldWidget = "widget"
+	fieldSubmit = "submit"
+)
+
+// FieldRequestArgs are the arguments of the monsti.FieldRequest
+// signal.
+type FieldRequestArgs struct {
+	// Op is the requested operation, one of "render", "widget" or
+	// "submit".
+	Op     string
+	Site   string
+	Locale string
+	Field  NodeField
+	// Value is the field's JSON value.
+	Value []byte
+	// FormValue is the submitted form value for the submit operation.
+	FormValue interface{}
+}
+
+// FieldRequestRet is the return value of the monsti.FieldRequest
+// signal.
+type FieldRequestRet struct {
+	// Handled is true if the subscriber provides the field type.
+	Handled bool
+	// String and HTML are the results of the render operation.
+	String string
+	HTML   template.HTML
+	// Widget and FormValue are the results of the widget operation.
+	// Widget is nil if the field can't be edited in Monsti's node
+	// edit form.
+	Widget    htmlwidgets.Widget
+	FormValue interface{}
+	// Value is the field's JSON value after the submit operation.
+	Value []byte
+}
+
+type fieldRequestHandler struct {
+	m *MonstiClient
+}
+
+func (r *fieldRequestHandler) Name() string {
+	return "monsti.FieldRequest"
+}
+
+func (r *fieldRequestHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(FieldRequestArgs)
+	if !r.m.fieldTypes[args_.Field.Type] {
+		return FieldRequestRet{}, nil
+	}
+	field := newField(args_.Field.Type)
+	if err := field.Init(r.m, args_.Site); err != nil {
+		return nil, fmt.Errorf("Could not init field: %v", err)
+	}
+	if len(args_.Value) > 0 {
+		if err := field.Load(func(in interface{}) error {
+			return json.Unmarshal(args_.Value, in)
+		}); err != nil {
+			return nil, fmt.Errorf("Could not load field: %v", err)
+		}
+	}
+	ret := FieldRequestRet{Handled: true}
+	switch args_.Op {
+	case fieldRender:
+		ret.String = field.String()
+		switch html := field.RenderHTML().(type) {
+		case template.HTML:
+			ret.HTML = html
+		default:
+			ret.HTML = template.HTML(template.HTMLEscapeString(fmt.Sprint(html)))
+		}
+	case fieldWidget:
+		if widgetField, ok := field.(FormWidgetField); ok {
+			ret.Widget, ret.FormValue = widgetField.FormWidget(&args_.Field,
+				args_.Locale)
+		}
+	case fieldSubmit:
+		data := make(util.NestedMap)
+		data.Set(args_.Field.Id, args_.FormValue)
+		field.FromFormField(data, &args_.Field)
+		value, err := json.Marshal(field.Dump())
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode field: %v", err)
+		}
+		ret.Value = value
+	default:
+		return nil, fmt.Errorf("Unknown field operation %q", args_.Op)
+	}
+	return ret, nil
+}
+
+// RegisterFieldType registers a field type provided by the module.
+// Node types may then use fields of this type.
+//
+// The id must be prefixed by the module's namespace, e.g.
+// "example.Rating". Other processes, including Monsti itself, load
+// and dump fields of module field types as raw JSON and send a
+// monsti.FieldRequest signal to the module to render them or to
+// process form submissions. Implement FormWidgetField to let the
+// fields be edited in Monsti's node edit form.
+//
+// Register field types before registering node types which use them.
+// Be sure to wait for incoming signals by calling WaitSignal() on
+// this MonstiClient!
+func (s *MonstiClient) RegisterFieldType(id string,
+	factory FieldFactory) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	err := s.RPCClient.Call("Monsti.RegisterFieldType", id, new(int))
+	if err != nil {
+		return fmt.Errorf("service: RegisterFieldType error: %v", err)
+	}
+	if s.fieldTypes == nil {
+		s.fieldTypes = make(map[string]bool)
+		if err := s.AddSignalHandler(&fieldRequestHandler{s}); err != nil {
+			s.fieldTypes = nil
+			return err
+		}
+	}
+	fieldTypes.Lock()
+	fieldTypes.factories[id] = factory
+	fieldTypes.Unlock()
+	s.fieldTypes[id] = true
+	return nil
+}
+
+// fieldTypeRegistered returns true if some module registered the
+// field type.
+func (s *MonstiClient) fieldTypeRegistered(id string) (bool, error) {
+	if s.Error != nil {
+		return false, s.Error
+	}
+	var reply bool
+	err := s.RPCClient.Call("Monsti.FieldTypeRegistered", id, &reply)
+	if err != nil {
+		return false, fmt.Errorf("service: FieldTypeRegistered error: %v", err)
+	}
+	return reply, nil
+}
+
+// remoteField is a field of a module field type which is unknown to
+// this process. Its value is kept as raw JSON, everything else is
+// delegated to the module.
+type remoteField struct {
+	m        *MonstiClient
+	site     string
+	field    NodeField
+	value    json.RawMessage
+	rendered *FieldRequestRet
+}
+
+// request sends the field request to the module providing the field
+// type.
+func (t *remoteField) request(args FieldRequestArgs) (*FieldRequestRet,
+	error) {
+	args.Site = t.site
+	args.Field = t.field
+	args.Value = t.value
+	var rets []FieldRequestRet
+	if err := t.m.EmitSignal("monsti.FieldRequest", args, &rets); err != nil {
+		return nil, err
+	}
+	for i := range rets {
+		if rets[i].Handled {
+			return &rets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No module handled field type %q (not running?)",
+		t.field.Type)
+}
+
+func (t *remoteField) render() *FieldRequestRet {
+	if t.rendered == nil {
+		ret, err := t.request(FieldRequestArgs{Op: fieldRender})
+		if err != nil {
+			ret = &FieldRequestRet{}
+		}
+		t.rendered = ret
+	}
+	return t.rendered
+}
+
+func (t *remoteField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t *remoteField) String() string {
+	return t.render().String
+}
+
+func (t *remoteField) RenderHTML() interface{} {
+	return t.render().HTML
+}
+
+func (t *remoteField) Load(f func(interface{}) error) error {
+	t.rendered = nil
+	return f(&t.value)
+}
+
+func (t *remoteField) Dump() interface{} {
+	if len(t.value) == 0 {
+		return nil
+	}
+	return t.value
+}
+
+// ToFormField adds the widget returned by the module. Nothing will be
+// added if the module is not available or does not support the edit
+// form.
+func (t *remoteField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	ret, err := t.request(FieldRequestArgs{Op: fieldWidget, Locale: locale})
+	if err != nil || ret.Widget == nil {
+		return
+	}
+	data.Set(field.Id, ret.FormValue)
+	form.AddWidget(ret.Widget, "Fields."+field.Id, field.Name[locale], "")
+}
+
+// FromFormField lets the module process the submitted value. The
+// value stays unchanged if the field has not been part of the form or
+// if the module is not available.
+func (t *remoteField) FromFormField(data util.NestedMap, field *NodeField) {
+	formValue := data.Get(field.Id)
+	if formValue == nil {
+		return
+	}
+	ret, err := t.request(FieldRequestArgs{Op: fieldSubmit,
+		FormValue: formValue})
+	if err != nil {
+		return
+	}
+	t.value = ret.Value
+	t.rendered = nil
+}
+
+// fieldFactory returns a function which creates initialized fields
+// for the given node field.
+func fieldFactory(m *MonstiClient, site string, field *NodeField) (
+	func() (Field, error), error) {
+	init := func(val Field) (Field, error) {
+		if err := val.Init(m, site); err != nil {
+			return nil, fmt.Errorf("Could not init field %q: %v", field.Id, err)
+		}
+		return val, nil
+	}
+	if newField(field.Type) != nil {
+		return func() (Field, error) {
+			return init(newField(field.Type))
+		}, nil
+	}
+	if m == nil || !strings.Contains(field.Type, ".") {
+		return nil, fmt.Errorf("Unknown field type %q", field.Type)
+	}
+	registered, err := m.fieldTypeRegistered(field.Type)
+	if err != nil {
+		return nil, err
+	}
+	if !registered {
+		return nil, fmt.Errorf("Unknown field type %q", field.Type)
+	}
+	remote := *field
+	return func() (Field, error) {
+		return init(&remoteField{m: m, site: site, field: remote})
+	}, nil
+}
@@ -0,0 +1,106 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"reflect"
+	"testing"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// ratingField is a field type as it could be provided by a module.
+type ratingField int
+
+func (t ratingField) Init(*MonstiClient, string) error { return nil }
+func (t ratingField) String() string                   { return fmt.Sprint(int(t)) }
+func (t ratingField) RenderHTML() interface{} {
+	return template.HTML(fmt.Sprintf("<b>%d</b>", t))
+}
+func (t *ratingField) Load(f func(interface{}) error) error { return f(t) }
+func (t ratingField) Dump() interface{}                     { return int(t) }
+func (t ratingField) ToFormField(*htmlwidgets.Form, util.NestedMap,
+	*NodeField, string) {
+}
+func (t *ratingField) FromFormField(data util.NestedMap, field *NodeField) {
+	*t = ratingField(data.Get(field.Id).(int) * 10)
+}
+func (t ratingField) FormWidget(field *NodeField, locale string) (
+	htmlwidgets.Widget, interface{}) {
+	return new(htmlwidgets.IntegerWidget), int(t) / 10
+}
+
+func TestFieldRequestHandler(t *testing.T) {
+	fieldTypes.Lock()
+	fieldTypes.factories["test.Rating"] = func() Field { return new(ratingField) }
+	fieldTypes.Unlock()
+	handler := &fieldRequestHandler{&MonstiClient{
+		fieldTypes: map[string]bool{"test.Rating": true}}}
+	field := NodeField{Id: "foo.Rating", Type: "test.Rating"}
+	tests := []struct {
+		Args FieldRequestArgs
+		Ret  FieldRequestRet
+	}{
+		{FieldRequestArgs{Op: "render", Field: field, Value: []byte(`30`)},
+			FieldRequestRet{Handled: true, String: "30", HTML: "<b>30</b>"}},
+		{FieldRequestArgs{Op: "widget", Field: field, Value: []byte(`30`)},
+			FieldRequestRet{Handled: true, Widget: new(htmlwidgets.IntegerWidget),
+				FormValue: 3}},
+		{FieldRequestArgs{Op: "submit", Field: field, Value: []byte(`30`),
+			FormValue: 5},
+			FieldRequestRet{Handled: true, Value: []byte(`50`)}},
+		{FieldRequestArgs{Op: "render", Field: NodeField{Id: "foo.Text",
+			Type: "Text"}, Value: []byte(`"foo"`)}, FieldRequestRet{}},
+	}
+	for i, test := range tests {
+		ret, err := handler.Handle(test.Args)
+		if err != nil || !reflect.DeepEqual(ret, test.Ret) {
+			t.Errorf("Test %v: Handle() = %#v, %v, should be %#v", i, ret, err,
+				test.Ret)
+		}
+	}
+}
+
+func TestRemoteFieldLoadDump(t *testing.T) {
+	field := &remoteField{field: NodeField{Id: "foo.Bar", Type: "test.Bar"}}
+	if dump, err := json.Marshal(field.Dump()); err != nil ||
+		string(dump) != "null" {
+		t.Errorf("Empty remote field should dump to null, got %s, %v", dump, err)
+	}
+	value := `{"Foo":[1,2]}`
+	if err := field.Load(func(in interface{}) error {
+		return json.Unmarshal([]byte(value), in)
+	}); err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if dump, err := json.Marshal(field.Dump()); err != nil ||
+		string(dump) != value {
+		t.Errorf("Load/Dump of %v returned %s, %v", value, dump, err)
+	}
+}
+
+func TestInitFieldsUnknownType(t *testing.T) {
+	node := Node{Type: &NodeType{Fields: []*NodeField{
+		{Id: "foo.Bar", Type: "foo.Unknown"}}}}
+	if err := node.InitFields(nil, ""); err == nil {
+		t.Errorf("InitFields should fail for unknown field types")
+	}
+}
@@ -0,0 +1,174 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+func init() {
+	gob.RegisterName("monsti.MigrateNodeArgs", MigrateNodeArgs{})
+	gob.RegisterName("monsti.MigrateNodeRet", MigrateNodeRet{})
+}
+
+// Migration is a step to upgrade the stored nodes of a site to a new
+// schema version.
+//
+// Each namespace, i.e. Monsti's core or a module, has its own schema
+// version per site. Migrations of a namespace are applied in the
+// order of their versions.
+type Migration struct {
+	// Namespace of the migration, e.g. the name of the module.
+	Namespace string
+	// Version is the schema version of the namespace after the
+	// migration has been applied. The first version is 1.
+	Version int
+	// Description tells what the migration does.
+	Description string
+	// Migrate changes the given node document, i.e. the decoded
+	// node.json, in place. Nodes which are not affected by the
+	// migration must be left untouched.
+	Migrate func(site, path string, node map[string]interface{}) error
+}
+
+// MigrateNodeArgs are the arguments of the monsti.MigrateNode signal.
+type MigrateNodeArgs struct {
+	Site, Path string
+	Namespace  string
+	Version    int
+	// Node is the node's JSON document.
+	Node []byte
+}
+
+// MigrateNodeRet is the return value of the monsti.MigrateNode
+// signal.
+type MigrateNodeRet struct {
+	// Handled is true if the subscriber provides the requested
+	// migration.
+	Handled bool
+	// Node is the migrated JSON document of the node.
+	Node []byte
+}
+
+type migrateNodeHandler struct {
+	m *MonstiClient
+}
+
+func (r *migrateNodeHandler) Name() string {
+	return "monsti.MigrateNode"
+}
+
+func (r *migrateNodeHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(MigrateNodeArgs)
+	migration, ok := r.m.migrations[migrationKey(args_.Namespace,
+		args_.Version)]
+	if !ok {
+		return MigrateNodeRet{}, nil
+	}
+	var node map[string]interface{}
+	if err := json.Unmarshal(args_.Node, &node); err != nil {
+		return nil, fmt.Errorf("Could not decode node: %v", err)
+	}
+	if err := migration.Migrate(args_.Site, args_.Path, node); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode node: %v", err)
+	}
+	return MigrateNodeRet{Handled: true, Node: data}, nil
+}
+
+func migrationKey(namespace string, version int) string {
+	return fmt.Sprintf("%v#%v", namespace, version)
+}
+
+// AddMigrations registers the module's migrations and connects to
+// the monsti.MigrateNode signal to apply them.
+//
+// Be sure to wait for incoming signals by calling WaitSignal() on
+// this MonstiClient!
+func (s *MonstiClient) AddMigrations(migrations ...Migration) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	for _, migration := range migrations {
+		if migration.Migrate == nil {
+			return fmt.Errorf("service: Migration %v of %q has no Migrate function",
+				migration.Version, migration.Namespace)
+		}
+		err := s.RPCClient.Call("Monsti.RegisterMigration", &migration, new(int))
+		if err != nil {
+			return fmt.Errorf("service: RegisterMigration error: %v", err)
+		}
+	}
+	if s.migrations == nil {
+		s.migrations = make(map[string]Migration)
+		if err := s.AddSignalHandler(&migrateNodeHandler{s}); err != nil {
+			s.migrations = nil
+			return err
+		}
+	}
+	for _, migration := range migrations {
+		s.migrations[migrationKey(migration.Namespace,
+			migration.Version)] = migration
+	}
+	return nil
+}
+
+// MigrationResult describes an applied migration.
+type MigrationResult struct {
+	Namespace   string
+	Version     int
+	Description string
+	// Nodes holds the paths of the changed nodes.
+	Nodes []string
+}
+
+// MigrateSiteResult describes the migration of a site.
+type MigrateSiteResult struct {
+	// Migrations holds the applied migrations in the order of their
+	// application.
+	Migrations []MigrationResult
+	// Backup is the directory holding the original node documents of
+	// the changed nodes if a backup has been requested.
+	Backup string
+}
+
+// MigrateSite applies all pending migrations to the site's nodes.
+//
+// If dryRun is true, nothing will be written, but the result tells
+// which nodes would be changed. If backup is true, the original
+// documents of the changed nodes get saved in the site's data
+// directory.
+func (s *MonstiClient) MigrateSite(site string, dryRun, backup bool) (
+	*MigrateSiteResult, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site           string
+		DryRun, Backup bool
+	}{site, dryRun, backup}
+	var reply MigrateSiteResult
+	if err := s.RPCClient.Call("Monsti.MigrateSite", &args, &reply); err != nil {
+		return nil, fmt.Errorf("service: MigrateSite error: %v", err)
+	}
+	return &reply, nil
+}
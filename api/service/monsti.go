@@ -18,6 +18,7 @@ package service
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
@@ -25,9 +26,11 @@ import (
 	"net/url"
 	"reflect"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/chrneumann/htmlwidgets"
 	"github.com/chrneumann/mimemail"
 )
 
@@ -35,6 +38,26 @@ import (
 type MonstiClient struct {
 	Client
 	SignalHandlers map[string]func(interface{}) (interface{}, error)
+	// SubscriberId identifies the signal subscriptions of this
+	// client. Defaults to the client's Id. See AddSignalWorker.
+	SubscriberId string
+	// migrations maps namespaces and versions to the migrations added
+	// by AddMigrations.
+	migrations map[string]Migration
+	// fieldTypes holds the ids of the field types registered by
+	// RegisterFieldType.
+	fieldTypes map[string]bool
+	// locales are the preferred locales of translatable fields, see
+	// SetLocales.
+	locales []string
+}
+
+// subscriberId returns the id used to subscribe to signals.
+func (s *MonstiClient) subscriberId() string {
+	if len(s.SubscriberId) > 0 {
+		return s.SubscriberId
+	}
+	return s.Id
 }
 
 // NewMonstiConnection establishes a new RPC connection to a Monsti service.
@@ -67,14 +90,30 @@ func (s *MonstiClient) ModuleInitDone(module string) error {
 // nodeToData converts the node to a JSON document.
 // The Path field will be omitted.
 func nodeToData(node *Node, indent bool) ([]byte, error) {
-	var data []byte
-	var err error
 	path := node.Path
 	node.Path = ""
 	defer func() {
 		node.Path = path
 	}()
+	return encodeNode(node, indent)
+}
 
+// MarshalNode converts the node to a JSON document including the
+// node's path. It uses the same format as Monsti's node storage.
+func MarshalNode(node *Node) ([]byte, error) {
+	return encodeNode(node, false)
+}
+
+// UnmarshalNode converts a JSON document as returned by MarshalNode
+// to a node of the given site.
+func (s *MonstiClient) UnmarshalNode(site string, data []byte) (*Node, error) {
+	return dataToNode(data, s.GetNodeType, s, site)
+}
+
+// encodeNode converts the node to a JSON document.
+func encodeNode(node *Node, indent bool) ([]byte, error) {
+	var data []byte
+	var err error
 	var outNode nodeJSON
 	outNode.Node = *node
 	outNode.Type = node.Type.Id
@@ -106,18 +145,56 @@ func nodeToData(node *Node, indent bool) ([]byte, error) {
 	return data, nil
 }
 
+// ErrNodeChanged is returned by WriteNode if the node has been
+// changed since it has been read.
+var ErrNodeChanged = errors.New("service: Node has been changed in the meantime")
+
+// writeVetoedPrefix prefixes the error messages of vetoed writes.
+const writeVetoedPrefix = "service: Write vetoed: "
+
+// WriteVetoedError is returned by WriteNode if a monsti.BeforeWriteNode
+// signal handler rejected the node.
+type WriteVetoedError struct {
+	// Reason is the error message of the signal handler.
+	Reason string
+}
+
+func (e *WriteVetoedError) Error() string {
+	return writeVetoedPrefix + e.Reason
+}
+
 // WriteNode writes the given node.
+//
+// If the node's Changed attribute is set, the node will only be
+// written if the stored node has not been changed since, otherwise
+// ErrNodeChanged is returned. If a monsti.BeforeWriteNode signal
+// handler rejects the node, a *WriteVetoedError is returned. On
+// success, Changed will be set to the current time.
 func (s *MonstiClient) WriteNode(site, path string, node *Node) error {
 	if s.Error != nil {
 		return nil
 	}
+	previous := node.Changed
 	node.Changed = time.Now().UTC()
 	data, err := nodeToData(node, true)
 	if err != nil {
+		node.Changed = previous
 		return fmt.Errorf("service: Could not convert node: %v", err)
 	}
-	err = s.WriteNodeData(site, path, "node.json", data)
-	if err != nil {
+	args := struct {
+		Site, Path string
+		Node       []byte
+		Changed    time.Time
+	}{site, path, data, previous}
+	if err = s.RPCClient.Call("Monsti.WriteNode", &args, new(int)); err != nil {
+		node.Changed = previous
+		if err.Error() == ErrNodeChanged.Error() {
+			return ErrNodeChanged
+		}
+		if strings.HasPrefix(err.Error(), writeVetoedPrefix) {
+			return &WriteVetoedError{
+				strings.TrimPrefix(err.Error(), writeVetoedPrefix)}
+		}
 		return fmt.Errorf(
 			"service: Could not write node: %v", err)
 	}
@@ -229,7 +306,25 @@ func (s *MonstiClient) GetNodeData(site, path, file string) ([]byte, error) {
 	return reply, nil
 }
 
-// WriteNodeData writes data for some node.
+// ListNodeData returns the names of the node's data files, e.g.
+// attachments. Internal files like node.json or the node's history
+// are not included.
+func (s *MonstiClient) ListNodeData(site, path string) ([]string, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply []string
+	err := s.RPCClient.Call("Monsti.ListNodeData", &args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: ListNodeData error: %v", err)
+	}
+	return reply, nil
+}
+
+// WriteNodeData writes data for some node. Writing the node.json file
+// is equivalent to WriteNode without a change time, i.e. the
+// monsti.BeforeWriteNode and monsti.NodeWritten signals get emitted.
 func (s *MonstiClient) WriteNodeData(site, path, file string,
 	content []byte) error {
 	if s.Error != nil {
@@ -276,6 +371,92 @@ func (s *MonstiClient) RenameNode(site, source, target string) error {
 	return nil
 }
 
+// NodeRevision describes an archived revision of a node.
+type NodeRevision struct {
+	// Number identifies the revision. Newer revisions have higher
+	// numbers.
+	Number int
+	// Archived is the time the revision has been replaced by a newer
+	// one.
+	Archived time.Time
+	// Files lists the node data files kept in this revision,
+	// e.g. "node.json" or "__file_core.File".
+	Files []string
+}
+
+// GetNodeRevisions returns the archived revisions of the given node,
+// newest first.
+func (s *MonstiClient) GetNodeRevisions(site, path string) (
+	[]NodeRevision, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply []NodeRevision
+	err := s.RPCClient.Call("Monsti.GetNodeRevisions", args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetNodeRevisions error: %v", err)
+	}
+	return reply, nil
+}
+
+// GetNodeRevisionData returns the given data file of an archived
+// revision of the node.
+//
+// Returns a nil slice and nil error if the data does not exist.
+func (s *MonstiClient) GetNodeRevisionData(site, path string, number int,
+	file string) ([]byte, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site, Path string
+		Number     int
+		File       string
+	}{site, path, number, file}
+	var reply []byte
+	err := s.RPCClient.Call("Monsti.GetNodeRevision", args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetNodeRevision error: %v", err)
+	}
+	return reply, nil
+}
+
+// GetNodeRevision reads an archived revision of the given node.
+//
+// If the revision does not exist, it returns nil, nil.
+func (s *MonstiClient) GetNodeRevision(site, path string, number int) (
+	*Node, error) {
+	reply, err := s.GetNodeRevisionData(site, path, number, "node.json")
+	if err != nil {
+		return nil, err
+	}
+	node, err := dataToNode(reply, s.GetNodeType, s, site)
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not convert node: %v", err)
+	}
+	return node, nil
+}
+
+// RestoreNodeRevision replaces the given node's data with the data of
+// an archived revision. The replaced data will be archived as a new
+// revision.
+func (s *MonstiClient) RestoreNodeRevision(site, path string,
+	number int) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site, Path string
+		Number     int
+	}{site, path, number}
+	if err := s.RPCClient.Call("Monsti.RestoreNodeRevision", args,
+		new(int)); err != nil {
+		return fmt.Errorf("service: RestoreNodeRevision error: %v", err)
+	}
+	return nil
+}
+
 func getConfig(reply []byte, out interface{}) error {
 	if len(reply) == 0 {
 		return nil
@@ -408,8 +589,46 @@ const (
 	RemoveAction
 	RequestPasswordTokenAction
 	ChangePasswordAction
+	HistoryAction
+	UsersAction
+	ModulesAction
 )
 
+// actionNames maps actions to their names as used in URLs, e.g.
+// "@@edit", and node ACLs.
+var actionNames = []string{
+	ViewAction:                 "view",
+	EditAction:                 "edit",
+	LoginAction:                "login",
+	LogoutAction:               "logout",
+	AddAction:                  "add",
+	RemoveAction:               "remove",
+	RequestPasswordTokenAction: "request-password-token",
+	ChangePasswordAction:       "change-password",
+	HistoryAction:              "history",
+	UsersAction:                "users",
+	ModulesAction:              "modules",
+}
+
+// String returns the name of the action, e.g. "edit".
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return fmt.Sprintf("Action(%d)", uint(a))
+}
+
+// ParseAction returns the action with the given name. If there is
+// no such action, ok will be false.
+func ParseAction(name string) (action Action, ok bool) {
+	for i, actionName := range actionNames {
+		if actionName == name {
+			return Action(i), true
+		}
+	}
+	return ViewAction, false
+}
+
 // A request to be processed by a nodes service.
 type Request struct {
 	Id       uint
@@ -548,6 +767,138 @@ type User struct {
 	Password string
 	// PasswordChanged keeps the time of the last password change.
 	PasswordChanged time.Time
+	// Roles of the user, e.g. RoleEditor. Users of user databases
+	// written before roles existed are administrators.
+	Roles []string
+	// Disabled users can't login.
+	Disabled bool
+}
+
+// GetUser returns the site's user with the given login. If there is
+// no such user, it returns nil.
+func (s *MonstiClient) GetUser(site, login string) (*User, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Login string }{site, login}
+	var reply User
+	if err := s.RPCClient.Call("Monsti.GetUser", &args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetUser error: %v", err)
+	}
+	if len(reply.Login) == 0 {
+		return nil, nil
+	}
+	return &reply, nil
+}
+
+// ListUsers returns all users of the site ordered by their logins.
+func (s *MonstiClient) ListUsers(site string) ([]User, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []User
+	if err := s.RPCClient.Call("Monsti.ListUsers", site, &reply); err != nil {
+		return nil, fmt.Errorf("service: ListUsers error: %v", err)
+	}
+	return reply, nil
+}
+
+// WriteUser creates or updates the given user of the site.
+//
+// The user's password must be hashed using bcrypt. If it is empty,
+// the stored password will be kept.
+func (s *MonstiClient) WriteUser(site string, user *User) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site string
+		User *User
+	}{site, user}
+	if err := s.RPCClient.Call("Monsti.WriteUser", &args, new(int)); err != nil {
+		return fmt.Errorf("service: WriteUser error: %v", err)
+	}
+	return nil
+}
+
+// RemoveUser removes the site's user with the given login.
+func (s *MonstiClient) RemoveUser(site, login string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, Login string }{site, login}
+	if err := s.RPCClient.Call("Monsti.RemoveUser", &args, new(int)); err != nil {
+		return fmt.Errorf("service: RemoveUser error: %v", err)
+	}
+	return nil
+}
+
+// SearchResult is a node found by a search.
+type SearchResult struct {
+	// Path of the found node.
+	Path string
+	// Title of the found node.
+	Title string
+	// Snippet is a plain text excerpt of the node's content.
+	Snippet string
+	// Score is the relevance of the node. Higher is better.
+	Score int
+}
+
+// Search searches the site's public and published nodes for the
+// given terms. It returns at most limit results if limit is greater
+// than zero, ordered by relevance. Nodes which the session's user may
+// not view are omitted. Pass a nil session for anonymous visitors.
+func (s *MonstiClient) Search(site, query string, limit int,
+	session *UserSession) ([]SearchResult, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site, Query string
+		Limit       int
+		Session     *UserSession
+	}{site, query, limit, session}
+	var reply []SearchResult
+	if err := s.RPCClient.Call("Monsti.Search", &args, &reply); err != nil {
+		return nil, fmt.Errorf("service: Search error: %v", err)
+	}
+	return reply, nil
+}
+
+// User roles.
+const (
+	// Administrators may perform any action.
+	RoleAdmin = "admin"
+	// Editors may add, edit and remove nodes.
+	RoleEditor = "editor"
+	// Authors may add and edit nodes.
+	RoleAuthor = "author"
+	// Readers may view non public nodes.
+	RoleReader = "reader"
+	// RoleAnonymous is the pseudo role of unauthenticated visitors
+	// which may be used in node ACLs.
+	RoleAnonymous = "anonymous"
+)
+
+// CheckPermission returns true iff the session's user may perform the
+// given action on the given node.
+func (s *MonstiClient) CheckPermission(site, path string, action Action,
+	session *UserSession) (bool, error) {
+	if s.Error != nil {
+		return false, s.Error
+	}
+	args := struct {
+		Site, Path string
+		Action     Action
+		Session    *UserSession
+	}{site, path, action, session}
+	var reply bool
+	if err := s.RPCClient.Call("Monsti.CheckPermission", &args,
+		&reply); err != nil {
+		return false, fmt.Errorf("service: CheckPermission error: %v", err)
+	}
+	return reply, nil
 }
 
 // UserSession is a session of an authenticated or anonymous user.
@@ -556,6 +907,29 @@ type UserSession struct {
 	User *User
 	// Locale used for this session.
 	Locale string
+	// CSRFToken must be submitted with every POST request of this
+	// session.
+	CSRFToken string
+}
+
+// CSRFTokenField is the name of the form field holding the CSRF token.
+const CSRFTokenField = "CSRFToken"
+
+// CheckCSRFToken returns true iff the given token matches the
+// session's CSRF token.
+func (s *UserSession) CheckCSRFToken(token string) bool {
+	return len(s.CSRFToken) > 0 &&
+		subtle.ConstantTimeCompare([]byte(s.CSRFToken), []byte(token)) == 1
+}
+
+// AddCSRFWidget adds a hidden widget holding the session's CSRF token
+// to the given form.
+//
+// The form's data must have a string field named like CSRFTokenField
+// and token must point to this field.
+func (s *UserSession) AddCSRFWidget(form *htmlwidgets.Form, token *string) {
+	*token = s.CSRFToken
+	form.AddWidget(new(htmlwidgets.HiddenWidget), CSRFTokenField, "", "")
 }
 
 // Send given Monsti.
@@ -580,7 +954,7 @@ func (s *MonstiClient) AddSignalHandler(handler SignalHandler) error {
 	if s.Error != nil {
 		return s.Error
 	}
-	args := struct{ Id, Signal string }{s.Id, handler.Name()}
+	args := struct{ Id, Signal string }{s.subscriberId(), handler.Name()}
 	err := s.RPCClient.Call("Monsti.ConnectSignal", args, new(int))
 	if err != nil {
 		return fmt.Errorf("service: Monsti.ConnectSignal error: %v", err)
@@ -592,17 +966,60 @@ func (s *MonstiClient) AddSignalHandler(handler SignalHandler) error {
 	return nil
 }
 
+// AddSignalWorker lets the worker handle the signals this client
+// subscribed to.
+//
+// Call WaitSignal() on the worker and on this client in parallel to
+// handle several signals at once. Add the signal handlers before
+// adding workers and don't use the worker for anything else.
+func (s *MonstiClient) AddSignalWorker(worker *MonstiClient) {
+	worker.SubscriberId = s.subscriberId()
+	worker.SignalHandlers = s.SignalHandlers
+}
+
 type argWrap struct{ Wrap interface{} }
 
+// SignalError is returned by EmitSignal if some subscribers failed to
+// handle the signal or timed out. The return values of the other
+// subscribers are returned nevertheless.
+type SignalError struct {
+	// Errors maps the ids of the failed subscribers to their error
+	// messages.
+	Errors map[string]string
+}
+
+func (e *SignalError) Error() string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	messages := make([]string, 0, len(ids))
+	for _, id := range ids {
+		messages = append(messages, fmt.Sprintf("%v: %v", id, e.Errors[id]))
+	}
+	return "service: Signal subscribers failed: " + strings.Join(messages, "; ")
+}
+
 // EmitSignal emits the named signal with given arguments and return
 // value.
+//
+// retarg must be a pointer to a slice which receives the return values
+// of the subscribers. It may be nil if the signal does not return any
+// values.
+//
+// The signal is sent to all subscribers in parallel. If some of them
+// fail or time out, EmitSignal returns a *SignalError and retarg
+// receives the return values of the remaining subscribers.
 func (s *MonstiClient) EmitSignal(name string, args interface{},
 	retarg interface{}) error {
 	if s.Error != nil {
 		return s.Error
 	}
-	gob.RegisterName(name+"Ret", reflect.Zero(
-		reflect.TypeOf(retarg).Elem().Elem()).Interface())
+	if retarg != nil {
+		gob.RegisterName(name+"Ret", reflect.Zero(
+			reflect.TypeOf(retarg).Elem().Elem()).Interface())
+	}
 	gob.RegisterName(name+"Args", args)
 	var args_ struct {
 		Name string
@@ -616,22 +1033,51 @@ func (s *MonstiClient) EmitSignal(name string, args interface{},
 	}
 	args_.Name = name
 	args_.Args = buffer.Bytes()
-	var ret [][]byte
+	var ret []struct {
+		Subscriber string
+		Ret        []byte
+		Err        string
+	}
 	err = s.RPCClient.Call("Monsti.EmitSignal", args_, &ret)
 	if err != nil {
 		return fmt.Errorf("service: Monsti.EmitSignal error: %v", err)
 	}
-	reflect.ValueOf(retarg).Elem().Set(reflect.MakeSlice(
-		reflect.TypeOf(retarg).Elem(), len(ret), len(ret)))
-	for i, answer := range ret {
-		buffer = bytes.NewBuffer(answer)
+	var signalErr *SignalError
+	var values []reflect.Value
+	for _, answer := range ret {
+		if len(answer.Err) > 0 {
+			if signalErr == nil {
+				signalErr = &SignalError{make(map[string]string)}
+			}
+			signalErr.Errors[answer.Subscriber] = answer.Err
+			continue
+		}
+		if retarg == nil {
+			continue
+		}
+		buffer = bytes.NewBuffer(answer.Ret)
 		dec := gob.NewDecoder(buffer)
 		var ret_ argWrap
 		err = dec.Decode(&ret_)
 		if err != nil {
 			return fmt.Errorf("service: Could not decode signal return value: %v", err)
 		}
-		reflect.ValueOf(retarg).Elem().Index(i).Set(reflect.ValueOf(ret_.Wrap))
+		value := reflect.ValueOf(ret_.Wrap)
+		if ret_.Wrap == nil {
+			value = reflect.Zero(reflect.TypeOf(retarg).Elem().Elem())
+		}
+		values = append(values, value)
+	}
+	if retarg != nil {
+		slice := reflect.MakeSlice(reflect.TypeOf(retarg).Elem(), len(values),
+			len(values))
+		for i, value := range values {
+			slice.Index(i).Set(value)
+		}
+		reflect.ValueOf(retarg).Elem().Set(slice)
+	}
+	if signalErr != nil {
+		return signalErr
 	}
 	return nil
 }
@@ -640,16 +1086,17 @@ func (s *MonstiClient) EmitSignal(name string, args interface{},
 //
 // You have to connect to some signals before. See AddSignalHandler.
 // This method must not be called in parallel by the same client
-// instance.
+// instance. Use AddSignalWorker to handle signals in parallel.
 func (s *MonstiClient) WaitSignal() error {
 	if s.Error != nil {
 		return s.Error
 	}
 	signal := struct {
-		Name string
-		Args []byte
+		Ticket uint64
+		Name   string
+		Args   []byte
 	}{}
-	err := s.RPCClient.Call("Monsti.WaitSignal", s.Id, &signal)
+	err := s.RPCClient.Call("Monsti.WaitSignal", s.subscriberId(), &signal)
 	if err != nil {
 		return fmt.Errorf("service: Monsti.WaitSignal error: %v", err)
 	}
@@ -674,10 +1121,11 @@ func (s *MonstiClient) WaitSignal() error {
 		ret, reterr = s.SignalHandlers[signal.Name](args_.Wrap)
 	}()
 	signalRet := &struct {
-		Id  string
-		Err string
-		Ret []byte
-	}{Id: s.Id}
+		Id     string
+		Ticket uint64
+		Err    string
+		Ret    []byte
+	}{Id: s.subscriberId(), Ticket: signal.Ticket}
 	buffer = &bytes.Buffer{}
 	if reterr == nil {
 		enc := gob.NewEncoder(buffer)
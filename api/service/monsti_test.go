@@ -48,7 +48,7 @@ func TestDataToNode(t *testing.T) {
 		Id:   "foo.Bar",
 		Name: map[string]string{"en": "A Bar"},
 		Fields: []*NodeField{
-			{"foo.FooField", map[string]string{"en": "A FooField"}, false, "Text"},
+			{"foo.FooField", map[string]string{"en": "A FooField"}, false, "Text", nil, false},
 		},
 		Embed: nil}
 	data := []byte(`
@@ -89,12 +89,12 @@ func TestNodeToData(t *testing.T) {
 		Type: &NodeType{
 			Id: "foo.Bar",
 			Fields: []*NodeField{
-				{"foo.FooField", nil, false, "Text"},
+				{"foo.FooField", nil, false, "Text", nil, false},
 			},
 			Embed: nil,
 		},
 		LocalFields: []*NodeField{
-			{"foo.BarField", nil, false, "Text"},
+			{"foo.BarField", nil, false, "Text", nil, false},
 		},
 	}
 	node.InitFields(nil, "")
@@ -124,6 +124,7 @@ func TestNodeToData(t *testing.T) {
 			],
 		  "Public": false,
 		  "PublishTime": "0001-01-01T00:00:00Z",
+		  "UnpublishTime": "0001-01-01T00:00:00Z",
       "Changed":"0001-01-01T00:00:00Z",
 		  "Type": "foo.Bar",
 		  "Fields": {
@@ -152,4 +153,32 @@ func TestNodeToData(t *testing.T) {
 		t.Errorf("nodeToData(%v, true) is\n`%v`\n, should be\n`%v`", node,
 			trim(string(ret)), trim(expected))
 	}
+	ret, err = MarshalNode(&node)
+	if err != nil {
+		t.Errorf("MarshalNode returned error: %v", err)
+	}
+	expected = `{"Path":"/foo",` + trim(expected)[1:]
+	if string(ret) != expected {
+		t.Errorf("MarshalNode(%v) is\n`%v`\n, should be\n`%v`", node,
+			string(ret), expected)
+	}
+}
+
+func TestCheckCSRFToken(t *testing.T) {
+	tests := []struct {
+		Session, Token string
+		Valid          bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		session := UserSession{CSRFToken: test.Session}
+		if ret := session.CheckCSRFToken(test.Token); ret != test.Valid {
+			t.Errorf("CheckCSRFToken(%q) with session token %q = %v, should be %v",
+				test.Token, test.Session, ret, test.Valid)
+		}
+	}
 }
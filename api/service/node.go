@@ -233,37 +233,69 @@ type Node struct {
 	// PublishTime holds the time the node has been or should be
 	// published.
 	PublishTime time.Time
+	// UnpublishTime holds the time the node should no longer be
+	// published. The node stays published if it is zero.
+	UnpublishTime time.Time
 	// Changed is updated with the current time on every write to the
 	// database.
 	Changed time.Time
+	// ACL maps role names to the names of the actions users with this
+	// role may perform on this node and its descendants, e.g.
+	// {"author": ["view", "edit"]}. It overrides the roles' default
+	// permissions. The nearest ancestor's ACL applies to nodes without
+	// an ACL.
+	ACL map[string][]string `json:",omitempty"`
+}
+
+// IsPublished returns true if the node is public and published at the
+// given time.
+func (n *Node) IsPublished(at time.Time) bool {
+	return n.Public && !n.PublishTime.After(at) &&
+		(n.UnpublishTime.IsZero() || n.UnpublishTime.After(at))
+}
+
+// IsListed returns true if the node may be listed to anonymous
+// visitors at the given time, i.e. if it's published or a core.Path
+// node grouping other nodes, like the year and month directories of
+// blogs. Permissions granted by ACLs have to be checked separately.
+func (n *Node) IsListed(at time.Time) bool {
+	return n.IsPublished(at) || n.Type != nil && n.Type.Id == "core.Path"
 }
 
 func (n *Node) InitFields(m *MonstiClient, site string) error {
 	n.Fields = make(map[string]Field)
 	nodeFields := append(n.Type.Fields, n.LocalFields...)
 	for _, field := range nodeFields {
-		var val Field
-		switch field.Type {
-		case "DateTime":
-			val = new(DateTimeField)
-		case "File":
-			val = new(FileField)
-		case "Text":
-			val = new(TextField)
-		case "HTMLArea":
-			val = new(HTMLField)
-		default:
-			return fmt.Errorf("Unknown field type %q for node %q", field.Type, n.Path)
-		}
-		err := val.Init(m, site)
+		factory, err := fieldFactory(m, site, field)
 		if err != nil {
-			return fmt.Errorf("Could not init field %q: %v", field.Id, err)
+			return fmt.Errorf("Could not init field %q of node %q: %v", field.Id,
+				n.Path, err)
+		}
+		var val Field
+		if field.Translatable {
+			translatable := &TranslatableField{newField: factory}
+			if m != nil {
+				translatable.SetLocales(m.locales...)
+			}
+			val = translatable
+		} else if val, err = factory(); err != nil {
+			return err
 		}
 		n.Fields[field.Id] = val
 	}
 	return nil
 }
 
+// SetLocale sets the preferred locales of the node's translatable
+// fields, most preferred first.
+func (n *Node) SetLocale(locales ...string) {
+	for _, field := range n.Fields {
+		if translatable, ok := field.(*TranslatableField); ok {
+			translatable.SetLocales(locales...)
+		}
+	}
+}
+
 func (n Node) GetField(id string) Field {
 	return n.Fields[id]
 }
@@ -337,6 +369,11 @@ type NodeField struct {
 	Name     map[string]string
 	Required bool
 	Type     string
+	// Options are the selectable values of Select and MultiSelect
+	// fields.
+	Options []FieldOption `json:",omitempty"`
+	// Translatable fields hold a value per locale of the site.
+	Translatable bool `json:",omitempty"`
 }
 
 type EmbedNode struct {
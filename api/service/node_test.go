@@ -107,3 +107,45 @@ func TestGetPathPrefix(t *testing.T) {
 		}
 	}
 }
+
+func TestIsPublished(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := []struct {
+		Node      Node
+		Published bool
+	}{
+		{Node{}, false},
+		{Node{Public: true}, true},
+		{Node{Public: true, PublishTime: now}, true},
+		{Node{Public: true, PublishTime: after}, false},
+		{Node{Public: true, PublishTime: before, UnpublishTime: after}, true},
+		{Node{Public: true, PublishTime: before, UnpublishTime: now}, false},
+		{Node{Public: false, PublishTime: before, UnpublishTime: after}, false},
+	}
+	for i, test := range tests {
+		if ret := test.Node.IsPublished(now); ret != test.Published {
+			t.Errorf("Test %v: IsPublished(%v) should be %v, got %v",
+				i, now, test.Published, ret)
+		}
+	}
+}
+
+func TestIsListed(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Node   Node
+		Listed bool
+	}{
+		{Node{}, false},
+		{Node{Public: true}, true},
+		{Node{Type: &NodeType{Id: "core.Document"}}, false},
+		{Node{Type: &NodeType{Id: "core.Path"}}, true},
+	}
+	for i, test := range tests {
+		if ret := test.Node.IsListed(now); ret != test.Listed {
+			t.Errorf("Test %v: IsListed(%v) should be %v, got %v",
+				i, now, test.Listed, ret)
+		}
+	}
+}
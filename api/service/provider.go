@@ -22,6 +22,7 @@ import (
 	"net"
 	"net/rpc"
 	"os"
+	"sync"
 )
 
 type Provider struct {
@@ -29,6 +30,8 @@ type Provider struct {
 	listener net.Listener
 	service  string
 	rcvr     interface{}
+	closed   bool
+	mutex    sync.Mutex
 }
 
 // NewProvider returns a new Provider for the given service and using
@@ -55,6 +58,12 @@ func (p *Provider) Accept() error {
 	for {
 		conn, err := p.listener.Accept()
 		if err != nil {
+			p.mutex.Lock()
+			closed := p.closed
+			p.mutex.Unlock()
+			if closed {
+				return nil
+			}
 			return fmt.Errorf("service: Could not accept connection for %q: %v",
 				p.service, err)
 		}
@@ -70,3 +79,15 @@ func (p *Provider) Accept() error {
 	}
 	return nil
 }
+
+// Close stops accepting connections and removes the socket. Accept
+// returns nil after the provider has been closed.
+func (p *Provider) Close() error {
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+	if err := p.listener.Close(); err != nil {
+		return fmt.Errorf("service: Could not close listener: %v", err)
+	}
+	return nil
+}
@@ -16,11 +16,23 @@
 
 package service
 
-import "encoding/gob"
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
 
 func init() {
 	gob.RegisterName("monsti.NodeContextArgs", NodeContextArgs{})
 	gob.RegisterName("monsti.NodeContextRet", map[string]string{})
+	gob.RegisterName("monsti.NodePublishedArgs", NodePublishedArgs{})
+	gob.RegisterName("monsti.NodeUnpublishedArgs", NodeUnpublishedArgs{})
+	gob.RegisterName("monsti.BeforeWriteNodeArgs", BeforeWriteNodeArgs{})
+	gob.RegisterName("monsti.BeforeWriteNodeRet", BeforeWriteNodeRet{})
+	gob.RegisterName("monsti.NodeWrittenArgs", NodeWrittenArgs{})
+	gob.RegisterName("monsti.NodeRemovedArgs", NodeRemovedArgs{})
+	gob.RegisterName("monsti.NodeRenamedArgs", NodeRenamedArgs{})
+	gob.RegisterName("monsti.UserLoggedInArgs", UserLoggedInArgs{})
 }
 
 // SignalHandler wraps a handler for a specific signal.
@@ -57,3 +69,210 @@ func NewNodeContextHandler(
 		embedNode *EmbedNode) map[string]string) SignalHandler {
 	return &nodeContextHandler{cb}
 }
+
+// NodePublishedArgs are the arguments of the monsti.NodePublished
+// signal.
+type NodePublishedArgs struct {
+	Site, Path string
+}
+
+type nodePublishedHandler struct {
+	f func(site, path string) error
+}
+
+func (r *nodePublishedHandler) Name() string {
+	return "monsti.NodePublished"
+}
+
+func (r *nodePublishedHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(NodePublishedArgs)
+	return nil, r.f(args_.Site, args_.Path)
+}
+
+// NewNodePublishedHandler constructs a signal handler that gets called
+// when the publish time of a node has been reached.
+func NewNodePublishedHandler(cb func(site, path string) error) SignalHandler {
+	return &nodePublishedHandler{cb}
+}
+
+// NodeUnpublishedArgs are the arguments of the monsti.NodeUnpublished
+// signal.
+type NodeUnpublishedArgs struct {
+	Site, Path string
+}
+
+type nodeUnpublishedHandler struct {
+	f func(site, path string) error
+}
+
+func (r *nodeUnpublishedHandler) Name() string {
+	return "monsti.NodeUnpublished"
+}
+
+func (r *nodeUnpublishedHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(NodeUnpublishedArgs)
+	return nil, r.f(args_.Site, args_.Path)
+}
+
+// NewNodeUnpublishedHandler constructs a signal handler that gets
+// called when the unpublish time of a node has been reached.
+func NewNodeUnpublishedHandler(cb func(site, path string) error) SignalHandler {
+	return &nodeUnpublishedHandler{cb}
+}
+
+// BeforeWriteNodeArgs are the arguments of the monsti.BeforeWriteNode
+// signal.
+type BeforeWriteNodeArgs struct {
+	Site, Path string
+	// Node is the JSON document of the node to be written.
+	Node []byte
+}
+
+// BeforeWriteNodeRet is the return value of the monsti.BeforeWriteNode
+// signal.
+type BeforeWriteNodeRet struct {
+	// Node is the JSON document of the changed node or nil if the
+	// handler did not change the node.
+	Node []byte
+	// Veto holds the reason if the handler rejected the node.
+	Veto string
+}
+
+type beforeWriteNodeHandler struct {
+	m *MonstiClient
+	f func(site string, node *Node) error
+}
+
+func (r *beforeWriteNodeHandler) Name() string {
+	return "monsti.BeforeWriteNode"
+}
+
+func (r *beforeWriteNodeHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(BeforeWriteNodeArgs)
+	node, err := dataToNode(args_.Node, r.m.GetNodeType, r.m, args_.Site)
+	if err != nil {
+		return nil, fmt.Errorf("Could not convert node: %v", err)
+	}
+	node.Path = args_.Path
+	if err := r.f(args_.Site, node); err != nil {
+		return BeforeWriteNodeRet{Veto: err.Error()}, nil
+	}
+	data, err := nodeToData(node, true)
+	if err != nil {
+		return nil, fmt.Errorf("Could not convert node: %v", err)
+	}
+	if bytes.Equal(data, args_.Node) {
+		data = nil
+	}
+	return BeforeWriteNodeRet{Node: data}, nil
+}
+
+// NewBeforeWriteNodeHandler constructs a signal handler that gets
+// called before a node is written. The handler may change the given
+// node. If it returns an error, the node will not be written and
+// WriteNode returns a *WriteVetoedError holding the error message.
+//
+// The handler must not write the node itself. m is used to look up
+// the node's type and fields.
+func NewBeforeWriteNodeHandler(m *MonstiClient,
+	cb func(site string, node *Node) error) SignalHandler {
+	return &beforeWriteNodeHandler{m, cb}
+}
+
+// NodeWrittenArgs are the arguments of the monsti.NodeWritten signal.
+type NodeWrittenArgs struct {
+	Site, Path string
+}
+
+type nodeWrittenHandler struct {
+	f func(site, path string) error
+}
+
+func (r *nodeWrittenHandler) Name() string {
+	return "monsti.NodeWritten"
+}
+
+func (r *nodeWrittenHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(NodeWrittenArgs)
+	return nil, r.f(args_.Site, args_.Path)
+}
+
+// NewNodeWrittenHandler constructs a signal handler that gets called
+// after a node has been written.
+func NewNodeWrittenHandler(cb func(site, path string) error) SignalHandler {
+	return &nodeWrittenHandler{cb}
+}
+
+// NodeRemovedArgs are the arguments of the monsti.NodeRemoved signal.
+type NodeRemovedArgs struct {
+	Site, Path string
+}
+
+type nodeRemovedHandler struct {
+	f func(site, path string) error
+}
+
+func (r *nodeRemovedHandler) Name() string {
+	return "monsti.NodeRemoved"
+}
+
+func (r *nodeRemovedHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(NodeRemovedArgs)
+	return nil, r.f(args_.Site, args_.Path)
+}
+
+// NewNodeRemovedHandler constructs a signal handler that gets called
+// after a node and its descendants have been removed.
+func NewNodeRemovedHandler(cb func(site, path string) error) SignalHandler {
+	return &nodeRemovedHandler{cb}
+}
+
+// NodeRenamedArgs are the arguments of the monsti.NodeRenamed signal.
+type NodeRenamedArgs struct {
+	Site, Source, Target string
+}
+
+type nodeRenamedHandler struct {
+	f func(site, source, target string) error
+}
+
+func (r *nodeRenamedHandler) Name() string {
+	return "monsti.NodeRenamed"
+}
+
+func (r *nodeRenamedHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(NodeRenamedArgs)
+	return nil, r.f(args_.Site, args_.Source, args_.Target)
+}
+
+// NewNodeRenamedHandler constructs a signal handler that gets called
+// after a node and its descendants have been moved.
+func NewNodeRenamedHandler(
+	cb func(site, source, target string) error) SignalHandler {
+	return &nodeRenamedHandler{cb}
+}
+
+// UserLoggedInArgs are the arguments of the monsti.UserLoggedIn
+// signal.
+type UserLoggedInArgs struct {
+	Site, Login string
+}
+
+type userLoggedInHandler struct {
+	f func(site, login string) error
+}
+
+func (r *userLoggedInHandler) Name() string {
+	return "monsti.UserLoggedIn"
+}
+
+func (r *userLoggedInHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(UserLoggedInArgs)
+	return nil, r.f(args_.Site, args_.Login)
+}
+
+// NewUserLoggedInHandler constructs a signal handler that gets called
+// after a user has logged in.
+func NewUserLoggedInHandler(cb func(site, login string) error) SignalHandler {
+	return &userLoggedInHandler{cb}
+}
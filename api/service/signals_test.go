@@ -0,0 +1,122 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNotificationHandlers(t *testing.T) {
+	var called []string
+	record := func(args ...string) error {
+		called = args
+		if args[0] == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	tests := []struct {
+		Handler SignalHandler
+		Name    string
+		Args    interface{}
+		Called  []string
+	}{
+		{NewNodePublishedHandler(func(site, path string) error {
+			return record(site, path)
+		}), "monsti.NodePublished", NodePublishedArgs{"site", "/foo"},
+			[]string{"site", "/foo"}},
+		{NewNodeUnpublishedHandler(func(site, path string) error {
+			return record(site, path)
+		}), "monsti.NodeUnpublished", NodeUnpublishedArgs{"site", "/foo"},
+			[]string{"site", "/foo"}},
+		{NewNodeWrittenHandler(func(site, path string) error {
+			return record(site, path)
+		}), "monsti.NodeWritten", NodeWrittenArgs{"site", "/foo"},
+			[]string{"site", "/foo"}},
+		{NewNodeRemovedHandler(func(site, path string) error {
+			return record(site, path)
+		}), "monsti.NodeRemoved", NodeRemovedArgs{"fail", "/foo"},
+			[]string{"fail", "/foo"}},
+		{NewNodeRenamedHandler(func(site, source, target string) error {
+			return record(site, source, target)
+		}), "monsti.NodeRenamed", NodeRenamedArgs{"site", "/foo", "/bar"},
+			[]string{"site", "/foo", "/bar"}},
+		{NewUserLoggedInHandler(func(site, login string) error {
+			return record(site, login)
+		}), "monsti.UserLoggedIn", UserLoggedInArgs{"site", "admin"},
+			[]string{"site", "admin"}},
+	}
+	for _, test := range tests {
+		called = nil
+		if test.Handler.Name() != test.Name {
+			t.Errorf("Handler name is %q, should be %q", test.Handler.Name(),
+				test.Name)
+		}
+		ret, err := test.Handler.Handle(test.Args)
+		if ret != nil {
+			t.Errorf("%v handler returned %v, should return nil", test.Name, ret)
+		}
+		if (err != nil) != (test.Called[0] == "fail") {
+			t.Errorf("%v handler returned error %v", test.Name, err)
+		}
+		if !reflect.DeepEqual(called, test.Called) {
+			t.Errorf("%v handler called callback with %v, should be %v",
+				test.Name, called, test.Called)
+		}
+	}
+}
+
+func TestSignalError(t *testing.T) {
+	err := &SignalError{map[string]string{"b": "timed out", "a": "failed"}}
+	expected := "service: Signal subscribers failed: a: failed; b: timed out"
+	if err.Error() != expected {
+		t.Errorf("SignalError.Error() = %q, should be %q", err.Error(), expected)
+	}
+}
+
+func TestMigrateNodeHandler(t *testing.T) {
+	m := &MonstiClient{migrations: map[string]Migration{
+		migrationKey("foo", 2): Migration{
+			Namespace: "foo",
+			Version:   2,
+			Migrate: func(site, path string, node map[string]interface{}) error {
+				node["Bar"] = node["Foo"]
+				delete(node, "Foo")
+				return nil
+			}}}}
+	handler := &migrateNodeHandler{m}
+	tests := []struct {
+		Args MigrateNodeArgs
+		Ret  MigrateNodeRet
+	}{
+		{MigrateNodeArgs{"site", "/", "foo", 2, []byte(`{"Foo":1}`)},
+			MigrateNodeRet{true, []byte(`{"Bar":1}`)}},
+		{MigrateNodeArgs{"site", "/", "foo", 1, []byte(`{"Foo":1}`)},
+			MigrateNodeRet{}},
+		{MigrateNodeArgs{"site", "/", "bar", 2, []byte(`{"Foo":1}`)},
+			MigrateNodeRet{}},
+	}
+	for i, test := range tests {
+		ret, err := handler.Handle(test.Args)
+		if err != nil || !reflect.DeepEqual(ret, test.Ret) {
+			t.Errorf("Test %v: Handle() = %v, %v, should be %v", i, ret, err,
+				test.Ret)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// TranslatableField holds the values of a translatable node field,
+// one field per locale.
+//
+// Its values get stored as JSON object mapping locales to the values,
+// e.g. {"en": "Hello", "de": "Hallo"}. A value stored before the
+// field has been made translatable is kept as value of the empty
+// locale and used for missing translations. Field types dumping JSON
+// objects can't be translated.
+type TranslatableField struct {
+	newField func() (Field, error)
+	// locales are the preferred locales, most preferred first.
+	locales []string
+	values  map[string]Field
+}
+
+// SetLocales sets the preferred locales, most preferred first.
+//
+// The field renders the value of the first preferred locale having
+// one. Form submissions change the value of the most preferred
+// locale.
+func (t *TranslatableField) SetLocales(locales ...string) {
+	t.locales = locales
+}
+
+// Translation returns the field holding the value of the given
+// locale or nil if there is no such value.
+func (t *TranslatableField) Translation(locale string) Field {
+	return t.values[locale]
+}
+
+// Locales returns the sorted locales having a value.
+func (t *TranslatableField) Locales() []string {
+	locales := make([]string, 0, len(t.values))
+	for locale := range t.values {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// current returns the field of the first preferred locale having a
+// value, the untranslated value or any other value. It returns nil if
+// there are no values at all.
+func (t *TranslatableField) current() Field {
+	for _, locale := range append(t.locales, "") {
+		if value, ok := t.values[locale]; ok {
+			return value
+		}
+	}
+	if locales := t.Locales(); len(locales) > 0 {
+		return t.values[locales[0]]
+	}
+	return nil
+}
+
+func (t *TranslatableField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t *TranslatableField) String() string {
+	if value := t.current(); value != nil {
+		return value.String()
+	}
+	return ""
+}
+
+func (t *TranslatableField) RenderHTML() interface{} {
+	if value := t.current(); value != nil {
+		return value.RenderHTML()
+	}
+	return ""
+}
+
+func (t *TranslatableField) Load(f func(interface{}) error) error {
+	var raw json.RawMessage
+	if err := f(&raw); err != nil {
+		return err
+	}
+	values := make(map[string]json.RawMessage)
+	if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		values[""] = raw
+	} else if err := json.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("Could not decode translations: %v", err)
+	}
+	t.values = make(map[string]Field, len(values))
+	for locale, value := range values {
+		field, err := t.newField()
+		if err != nil {
+			return err
+		}
+		value := value
+		if err := field.Load(func(in interface{}) error {
+			return json.Unmarshal(value, in)
+		}); err != nil {
+			return fmt.Errorf("Could not load translation %q: %v", locale, err)
+		}
+		t.values[locale] = field
+	}
+	return nil
+}
+
+// Dump returns the values mapped by their locales. A single
+// untranslated value is dumped as is.
+func (t *TranslatableField) Dump() interface{} {
+	if value, ok := t.values[""]; ok && len(t.values) == 1 {
+		return value.Dump()
+	}
+	if len(t.values) == 0 {
+		if value, err := t.newField(); err == nil {
+			return value.Dump()
+		}
+		return nil
+	}
+	values := make(map[string]interface{}, len(t.values))
+	for locale, value := range t.values {
+		values[locale] = value.Dump()
+	}
+	return values
+}
+
+// ToFormField adds the form field of the current value. The most
+// preferred locale gets appended to the field's name.
+func (t *TranslatableField) ToFormField(form *htmlwidgets.Form,
+	data util.NestedMap, field *NodeField, locale string) {
+	value := t.current()
+	if value == nil {
+		var err error
+		if value, err = t.newField(); err != nil {
+			return
+		}
+	}
+	if len(t.locales) > 0 {
+		translated := *field
+		translated.Name = map[string]string{locale: fmt.Sprintf("%v (%v)",
+			field.Name[locale], t.locales[0])}
+		field = &translated
+	}
+	value.ToFormField(form, data, field, locale)
+}
+
+// FromFormField sets the value of the most preferred locale.
+func (t *TranslatableField) FromFormField(data util.NestedMap,
+	field *NodeField) {
+	locale := ""
+	if len(t.locales) > 0 {
+		locale = t.locales[0]
+	}
+	value, ok := t.values[locale]
+	if !ok {
+		var err error
+		if value, err = t.newField(); err != nil {
+			return
+		}
+		if t.values == nil {
+			t.values = make(map[string]Field)
+		}
+		t.values[locale] = value
+	}
+	value.FromFormField(data, field)
+}
+
+// SetLocales sets the preferred locales of translatable fields of the
+// nodes returned by this client, most preferred first.
+func (s *MonstiClient) SetLocales(locales ...string) {
+	s.locales = locales
+}
@@ -0,0 +1,88 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestTranslatableField(t *testing.T) {
+	field := &NodeField{Id: "foo.Title", Type: "Text", Translatable: true}
+	node := Node{Type: &NodeType{Fields: []*NodeField{field}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("InitFields returned error: %v", err)
+	}
+	translatable, ok := node.GetField(field.Id).(*TranslatableField)
+	if !ok {
+		t.Fatalf("Translatable fields should be a *TranslatableField, got %T",
+			node.GetField(field.Id))
+	}
+	load := func(value string) {
+		if err := translatable.Load(func(in interface{}) error {
+			return json.Unmarshal([]byte(value), in)
+		}); err != nil {
+			t.Fatalf("Load(%v) returned error: %v", value, err)
+		}
+	}
+	dump := func() string {
+		ret, _ := json.Marshal(translatable.Dump())
+		return string(ret)
+	}
+
+	if ret := dump(); ret != `""` {
+		t.Errorf("Empty field should dump to the empty value, got %v", ret)
+	}
+	load(`"Untranslated"`)
+	node.SetLocale("de", "en")
+	if ret := translatable.String(); ret != "Untranslated" {
+		t.Errorf("Untranslated value should be used, got %q", ret)
+	}
+	if ret := dump(); ret != `"Untranslated"` {
+		t.Errorf("Untranslated value should be dumped as is, got %v", ret)
+	}
+
+	load(`{"en":"Hello","de":"Hallo"}`)
+	tests := []struct {
+		Locales []string
+		String  string
+	}{
+		{[]string{"de", "en"}, "Hallo"},
+		{[]string{"fr", "en"}, "Hello"},
+		{nil, "Hallo"},
+	}
+	for _, test := range tests {
+		node.SetLocale(test.Locales...)
+		if ret := translatable.String(); ret != test.String {
+			t.Errorf("String() with locales %v = %q, should be %q", test.Locales,
+				ret, test.String)
+		}
+	}
+
+	node.SetLocale("fr", "en")
+	data := make(util.NestedMap)
+	data.Set(field.Id, "Bonjour")
+	translatable.FromFormField(data, field)
+	if ret := dump(); ret != `{"de":"Hallo","en":"Hello","fr":"Bonjour"}` {
+		t.Errorf("FromFormField should set the preferred locale, got %v", ret)
+	}
+	if ret := translatable.Translation("en").String(); ret != "Hello" {
+		t.Errorf("Translation(%q) = %q, should be %q", "en", ret, "Hello")
+	}
+}
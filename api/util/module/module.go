@@ -41,6 +41,18 @@ type ModuleContext struct {
 	Session  *service.Session
 	Logger   *log.Logger
 	Renderer *mtemplate.Renderer
+	// SignalWorkers is the number of sessions waiting for signals in
+	// parallel. The setup function may change it. Defaults to 1.
+	SignalWorkers int
+}
+
+// waitSignals handles incoming signals. It never returns.
+func waitSignals(monsti *service.MonstiClient, logger *log.Logger) {
+	for {
+		if err := monsti.WaitSignal(); err != nil {
+			logger.Printf("Could not wait for signal: %v", err)
+		}
+	}
 }
 
 // StartModule sets up the module with the given name.
@@ -60,7 +72,8 @@ func StartModule(name string, setup func(context *ModuleContext) error) {
 	gettext.DefaultLocales.LocaleDir = settings.Directories.Locale
 
 	renderer := mtemplate.Renderer{
-		Root: settings.GetTemplatesPath()}
+		Root: settings.GetTemplatesPath(),
+		Dev:  settings.Dev}
 	monstiPath := settings.GetServicePath(service.MonstiService.String())
 	sessions := service.NewSessionPool(1, monstiPath)
 
@@ -69,17 +82,22 @@ func StartModule(name string, setup func(context *ModuleContext) error) {
 		logger.Fatalf("Could not get session: %v", err)
 	}
 	defer sessions.Free(session)
-	if err := setup(&ModuleContext{
-		settings, sessions, session, logger, &renderer,
-	}); err != nil {
-		logger.Fatalf("Could not setup module: %v", err)
+	context := &ModuleContext{
+		settings, sessions, session, logger, &renderer, 1,
 	}
-	if err := session.Monsti().ModuleInitDone("example-module"); err != nil {
-		logger.Fatalf("Could not finish initialization: %v", err)
+	if err := setup(context); err != nil {
+		logger.Fatalf("Could not setup module: %v", err)
 	}
-	for {
-		if err := session.Monsti().WaitSignal(); err != nil {
-			logger.Printf("Could not wait for signal: %v", err)
+	for i := 1; i < context.SignalWorkers; i++ {
+		worker, err := sessions.New()
+		if err != nil {
+			logger.Fatalf("Could not get session for signal worker: %v", err)
 		}
+		session.Monsti().AddSignalWorker(worker.Monsti())
+		go waitSignals(worker.Monsti(), logger)
+	}
+	if err := session.Monsti().ModuleInitDone(name); err != nil {
+		logger.Fatalf("Could not finish initialization: %v", err)
 	}
+	waitSignals(session.Monsti(), logger)
 }
@@ -35,8 +35,34 @@ type SiteSettings struct {
 	SessionAuthKey string
 	// Key to authenticate password request tokens.
 	PasswordTokenKey string
-	// Locale used to translate monsti's web interface.
+	// Locale used to translate monsti's web interface. It's also the
+	// default locale of the site's content.
 	Locale string
+	// Locales of multilingual sites, e.g. ["en", "de"]. Visitors get
+	// translatable fields in their preferred locale.
+	Locales []string
+	// Theme is the name of the site's theme, i.e. of a directory in
+	// Monsti's themes directory.
+	Theme string
+	// Themes holds the site's theme followed by its ancestors. It's
+	// set by LoadSiteSettings.
+	Themes []string
+	// Storage configures where the site's nodes are stored.
+	Storage struct {
+		// Type of the storage backend. One of "filesystem" (default),
+		// "bolt" or "memory".
+		Type string
+		// Path to the database file of the bolt backend, relative to the
+		// site's data directory. Defaults to "nodes.db".
+		Path string
+	}
+	// History configures the archived revisions of nodes.
+	History struct {
+		// MaxRevisions is the number of revisions kept per node. Older
+		// revisions get removed. Defaults to 0, i.e. all revisions are
+		// kept.
+		MaxRevisions int
+	}
 }
 
 // MonstiSettings holds common Monsti settings.
@@ -58,6 +84,9 @@ type MonstiSettings struct {
 	//
 	// Load settings with *MonstiSettings.LoadSiteSettings()
 	Sites map[string]SiteSettings
+	// Dev turns on the development mode: Templates get parsed on every
+	// use and pages are not cached.
+	Dev bool
 }
 
 // GetServicePath returns the path to the given service's socket.
@@ -141,6 +170,13 @@ func (s *MonstiSettings) LoadSiteSettings() error {
 	if err != nil {
 		return err
 	}
+	for name, site := range sites {
+		site.Themes, err = s.getThemeChain(site.Theme)
+		if err != nil {
+			return fmt.Errorf("Could not load theme of site %q: %v", name, err)
+		}
+		sites[name] = site
+	}
 	s.Sites = sites
 	return nil
 }
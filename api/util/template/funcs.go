@@ -0,0 +1,302 @@
+// This file is part of monsti/util.
+// Copyright 2012-2013 Christian Neumann
+
+// monsti/util is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+
+// monsti/util is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with monsti/util. If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// Env is the environment of a rendered template. It's used by the
+// content-aware template functions:
+//
+// getNode returns the node at the given path or nil if there is no
+// such node.
+// getChildren returns the children of the node at the given path
+// sorted by their order.
+// nodeURL returns the absolute URL of the node at the given path.
+// imageURL returns the absolute URL of the image at the given path in
+// the given size, e.g. {{imageURL "/foo.jpg" "thumbnail"}}. The size
+// must be configured in core.image.sizes.
+// formatDate formats the time in the site's timezone using the given
+// layout of package time, e.g. {{formatDate "2006-01-02" .Node.Changed}}.
+// embed returns the rendered node at the given URI relative to the
+// requested node, like the nodes embedded by a node's Embed option.
+type Env struct {
+	// Locale is the locale to use for translation strings.
+	Locale string
+	// Session is used to retrieve the site's content.
+	Session *service.Session
+	// Site is the rendered site.
+	Site util.SiteSettings
+	// UserSession is the session of the visitor. getNode and
+	// getChildren only return nodes the visitor may view. Nil for
+	// anonymous visitors.
+	UserSession *service.UserSession
+	// Embed renders the node at the given URI.
+	Embed func(uri string) (template.HTML, error)
+	// location is the site's timezone.
+	location *time.Location
+}
+
+// funcs returns the content-aware template functions.
+func (e *Env) funcs() template.FuncMap {
+	return template.FuncMap{
+		"getNode":     e.getNode,
+		"getChildren": e.getChildren,
+		"nodeURL":     e.nodeURL,
+		"imageURL":    e.imageURL,
+		"formatDate":  e.formatDate,
+		"embed":       e.embed,
+	}
+}
+
+func (e *Env) monsti() (*service.MonstiClient, error) {
+	if e.Session == nil {
+		return nil, fmt.Errorf("No session to retrieve the site's content")
+	}
+	return e.Session.Monsti(), nil
+}
+
+func (e *Env) getNode(nodePath string) (*service.Node, error) {
+	m, err := e.monsti()
+	if err != nil {
+		return nil, err
+	}
+	node, err := m.GetNode(e.Site.Name, nodePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get node: %v", err)
+	}
+	if node == nil {
+		return nil, nil
+	}
+	visible, err := e.visible(m, node, time.Now())
+	if err != nil || !visible {
+		return nil, err
+	}
+	return node, nil
+}
+
+// visible returns true if the visitor may view the node.
+func (e *Env) visible(m *service.MonstiClient, node *service.Node,
+	now time.Time) (bool, error) {
+	session := e.UserSession
+	if session == nil {
+		session = new(service.UserSession)
+	}
+	if session.User == nil && !node.IsListed(now) {
+		return false, nil
+	}
+	ok, err := m.CheckPermission(e.Site.Name, node.Path, service.ViewAction,
+		session)
+	if err != nil {
+		return false, fmt.Errorf("Could not check permission: %v", err)
+	}
+	return ok, nil
+}
+
+type nodesByOrder []*service.Node
+
+func (n nodesByOrder) Len() int      { return len(n) }
+func (n nodesByOrder) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n nodesByOrder) Less(i, j int) bool {
+	return n[i].Order < n[j].Order ||
+		n[i].Order == n[j].Order && n[i].Name() < n[j].Name()
+}
+
+func (e *Env) getChildren(nodePath string) ([]*service.Node, error) {
+	m, err := e.monsti()
+	if err != nil {
+		return nil, err
+	}
+	children, err := m.GetChildren(e.Site.Name, nodePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get children: %v", err)
+	}
+	now := time.Now()
+	ret := make([]*service.Node, 0, len(children))
+	for _, child := range children {
+		visible, err := e.visible(m, child, now)
+		if err != nil {
+			return nil, err
+		}
+		if visible {
+			ret = append(ret, child)
+		}
+	}
+	sort.Sort(nodesByOrder(ret))
+	return ret, nil
+}
+
+func (e *Env) nodeURL(nodePath string) string {
+	nodePath = path.Join("/", nodePath)
+	if nodePath != "/" {
+		nodePath += "/"
+	}
+	return strings.TrimSuffix(e.Site.BaseURL, "/") + nodePath
+}
+
+func (e *Env) imageURL(nodePath, size string) (string, error) {
+	m, err := e.monsti()
+	if err != nil {
+		return "", err
+	}
+	var dimensions struct{ Width, Height uint }
+	err = m.GetSiteConfig(e.Site.Name, "core.image.sizes."+size, &dimensions)
+	if err != nil {
+		return "", fmt.Errorf("Could not get size config: %v", err)
+	}
+	if dimensions.Width == 0 {
+		return "", fmt.Errorf("Unknown image size %q", size)
+	}
+	return strings.TrimSuffix(e.nodeURL(nodePath), "/") + "?size=" +
+		url.QueryEscape(size), nil
+}
+
+func (e *Env) formatDate(layout string, t time.Time) (string, error) {
+	if e.location == nil {
+		e.location = time.UTC
+		if e.Session != nil {
+			var timezone string
+			err := e.Session.Monsti().GetSiteConfig(e.Site.Name, "core.timezone",
+				&timezone)
+			if err != nil {
+				return "", fmt.Errorf("Could not get timezone: %v", err)
+			}
+			if location, err := time.LoadLocation(timezone); err == nil {
+				e.location = location
+			}
+		}
+	}
+	return t.In(e.location).Format(layout), nil
+}
+
+func (e *Env) embed(uri string) (template.HTML, error) {
+	if e.Embed == nil {
+		return "", fmt.Errorf("Nodes can't be embedded here")
+	}
+	return e.Embed(uri)
+}
+
+// markdown returns the given Markdown text converted to HTML.
+func markdown(in interface{}) template.HTML {
+	return service.MarkdownField(fmt.Sprint(in)).RenderHTML().(template.HTML)
+}
+
+// voidElements are the HTML elements without end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// scanHTML splits the markup into tags and characters, including
+// entities, and calls f for each of them until it returns false.
+func scanHTML(markup string, f func(token string, tag bool) bool) {
+	for len(markup) > 0 {
+		n, tag := 1, false
+		switch markup[0] {
+		case '<':
+			if end := strings.IndexByte(markup, '>'); end > 0 {
+				n, tag = end+1, true
+			}
+		case '&':
+			if end := strings.IndexByte(markup, ';'); end > 0 && end < 12 {
+				n = end + 1
+			}
+		default:
+			_, n = utf8.DecodeRuneInString(markup)
+		}
+		if !f(markup[:n], tag) {
+			return
+		}
+		markup = markup[n:]
+	}
+}
+
+// tagName returns the lower case name of the given tag.
+func tagName(tag string) string {
+	name := strings.TrimLeft(tag[1:len(tag)-1], "/")
+	if end := strings.IndexAny(name, " \t\r\n/"); end >= 0 {
+		name = name[:end]
+	}
+	return strings.ToLower(name)
+}
+
+// truncateHTML shortens the given HTML to the given number of
+// characters, not counting tags, and closes any open elements. Values
+// which are not of type template.HTML get escaped.
+func truncateHTML(length int, in interface{}) template.HTML {
+	markup, ok := in.(template.HTML)
+	if !ok {
+		markup = template.HTML(template.HTMLEscapeString(fmt.Sprint(in)))
+	}
+	chars := 0
+	scanHTML(string(markup), func(_ string, tag bool) bool {
+		if !tag {
+			chars++
+		}
+		return true
+	})
+	if chars <= length {
+		return markup
+	}
+	var out bytes.Buffer
+	var open []string
+	chars = 0
+	scanHTML(string(markup), func(token string, tag bool) bool {
+		if !tag {
+			if chars >= length {
+				return false
+			}
+			out.WriteString(token)
+			chars++
+			return chars < length
+		}
+		out.WriteString(token)
+		name := tagName(token)
+		switch {
+		case strings.HasPrefix(token, "</"):
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == name {
+					open = open[:i]
+					break
+				}
+			}
+		case strings.HasPrefix(token, "<!"), strings.HasSuffix(token, "/>"),
+			voidElements[name]:
+		default:
+			open = append(open, name)
+		}
+		return true
+	})
+	out.WriteString("…")
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return template.HTML(out.String())
+}
@@ -0,0 +1,77 @@
+package template
+
+import (
+	"html/template"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+	mtesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestTruncateHTML(t *testing.T) {
+	tests := []struct {
+		Length   int
+		In       interface{}
+		Expected template.HTML
+	}{
+		{5, template.HTML("<p>foo</p>"), "<p>foo</p>"},
+		{3, template.HTML("<p>foo</p><p>bar</p>"), "<p>foo…</p>"},
+		{4, template.HTML("<p>f<em>oo</em> bar</p>"), "<p>f<em>oo</em> …</p>"},
+		{2, template.HTML("<div>a<br>b<img src=x />c</div>"), "<div>a<br>b…</div>"},
+		{2, template.HTML("&amp;&lt;&gt;"), "&amp;&lt;…"},
+		{2, template.HTML("äöü"), "äö…"},
+		{3, "<b>bold</b>", "&lt;b&gt;…"},
+		{0, template.HTML("<p>foo</p>"), "<p>…</p>"},
+	}
+	for _, test := range tests {
+		ret := truncateHTML(test.Length, test.In)
+		if ret != test.Expected {
+			t.Errorf("truncateHTML(%v, %q) = %q, should be %q", test.Length,
+				test.In, ret, test.Expected)
+		}
+	}
+}
+
+func TestEnvNodeURL(t *testing.T) {
+	tests := []struct {
+		BaseURL, Path, Expected string
+	}{
+		{"http://example.com", "/", "http://example.com/"},
+		{"http://example.com/", "/foo", "http://example.com/foo/"},
+		{"http://example.com/", "/foo/", "http://example.com/foo/"},
+		{"", "foo/bar", "/foo/bar/"},
+	}
+	for _, test := range tests {
+		env := Env{Site: util.SiteSettings{BaseURL: test.BaseURL}}
+		if ret := env.nodeURL(test.Path); ret != test.Expected {
+			t.Errorf("nodeURL(%q) with base URL %q = %q, should be %q", test.Path,
+				test.BaseURL, ret, test.Expected)
+		}
+	}
+}
+
+func TestRenderEnv(t *testing.T) {
+	root, cleanup, err := mtesting.CreateDirectoryTree(map[string]string{
+		"/templates/foo.html": `{{formatDate "2006-01-02 15:04" .}} ` +
+			`{{embed "bar"}} {{"*foo*" | markdown}}`,
+	}, "TestRenderEnv")
+	if err != nil {
+		t.Fatalf("Could not create test directory tree: %v", err)
+	}
+	defer cleanup()
+	renderer := Renderer{Root: filepath.Join(root, "templates")}
+	env := &Env{Embed: func(uri string) (template.HTML, error) {
+		return template.HTML("<p>" + uri + "</p>"), nil
+	}}
+	date := time.Date(2014, 2, 3, 4, 5, 0, 0, time.FixedZone("CET", 3600))
+	ret, err := renderer.RenderEnv("foo", date, env)
+	expected := "2014-02-03 03:05 <p>bar</p> <p><em>foo</em></p>\n"
+	if err != nil || ret != expected {
+		t.Errorf("RenderEnv returned %q, %v, should be %q", ret, err, expected)
+	}
+	if _, err := renderer.Render("foo", date, ""); err == nil {
+		t.Errorf("Render should fail if nodes can't be embedded")
+	}
+}
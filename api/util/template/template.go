@@ -25,9 +25,13 @@ import (
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"pkg.monsti.org/gettext"
 )
@@ -36,9 +40,69 @@ import (
 type Context map[string]interface{}
 
 // A Renderer for mustache templates.
+//
+// Parsed templates are cached and parsed again if one of their files
+// has been changed, added or removed. A Renderer must not be copied
+// after first use.
 type Renderer struct {
 	// Root is the absolute path to the template directory.
 	Root string
+	// Dev disables the cache, i.e. templates get read and parsed on
+	// every call of Render.
+	Dev bool
+	// mutex protects templates.
+	mutex sync.Mutex
+	// templates maps template names and site template paths to the
+	// parsed templates.
+	templates map[templateKey]*parsedTemplate
+}
+
+type templateKey struct {
+	// siteTemplates holds the site template paths separated by null
+	// bytes.
+	name, siteTemplates string
+}
+
+// parsedTemplate is a parsed template set which has not been executed.
+type parsedTemplate struct {
+	tmpl  *template.Template
+	files templateFiles
+}
+
+// fileStamp identifies the version of a file.
+type fileStamp struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+func getFileStamp(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{true, info.ModTime(), info.Size()}
+}
+
+// templateFiles holds the stamps of the files which have been tried
+// to read to parse a template, including missing ones.
+type templateFiles map[string]fileStamp
+
+// read reads the file and records its stamp.
+func (f templateFiles) read(path string) ([]byte, error) {
+	f[path] = getFileStamp(path)
+	return ioutil.ReadFile(path)
+}
+
+// changed returns true if one of the files has been changed since it
+// has been read.
+func (f templateFiles) changed() bool {
+	for path, stamp := range f {
+		if getFileStamp(path) != stamp {
+			return true
+		}
+	}
+	return false
 }
 
 // getIncludes searches for include and template.include files.
@@ -46,9 +110,11 @@ type Renderer struct {
 // roots are the template roots to search (results will be joined and duplicates
 // removed).
 // name is the name of the template (e.g. "blocks/sidebar").
+// read is used to read the files.
 //
 // Returns a list of templates to be included.
-func getIncludes(roots []string, name string) ([]string, error) {
+func getIncludes(roots []string, name string,
+	read func(string) ([]byte, error)) ([]string, error) {
 	includes := make([]string, 0)
 	if len(name) == 0 || name[0] == filepath.Separator {
 		return nil, fmt.Errorf("Invalid template name: %q", name)
@@ -62,7 +128,7 @@ func getIncludes(roots []string, name string) ([]string, error) {
 	}
 	for _, root := range roots {
 		for _, path := range paths {
-			contents, err := ioutil.ReadFile(filepath.Join(root, path))
+			contents, err := read(filepath.Join(root, path))
 			if err != nil {
 				continue
 			}
@@ -86,8 +152,10 @@ func getIncludes(roots []string, name string) ([]string, error) {
 // name is the name of the template (e.g. "blocks/sidebar").
 // context is used as template context for rendering.
 // locale is the locale to use for translation strings in templates.
-// siteTemplates is the path to the site's overridden templates. If it's an empty
-// string, Render will not search for overridden templates.
+// siteTemplates are the paths to directories overriding Monsti's
+// templates, most specific first, e.g. the site's templates followed by
+// those of the site's theme and its parent themes. Empty paths are
+// ignored.
 //
 // Render searches for nested templates to include in these files:
 // <dir_of_template>/<template>.include
@@ -95,11 +163,38 @@ func getIncludes(roots []string, name string) ([]string, error) {
 // <any_parent_dir_of_template>/include
 //
 // Returns the rendered template.
-func (r Renderer) Render(name string, context interface{},
-	locale string, siteTemplates string) (string, error) {
-	tmpl := template.New(name)
-	G, GN, GD, GDN := gettext.DefaultLocales.Use("", locale)
-	funcs := template.FuncMap{
+func (r *Renderer) Render(name string, context interface{},
+	locale string, siteTemplates ...string) (string, error) {
+	return r.RenderEnv(name, context, &Env{Locale: locale}, siteTemplates...)
+}
+
+// RenderEnv renders the named template like Render, but lets the
+// template functions access the site's content as given by env.
+func (r *Renderer) RenderEnv(name string, context interface{}, env *Env,
+	siteTemplates ...string) (string, error) {
+	if env == nil {
+		env = new(Env)
+	}
+	parsed, err := r.getTemplate(name, siteTemplates)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := parsed.Clone()
+	if err != nil {
+		return "", fmt.Errorf("Could not clone template: %v", err)
+	}
+	tmpl.Funcs(funcs(env))
+	out := bytes.Buffer{}
+	if err := tmpl.Execute(&out, context); err != nil {
+		return "", fmt.Errorf("Could not execute template: %v", err)
+	}
+	return out.String(), nil
+}
+
+// funcs returns the template functions for the given environment.
+func funcs(env *Env) template.FuncMap {
+	G, GN, GD, GDN := gettext.DefaultLocales.Use("", env.Locale)
+	ret := template.FuncMap{
 		"pathJoin": path.Join,
 		"G":        G,
 		"GN":       GN,
@@ -111,56 +206,94 @@ func (r Renderer) Render(name string, context interface{},
 		"mapGet": func(in interface{}, key interface{}) interface{} {
 			return reflect.ValueOf(in).MapIndex(reflect.ValueOf(key)).Interface()
 		},
+		"truncateHTML": truncateHTML,
+		"markdown":     markdown,
+	}
+	for name, f := range env.funcs() {
+		ret[name] = f
+	}
+	return ret
+}
+
+// getTemplate returns the parsed template set of the named template.
+// The returned template must not be executed, but only its clones.
+func (r *Renderer) getTemplate(name string, siteTemplates []string) (
+	*template.Template, error) {
+	roots := make([]string, 0, len(siteTemplates)+1)
+	for _, root := range siteTemplates {
+		if len(root) > 0 {
+			roots = append(roots, root)
+		}
+	}
+	roots = append(roots, r.Root)
+	if r.Dev {
+		return parseTemplate(name, roots, ioutil.ReadFile)
+	}
+	key := templateKey{name, strings.Join(siteTemplates, "\x00")}
+	r.mutex.Lock()
+	cached, ok := r.templates[key]
+	r.mutex.Unlock()
+	if ok && !cached.files.changed() {
+		return cached.tmpl, nil
 	}
-	tmpl.Funcs(funcs)
-	err := parse(name, tmpl, r.Root, siteTemplates)
+	files := make(templateFiles)
+	tmpl, err := parseTemplate(name, roots, files.read)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.templates == nil {
+		r.templates = make(map[templateKey]*parsedTemplate)
 	}
-	includes, err := getIncludes([]string{r.Root, siteTemplates}, name)
+	r.templates[key] = &parsedTemplate{tmpl, files}
+	return tmpl, nil
+}
+
+// parseTemplate parses the named template and its includes using the
+// given function to read the files.
+//
+// roots are the template directories, most specific first.
+func parseTemplate(name string, roots []string,
+	read func(string) ([]byte, error)) (*template.Template, error) {
+	tmpl := template.New(name)
+	tmpl.Funcs(funcs(new(Env)))
+	err := parse(name, tmpl, roots, read)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	includes, err := getIncludes(roots, name, read)
+	if err != nil {
+		return nil, err
 	}
 	for _, v := range includes {
-		err := parse(v, tmpl.New(v), r.Root, siteTemplates)
+		err := parse(v, tmpl.New(v), roots, read)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
-	out := bytes.Buffer{}
-	if err := tmpl.Execute(&out, context); err != nil {
-		return "", fmt.Errorf("Could not execute template: %v", err)
-	}
-	return out.String(), nil
+	return tmpl, nil
 }
 
 // Parse the named template and add to the existing template structure.
 //
 // name is the name of the template (e.g. "blocks/sidebar")
 // t is the existing template structure.
-// root is the path to monsti's template
-// siteRoot is the path to the sites' overriden templates.
-func parse(name string, t *template.Template, root string,
-	siteRoot string) error {
-	if len(siteRoot) > 0 {
-		path := filepath.Join(siteRoot, name+".html")
-		content, err := ioutil.ReadFile(path)
-		if err == nil {
-			_, err = t.Parse(string(content))
-			if err != nil {
-				return fmt.Errorf("Could not parse template: %v", err)
-			}
-			return nil
+// roots are the template directories to search, most specific first.
+// The last one is usually the path to monsti's templates.
+// read is used to read the template files.
+func parse(name string, t *template.Template, roots []string,
+	read func(string) ([]byte, error)) error {
+	for _, root := range roots {
+		content, err := read(filepath.Join(root, name+".html"))
+		if err != nil {
+			continue
 		}
+		_, err = t.Parse(string(content))
+		if err != nil {
+			return fmt.Errorf("Could not parse template: %v", err)
+		}
+		return nil
 	}
-	path := filepath.Join(root, name+".html")
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
-		return fmt.Errorf("Could not load template: %v", err)
-	}
-	_, err = t.Parse(string(content))
-	if err != nil {
-		return fmt.Errorf("Could not parse template: %v", err)
-	}
-	return nil
+	return fmt.Errorf("Could not load template %q", name)
 }
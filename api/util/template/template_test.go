@@ -1,6 +1,7 @@
 package template
 
 import (
+	"io/ioutil"
 	"path/filepath"
 	"reflect"
 	"sort"
@@ -24,7 +25,7 @@ func TestGetIncludes(t *testing.T) {
 	defer cleanup()
 	includes, err := getIncludes([]string{filepath.Join(root, "first"),
 		filepath.Join(root, "second")},
-		"foo/bar/cruz/template")
+		"foo/bar/cruz/template", ioutil.ReadFile)
 	sort.Strings(includes)
 	expected := []string{
 		"eight", "five", "four", "one", "seven", "six", "two"}
@@ -33,3 +34,92 @@ func TestGetIncludes(t *testing.T) {
 			includes, err, expected)
 	}
 }
+
+func TestRenderCache(t *testing.T) {
+	root, cleanup, err := mtesting.CreateDirectoryTree(map[string]string{
+		"/templates/foo.html":        `{{.}} foo {{template "bar"}}`,
+		"/templates/foo.include":     "bar",
+		"/templates/bar.html":        "bar",
+		"/site/templates/other.html": "other"}, "TestRenderCache")
+	if err != nil {
+		t.Fatalf("Could not create test directory tree: %v", err)
+	}
+	defer cleanup()
+	renderer := Renderer{Root: filepath.Join(root, "templates")}
+	siteTemplates := filepath.Join(root, "site", "templates")
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content),
+			0600); err != nil {
+			t.Fatalf("Could not write template: %v", err)
+		}
+	}
+	tests := []struct {
+		Change   func()
+		Rendered string
+	}{
+		{func() {}, "1 foo bar"},
+		{func() {}, "2 foo bar"},
+		{func() { write("/templates/bar.html", "changed bar") },
+			"3 foo changed bar"},
+		{func() { write("/site/templates/foo.html", "{{.}} site foo") },
+			"4 site foo"},
+	}
+	for i, test := range tests {
+		test.Change()
+		ret, err := renderer.Render("foo", i+1, "", siteTemplates)
+		if err != nil || ret != test.Rendered {
+			t.Errorf("Test %v: Render returned %q, %v, should be %q", i, ret, err,
+				test.Rendered)
+		}
+	}
+	if len(renderer.templates) != 1 {
+		t.Errorf("Renderer should have cached one template, got %v",
+			len(renderer.templates))
+	}
+
+	renderer = Renderer{Root: filepath.Join(root, "templates"), Dev: true}
+	if ret, err := renderer.Render("foo", 5, "", ""); err != nil ||
+		ret != "5 foo changed bar" || len(renderer.templates) != 0 {
+		t.Errorf("Render in dev mode returned %q, %v and cached %v templates",
+			ret, err, len(renderer.templates))
+	}
+}
+
+func TestRenderThemes(t *testing.T) {
+	root, cleanup, err := mtesting.CreateDirectoryTree(map[string]string{
+		"/templates/foo.html":           `core foo {{template "bar"}}`,
+		"/templates/foo.include":        "bar",
+		"/templates/bar.html":           "core bar",
+		"/templates/other.html":         `core other {{template "cruz"}}`,
+		"/templates/cruz.html":          "core cruz",
+		"/base/templates/bar.html":      "base bar",
+		"/base/templates/cruz.html":     "base cruz",
+		"/base/templates/other.include": "cruz",
+		"/theme/templates/bar.html":     "theme bar",
+		"/site/templates/other.html":    `site other {{template "cruz"}}`,
+	}, "TestRenderThemes")
+	if err != nil {
+		t.Fatalf("Could not create test directory tree: %v", err)
+	}
+	defer cleanup()
+	renderer := Renderer{Root: filepath.Join(root, "templates")}
+	roots := []string{filepath.Join(root, "site", "templates"),
+		filepath.Join(root, "theme", "templates"),
+		filepath.Join(root, "base", "templates")}
+	tests := []struct {
+		Name, Rendered string
+	}{
+		{"foo", "core foo theme bar"},
+		{"other", "site other base cruz"},
+	}
+	for _, test := range tests {
+		ret, err := renderer.Render(test.Name, nil, "", roots...)
+		if err != nil || ret != test.Rendered {
+			t.Errorf("Render(%q) returned %q, %v, should be %q", test.Name, ret,
+				err, test.Rendered)
+		}
+	}
+	if _, err := renderer.Render("missing", nil, "", roots...); err == nil {
+		t.Errorf("Render of missing template should fail")
+	}
+}
@@ -0,0 +1,104 @@
+// This file is part of monsti/util.
+// Copyright 2012-2014 Christian Neumann
+
+// monsti/util is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+
+// monsti/util is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with monsti/util. If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ThemeManifest describes a theme. It's read from the theme.yaml file
+// at the root of the theme's directory.
+type ThemeManifest struct {
+	// Title and Description of the theme for humans.
+	Title, Description string
+	// Parent is the name of the theme this theme is based on. Templates
+	// and static files missing in this theme are taken from the parent
+	// theme.
+	Parent string
+}
+
+// GetThemesPath returns the path to the directory holding the
+// installed themes.
+func (s MonstiSettings) GetThemesPath() string {
+	return filepath.Join(s.Directories.Share, "themes")
+}
+
+// GetThemePath returns the path to the given theme's directory.
+func (s MonstiSettings) GetThemePath(theme string) string {
+	return filepath.Join(s.GetThemesPath(), theme)
+}
+
+// LoadThemeManifest loads the manifest of the given theme.
+func (s MonstiSettings) LoadThemeManifest(theme string) (*ThemeManifest,
+	error) {
+	if len(theme) == 0 || strings.ContainsAny(theme, `/\`) ||
+		strings.HasPrefix(theme, ".") {
+		return nil, fmt.Errorf("Invalid theme name %q", theme)
+	}
+	var manifest ThemeManifest
+	err := ParseYAML(filepath.Join(s.GetThemePath(theme), "theme.yaml"),
+		&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load manifest of theme %q: %v", theme,
+			err)
+	}
+	return &manifest, nil
+}
+
+// getThemeChain returns the given theme followed by its ancestors.
+func (s MonstiSettings) getThemeChain(theme string) ([]string, error) {
+	var chain []string
+	seen := make(map[string]bool)
+	for len(theme) > 0 {
+		if seen[theme] {
+			return nil, fmt.Errorf("Theme %q inherits from itself", theme)
+		}
+		seen[theme] = true
+		manifest, err := s.LoadThemeManifest(theme)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, theme)
+		theme = manifest.Parent
+	}
+	return chain, nil
+}
+
+// GetSiteTemplatesPaths returns the paths to the template directories
+// overriding Monsti's templates for the given site, most specific
+// first: The site's templates directory followed by those of its theme
+// and the theme's ancestors.
+func (s MonstiSettings) GetSiteTemplatesPaths(site string) []string {
+	paths := []string{s.GetSiteTemplatesPath(site)}
+	for _, theme := range s.Sites[site].Themes {
+		paths = append(paths, filepath.Join(s.GetThemePath(theme), "templates"))
+	}
+	return paths
+}
+
+// GetThemeStaticsPaths returns the paths to the static directories of
+// the given site's theme and the theme's ancestors, most specific
+// first.
+func (s MonstiSettings) GetThemeStaticsPaths(site string) []string {
+	var paths []string
+	for _, theme := range s.Sites[site].Themes {
+		paths = append(paths, filepath.Join(s.GetThemePath(theme), "static"))
+	}
+	return paths
+}
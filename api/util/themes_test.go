@@ -0,0 +1,91 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	mtest "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestLoadSiteSettingsThemes(t *testing.T) {
+	files := map[string]string{
+		"/etc/sites/plain/site.yaml":     `title: Plain`,
+		"/etc/sites/themed/site.yaml":    `theme: child`,
+		"/share/themes/child/theme.yaml": `parent: base`,
+		"/share/themes/base/theme.yaml":  `title: Base`,
+	}
+	root, cleanup, err := mtest.CreateDirectoryTree(files,
+		"TestLoadSiteSettingsThemes")
+	if err != nil {
+		t.Fatalf("Could not create test files: %v", err)
+	}
+	defer cleanup()
+	var settings MonstiSettings
+	settings.Directories.Config = filepath.Join(root, "etc")
+	settings.Directories.Data = filepath.Join(root, "data")
+	settings.Directories.Share = filepath.Join(root, "share")
+	if err := settings.LoadSiteSettings(); err != nil {
+		t.Fatalf("LoadSiteSettings returned error: %v", err)
+	}
+	if themes := settings.Sites["plain"].Themes; len(themes) != 0 {
+		t.Errorf("Site without theme should not have themes, got %v", themes)
+	}
+	expected := []string{"child", "base"}
+	if themes := settings.Sites["themed"].Themes; !reflect.DeepEqual(themes,
+		expected) {
+		t.Errorf("Themes = %v, should be %v", themes, expected)
+	}
+	paths := settings.GetSiteTemplatesPaths("themed")
+	expected = []string{
+		filepath.Join(root, "data", "themed", "templates"),
+		filepath.Join(root, "share", "themes", "child", "templates"),
+		filepath.Join(root, "share", "themes", "base", "templates")}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("GetSiteTemplatesPaths = %v, should be %v", paths, expected)
+	}
+	paths = settings.GetThemeStaticsPaths("themed")
+	expected = []string{
+		filepath.Join(root, "share", "themes", "child", "static"),
+		filepath.Join(root, "share", "themes", "base", "static")}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("GetThemeStaticsPaths = %v, should be %v", paths, expected)
+	}
+}
+
+func TestGetThemeChainErrors(t *testing.T) {
+	files := map[string]string{
+		"/themes/loop/theme.yaml":    `parent: loopier`,
+		"/themes/loopier/theme.yaml": `parent: loop`,
+		"/themes/orphan/theme.yaml":  `parent: missing`,
+	}
+	root, cleanup, err := mtest.CreateDirectoryTree(files,
+		"TestGetThemeChainErrors")
+	if err != nil {
+		t.Fatalf("Could not create test files: %v", err)
+	}
+	defer cleanup()
+	var settings MonstiSettings
+	settings.Directories.Share = root
+	for _, theme := range []string{"loop", "orphan", "../themes/orphan"} {
+		if chain, err := settings.getThemeChain(theme); err == nil {
+			t.Errorf("getThemeChain(%q) = %v, should fail", theme, chain)
+		}
+	}
+}
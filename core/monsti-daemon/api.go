@@ -0,0 +1,427 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"pkg.monsti.org/monsti/api/service"
+)
+
+const (
+	// apiPrefix is the path prefix of the JSON API.
+	apiPrefix = "/@@api/"
+	// apiCSRFHeader is the request header holding the CSRF token for
+	// requests authenticated by the session cookie.
+	apiCSRFHeader = "X-CSRF-Token"
+	// apiMaxBodySize is the maximum size of request bodies in bytes.
+	apiMaxBodySize = 32 * 1024 * 1024
+)
+
+// apiError is an error to be sent to the API client.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newAPIError returns a new apiError.
+func newAPIError(status int, format string, args ...interface{}) *apiError {
+	return &apiError{status, fmt.Sprintf(format, args...)}
+}
+
+// apiContext holds the state of an API request.
+type apiContext struct {
+	Res         http.ResponseWriter
+	Req         *http.Request
+	Site        string
+	UserSession *service.UserSession
+	Monsti      *service.MonstiClient
+}
+
+// isDataFileAccessible returns true if the data file with the given
+// name may be read and written using the API.
+func isDataFileAccessible(name string) bool {
+	if len(name) == 0 || name == "." || name == ".." || name == "node.json" ||
+		strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	return !strings.HasPrefix(name, "__") || strings.HasPrefix(name, "__file_")
+}
+
+// apiNodePath returns the node path of the given API request path.
+func apiNodePath(urlPath string) (string, bool) {
+	rest := strings.TrimPrefix(urlPath, apiPrefix)
+	if rest != "nodes" && !strings.HasPrefix(rest, "nodes/") {
+		return "", false
+	}
+	return path.Clean("/" + strings.TrimPrefix(rest, "nodes")), true
+}
+
+// authenticate returns the session of the requesting user. Clients
+// may authenticate using HTTP basic authentication or the session
+// cookie. In the latter case, modifying requests must include the
+// CSRF token in the X-CSRF-Token header.
+func (h *nodeHandler) authenticate(c *apiContext) error {
+	site, _ := h.Settings.getSite(c.Site)
+	dataDir := h.Settings.getMonsti().GetSiteDataPath(c.Site)
+	if login, password, ok := c.Req.BasicAuth(); ok {
+		user, err := getUser(login, dataDir)
+		if err != nil {
+			return fmt.Errorf("Could not get user: %v", err)
+		}
+		if user == nil || user.Disabled ||
+			!passwordEqual(user.Password, password) {
+			c.Res.Header().Set("WWW-Authenticate", `Basic realm="Monsti"`)
+			return newAPIError(http.StatusUnauthorized, "Wrong login or password")
+		}
+		c.UserSession = &service.UserSession{User: user, Locale: site.Locale}
+		return nil
+	}
+	session, err := getSession(c.Req, site)
+	if err != nil {
+		return fmt.Errorf("Could not get session: %v", err)
+	}
+	c.UserSession, err = getClientSession(session, dataDir)
+	if err != nil {
+		return fmt.Errorf("Could not get client session: %v", err)
+	}
+	c.UserSession.Locale = site.Locale
+	if c.UserSession.User == nil {
+		return nil
+	}
+	var newToken bool
+	c.UserSession.CSRFToken, newToken, err = getCSRFToken(session)
+	if err != nil {
+		return fmt.Errorf("Could not get CSRF token: %v", err)
+	}
+	if newToken {
+		if err := session.Save(c.Req, c.Res); err != nil {
+			return fmt.Errorf("Could not save session: %v", err)
+		}
+	}
+	c.Res.Header().Set(apiCSRFHeader, c.UserSession.CSRFToken)
+	if c.Req.Method != "GET" && c.Req.Method != "HEAD" &&
+		!c.UserSession.CheckCSRFToken(c.Req.Header.Get(apiCSRFHeader)) {
+		return newAPIError(http.StatusForbidden, "Invalid CSRF token")
+	}
+	return nil
+}
+
+// checkAPIPermission returns an error if the user may not perform the
+// action on the given node.
+func checkAPIPermission(c *apiContext, action service.Action,
+	nodePath string) error {
+	acl, err := getNodeACL(nodePath, getNodeACLFn(c.Monsti, c.Site))
+	if err != nil {
+		return fmt.Errorf("Could not get node ACL: %v", err)
+	}
+	if checkPermission(action, c.UserSession, acl) {
+		return nil
+	}
+	if c.UserSession.User == nil {
+		c.Res.Header().Set("WWW-Authenticate", `Basic realm="Monsti"`)
+		return newAPIError(http.StatusUnauthorized, "Unauthorized")
+	}
+	return newAPIError(http.StatusForbidden, "Forbidden")
+}
+
+// writeJSON sends the given value as JSON document.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not encode response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, err = w.Write(data)
+	return err
+}
+
+// ServeAPI handles requests to the JSON API.
+func (h *nodeHandler) ServeAPI(w http.ResponseWriter, r *http.Request) {
+	defer context.Clear(r)
+	err := func() error {
+		site, ok := h.getSiteName(r.Host)
+		if !ok {
+			return newAPIError(http.StatusNotFound, "No site found for host %v",
+				r.Host)
+		}
+		if h.Migrator != nil && h.Migrator.isOutdated(site) {
+			return newAPIError(http.StatusServiceUnavailable,
+				"Site is being upgraded")
+		}
+		nodePath, ok := apiNodePath(r.URL.Path)
+		if !ok {
+			return newAPIError(http.StatusNotFound, "Unknown API endpoint")
+		}
+		session, err := h.Sessions.New()
+		if err != nil {
+			return fmt.Errorf("Could not get session: %v", err)
+		}
+		defer h.Sessions.Free(session)
+		c := &apiContext{Res: w, Req: r, Site: site, Monsti: session.Monsti()}
+		if err := h.authenticate(c); err != nil {
+			return err
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, apiMaxBodySize)
+		file := r.URL.Query().Get("file")
+		if len(file) > 0 && !isDataFileAccessible(file) {
+			return newAPIError(http.StatusBadRequest, "Invalid file name %q", file)
+		}
+		switch {
+		case r.Method == "GET" && len(file) > 0:
+			return h.apiGetNodeData(c, nodePath, file)
+		case r.Method == "GET":
+			return h.apiGetNode(c, nodePath)
+		case r.Method == "PUT" && len(file) > 0:
+			return h.apiWriteNodeData(c, nodePath, file)
+		case r.Method == "PUT":
+			return h.apiWriteNode(c, nodePath, false)
+		case r.Method == "POST":
+			name := r.URL.Query().Get("name")
+			if len(name) == 0 || strings.ContainsAny(name, "/\\") ||
+				name == "." || name == ".." {
+				return newAPIError(http.StatusBadRequest, "Invalid node name %q", name)
+			}
+			return h.apiWriteNode(c, path.Join(nodePath, name), true)
+		case r.Method == "DELETE":
+			return h.apiRemoveNode(c, nodePath)
+		default:
+			return newAPIError(http.StatusMethodNotAllowed,
+				"Request method not supported: %v", r.Method)
+		}
+	}()
+	if err == nil {
+		return
+	}
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		h.Log.Printf("API error: %v %v: %v", r.Method, r.URL.Path, err)
+		apiErr = newAPIError(http.StatusInternalServerError,
+			"Internal server error")
+	}
+	if err := writeJSON(w, apiErr.Status,
+		map[string]string{"Error": apiErr.Message}); err != nil {
+		h.Log.Printf("Could not send API error: %v", err)
+	}
+}
+
+// apiGetVisibleNode returns the given node if the user may view it.
+func apiGetVisibleNode(c *apiContext, nodePath string) (*service.Node, error) {
+	node, err := c.Monsti.GetNode(c.Site, nodePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get node: %v", err)
+	}
+	if node == nil ||
+		(c.UserSession.User == nil && !node.IsPublished(time.Now())) {
+		return nil, newAPIError(http.StatusNotFound, "Node not found")
+	}
+	if err := checkAPIPermission(c, service.ViewAction, nodePath); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// apiGetNode sends the node or, if requested, its children.
+func (h *nodeHandler) apiGetNode(c *apiContext, nodePath string) error {
+	node, err := apiGetVisibleNode(c, nodePath)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.Req.URL.Query()["children"]; !ok {
+		data, err := service.MarshalNode(node)
+		if err != nil {
+			return fmt.Errorf("Could not encode node: %v", err)
+		}
+		return writeJSON(c.Res, http.StatusOK, json.RawMessage(data))
+	}
+	children, err := c.Monsti.GetChildren(c.Site, nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not get children: %v", err)
+	}
+	acl, err := getNodeACL(nodePath, getNodeACLFn(c.Monsti, c.Site))
+	if err != nil {
+		return fmt.Errorf("Could not get node ACL: %v", err)
+	}
+	ret := make([]json.RawMessage, 0, len(children))
+	for _, child := range visibleNodes(c.UserSession, acl, children,
+		time.Now()) {
+		data, err := service.MarshalNode(child)
+		if err != nil {
+			return fmt.Errorf("Could not encode node: %v", err)
+		}
+		ret = append(ret, json.RawMessage(data))
+	}
+	return writeJSON(c.Res, http.StatusOK, ret)
+}
+
+// apiGetNodeData sends the given data file of the node.
+func (h *nodeHandler) apiGetNodeData(c *apiContext, nodePath,
+	file string) error {
+	if _, err := apiGetVisibleNode(c, nodePath); err != nil {
+		return err
+	}
+	content, err := c.Monsti.GetNodeData(c.Site, nodePath, file)
+	if err != nil {
+		return fmt.Errorf("Could not get node data: %v", err)
+	}
+	if content == nil {
+		return newAPIError(http.StatusNotFound, "File not found")
+	}
+	c.Res.Header().Set("Content-Type", http.DetectContentType(content))
+	_, err = c.Res.Write(content)
+	return err
+}
+
+// apiWriteNode writes the node sent in the request body. If create is
+// true, the node must not exist yet.
+func (h *nodeHandler) apiWriteNode(c *apiContext, nodePath string,
+	create bool) error {
+	if nodePath == "/" && create {
+		return newAPIError(http.StatusBadRequest, "Invalid node path")
+	}
+	existing, err := c.Monsti.GetNode(c.Site, nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not get node: %v", err)
+	}
+	if existing != nil && create {
+		return newAPIError(http.StatusConflict, "Node does already exist")
+	}
+	var action service.Action = service.EditAction
+	if existing == nil {
+		action = service.AddAction
+	}
+	if err := checkAPIPermission(c, action, nodePath); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(c.Req.Body)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "Could not read body: %v", err)
+	}
+	node, err := c.Monsti.UnmarshalNode(c.Site, body)
+	if err != nil || node == nil {
+		return newAPIError(http.StatusBadRequest, "Invalid node: %v", err)
+	}
+	node.Path = nodePath
+	var acl map[string][]string
+	if existing != nil {
+		acl = existing.ACL
+	}
+	if !checkPermission(service.UsersAction, c.UserSession, nil) {
+		if node.ACL != nil && !sameACL(node.ACL, acl) {
+			return newAPIError(http.StatusForbidden,
+				"Only administrators may change ACLs")
+		}
+		node.ACL = acl
+	}
+	if existing == nil {
+		parent, err := c.Monsti.GetNode(c.Site, path.Dir(nodePath))
+		if err != nil {
+			return fmt.Errorf("Could not get parent node: %v", err)
+		}
+		if parent != nil {
+			types, err := c.Monsti.GetAddableNodeTypes(c.Site, parent.Type.Id)
+			if err != nil {
+				return fmt.Errorf("Could not get addable node types: %v", err)
+			}
+			if !inStringSlice(node.Type.Id, types) {
+				return newAPIError(http.StatusBadRequest,
+					"Node type %q may not be added to %q", node.Type.Id, parent.Type.Id)
+			}
+		}
+	}
+	err = c.Monsti.WriteNode(c.Site, nodePath, node)
+	if err == service.ErrNodeChanged {
+		return newAPIError(http.StatusConflict,
+			"Node has been changed in the meantime")
+	}
+	if veto, ok := err.(*service.WriteVetoedError); ok {
+		return newAPIError(http.StatusUnprocessableEntity, "%v", veto.Reason)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write node: %v", err)
+	}
+	data, err := service.MarshalNode(node)
+	if err != nil {
+		return fmt.Errorf("Could not encode node: %v", err)
+	}
+	status := http.StatusOK
+	if existing == nil {
+		status = http.StatusCreated
+		c.Res.Header().Set("Location", apiPrefix+"nodes"+nodePath)
+	}
+	return writeJSON(c.Res, status, json.RawMessage(data))
+}
+
+// apiWriteNodeData writes the request body to the given data file of
+// the node.
+func (h *nodeHandler) apiWriteNodeData(c *apiContext, nodePath,
+	file string) error {
+	node, err := c.Monsti.GetNode(c.Site, nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not get node: %v", err)
+	}
+	if node == nil {
+		return newAPIError(http.StatusNotFound, "Node not found")
+	}
+	if err := checkAPIPermission(c, service.EditAction, nodePath); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(c.Req.Body)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "Could not read body: %v", err)
+	}
+	if err := c.Monsti.WriteNodeData(c.Site, nodePath, file,
+		content); err != nil {
+		return fmt.Errorf("Could not write node data: %v", err)
+	}
+	c.Res.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiRemoveNode removes the node and its descendants.
+func (h *nodeHandler) apiRemoveNode(c *apiContext, nodePath string) error {
+	if nodePath == "/" {
+		return newAPIError(http.StatusBadRequest, "The root node can't be removed")
+	}
+	node, err := c.Monsti.GetNode(c.Site, nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not get node: %v", err)
+	}
+	if node == nil {
+		return newAPIError(http.StatusNotFound, "Node not found")
+	}
+	if err := checkAPIPermission(c, service.RemoveAction, nodePath); err != nil {
+		return err
+	}
+	if err := c.Monsti.RemoveNode(c.Site, nodePath); err != nil {
+		return fmt.Errorf("Could not remove node: %v", err)
+	}
+	c.Res.WriteHeader(http.StatusNoContent)
+	return nil
+}
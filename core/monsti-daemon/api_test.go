@@ -0,0 +1,62 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestAPINodePath(t *testing.T) {
+	tests := []struct {
+		URLPath, NodePath string
+		Ok                bool
+	}{
+		{"/@@api/nodes", "/", true},
+		{"/@@api/nodes/", "/", true},
+		{"/@@api/nodes/foo/bar/", "/foo/bar", true},
+		{"/@@api/nodes/foo/../../bar", "/bar", true},
+		{"/@@api/nodesfoo", "", false},
+		{"/@@api/users/foo", "", false},
+	}
+	for _, test := range tests {
+		nodePath, ok := apiNodePath(test.URLPath)
+		if nodePath != test.NodePath || ok != test.Ok {
+			t.Errorf("apiNodePath(%q) = %q, %v, should be %q, %v", test.URLPath,
+				nodePath, ok, test.NodePath, test.Ok)
+		}
+	}
+}
+
+func TestIsDataFileAccessible(t *testing.T) {
+	tests := []struct {
+		Name       string
+		Accessible bool
+	}{
+		{"image.png", true},
+		{"__file_core.File", true},
+		{"", false},
+		{"..", false},
+		{"node.json", false},
+		{"../node.json", false},
+		{"__history", false},
+		{"foo/bar", false},
+	}
+	for _, test := range tests {
+		if ret := isDataFileAccessible(test.Name); ret != test.Accessible {
+			t.Errorf("isDataFileAccessible(%q) = %v, should be %v", test.Name, ret,
+				test.Accessible)
+		}
+	}
+}
@@ -25,9 +25,12 @@ import (
 	"fmt"
 	"log"
 	"net/url"
-
+	"path"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
+
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
 	mtemplate "pkg.monsti.org/monsti/api/util/template"
@@ -50,31 +53,224 @@ func (s *nodeSort) Less(i, j int) bool {
 	return s.Sorter(s.Nodes[i], s.Nodes[j])
 }
 
-func getBlogPosts(req *service.Request, blogPath string, s *service.Session,
-	limit int) ([]*service.Node, error) {
-	var posts []*service.Node
-	years, err := s.Monsti().GetChildren(req.Site, blogPath)
+// blogPageSize is the number of posts per page if the request does
+// not specify a limit.
+const blogPageSize = 10
+
+// blogQuery selects the posts of a blog.
+type blogQuery struct {
+	// Public restricts the posts to public and published ones.
+	Public bool
+	// Year and Month restrict the posts to the given archive. Zero
+	// values match all years or months.
+	Year, Month int
+	// Tag restricts the posts to those having the given tag.
+	Tag string
+	// Offset is the number of matching posts to skip.
+	Offset int
+	// Limit is the maximum number of posts to return. If it is zero,
+	// all posts are returned.
+	Limit int
+}
+
+// blogArchive identifies a year or month archive of a blog.
+type blogArchive struct {
+	Year  int
+	Month time.Month
+}
+
+// blogPost is a blog post as passed to the post list template.
+type blogPost struct {
+	*service.Node
+	Tags []string
+}
+
+// getBlogPostTags returns the tags of the given blog post.
+func getBlogPostTags(post *service.Node) []string {
+	field := post.GetField("core.Tags")
+	if field == nil {
+		return nil
+	}
+	var tags []string
+	for _, tag := range strings.Split(field.String(), ",") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// hasTag returns true if the blog post has the given tag. Tags are
+// compared case insensitively.
+func hasTag(post *service.Node, tag string) bool {
+	for _, postTag := range getBlogPostTags(post) {
+		if strings.EqualFold(postTag, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// getBlogPosts returns the posts of the given blog matching the query,
+// newest first. more is true if there are further matching posts
+// after the returned ones.
+//
+// Posts are stored in year and month directories below the blog
+// according to their publish time in the publish time's location. The
+// directories are walked from the newest to the oldest one, stopping
+// as soon as the remaining directories can't contain any of the
+// wanted posts.
+func getBlogPosts(blogPath string, query blogQuery,
+	getChildrenFn getChildrenFunc) (posts []*service.Node, more bool,
+	err error) {
+	byPath := func(left, right *service.Node) bool {
+		return left.Path < right.Path
+	}
+	byPublishTime := func(left, right *service.Node) bool {
+		return left.PublishTime.Before(right.PublishTime)
+	}
+	wanted := query.Offset + query.Limit
+	now := time.Now()
+	// done returns true if enough posts have been found and posts
+	// published before the given time would not be among them.
+	done := func(end time.Time) bool {
+		return query.Limit > 0 && len(posts) > wanted &&
+			end.Before(posts[wanted-1].PublishTime)
+	}
+	years, err := getChildrenFn(blogPath)
 	if err != nil {
-		return nil, fmt.Errorf("Could not fetch year children: %v", err)
+		return nil, false, fmt.Errorf("Could not fetch year children: %v", err)
 	}
+	sort.Sort(sort.Reverse(&nodeSort{years, byPath}))
+walk:
 	for _, year := range years {
-		months, err := s.Monsti().GetChildren(req.Site, year.Path)
+		if query.Year != 0 &&
+			path.Base(year.Path) != fmt.Sprintf("%04d", query.Year) {
+			continue
+		}
+		yearNumber, yearErr := strconv.Atoi(path.Base(year.Path))
+		if yearErr == nil && done(archiveEnd(yearNumber, 12)) {
+			break
+		}
+		months, err := getChildrenFn(year.Path)
 		if err != nil {
-			return nil, fmt.Errorf("Could not fetch month children: %v", err)
+			return nil, false, fmt.Errorf("Could not fetch month children: %v", err)
 		}
+		sort.Sort(sort.Reverse(&nodeSort{months, byPath}))
 		for _, month := range months {
-			monthPosts, err := s.Monsti().GetChildren(req.Site, month.Path)
+			if query.Month != 0 &&
+				path.Base(month.Path) != fmt.Sprintf("%02d", query.Month) {
+				continue
+			}
+			monthNumber, err := strconv.Atoi(path.Base(month.Path))
+			if yearErr == nil && err == nil &&
+				done(archiveEnd(yearNumber, time.Month(monthNumber))) {
+				break walk
+			}
+			monthPosts, err := getChildrenFn(month.Path)
 			if err != nil {
-				return nil, fmt.Errorf("Could not fetch month children: %v", err)
+				return nil, false, fmt.Errorf("Could not fetch month children: %v", err)
 			}
-			posts = append(posts, monthPosts...)
+			for _, post := range monthPosts {
+				if query.Public && !post.IsPublished(now) {
+					continue
+				}
+				if len(query.Tag) > 0 && !hasTag(post, query.Tag) {
+					continue
+				}
+				posts = append(posts, post)
+			}
+			sort.Stable(sort.Reverse(&nodeSort{posts, byPublishTime}))
 		}
 	}
-	order := func(left, right *service.Node) bool {
-		return left.PublishTime.Before(right.PublishTime)
+	if query.Limit > 0 && len(posts) > wanted {
+		more = true
+		posts = posts[:wanted]
+	}
+	if query.Offset >= len(posts) {
+		return nil, more, nil
 	}
-	sort.Sort(sort.Reverse(&nodeSort{posts, order}))
-	return posts, nil
+	return posts[query.Offset:], more, nil
+}
+
+// maxZoneOffset is the largest difference between a local time and UTC.
+const maxZoneOffset = 14 * time.Hour
+
+// archiveEnd returns a time after the publish times of all posts of
+// the given month's archive, regardless of the posts' locations.
+func archiveEnd(year int, month time.Month) time.Time {
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC).Add(maxZoneOffset)
+}
+
+// parseBlogArchivePath splits an archive path like "/blog/2014" or
+// "/blog/2014/03" into the path of the blog and the archive. ok is
+// false if the path does not end with an archive.
+func parseBlogArchivePath(archivePath string) (
+	blogPath string, archive blogArchive, ok bool) {
+	parts := strings.Split(strings.Trim(archivePath, "/"), "/")
+	if len(parts) >= 3 && len(parts[len(parts)-1]) == 2 {
+		month, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil || month < 1 || month > 12 {
+			return "", archive, false
+		}
+		archive.Month = time.Month(month)
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < 2 || len(parts[len(parts)-1]) != 4 {
+		return "", blogArchive{}, false
+	}
+	year, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return "", blogArchive{}, false
+	}
+	archive.Year = year
+	return "/" + strings.Join(parts[:len(parts)-1], "/"), archive, true
+}
+
+// getBlog returns the blog node for the given path and the requested
+// archive, if any. The path may be the path of the blog itself or of
+// one of its year or month archives. If there is no such blog, it
+// returns nil.
+func getBlog(nodePath string, getNodeFn getNodeFunc) (
+	*service.Node, *blogArchive, error) {
+	node, err := getNodeFn(nodePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not get node: %v", err)
+	}
+	if node != nil {
+		if node.Type.Id == "core.Blog" {
+			return node, nil, nil
+		}
+		return nil, nil, nil
+	}
+	blogPath, archive, ok := parseBlogArchivePath(nodePath)
+	if !ok {
+		return nil, nil, nil
+	}
+	node, err = getNodeFn(blogPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not get blog node: %v", err)
+	}
+	if node == nil || node.Type.Id != "core.Blog" {
+		return nil, nil, nil
+	}
+	return node, &archive, nil
+}
+
+// getBlogArchiveNode returns the blog node to be viewed for the given
+// archive path, with the path set to the archive path. If the path is
+// not the path of a blog archive, it returns nil.
+func getBlogArchiveNode(m *service.MonstiClient, site, archivePath string) (
+	*service.Node, error) {
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return m.GetNode(site, nodePath)
+	}
+	blog, archive, err := getBlog(archivePath, getNodeFn)
+	if err != nil || archive == nil {
+		return nil, err
+	}
+	blog.Path = archivePath
+	return blog, nil
 }
 
 func getBlogContext(reqId uint, embed *service.EmbedNode,
@@ -94,21 +290,79 @@ func getBlogContext(reqId uint, embed *service.EmbedNode,
 		query = embedUrl.Query()
 		blogPath = embedUrl.Path
 	}
-	limit := -1
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return s.Monsti().GetNode(req.Site, nodePath)
+	}
+	getChildrenFn := visibleChildrenFn(s.Monsti(), req.Site, req.Session)
+	blog, archive, err := getBlog(blogPath, getNodeFn)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get blog: %v", err)
+	}
+	if blog == nil {
+		return nil, fmt.Errorf("Could not find blog %q", blogPath)
+	}
+	blogQuery := blogQuery{
+		Public: req.Session.User == nil,
+		Tag:    query.Get("tag"),
+		Limit:  blogPageSize,
+	}
+	if archive != nil {
+		blogQuery.Year, blogQuery.Month = archive.Year, int(archive.Month)
+	}
 	if limitParam, err := strconv.Atoi(query.Get("limit")); err == nil {
-		limit = limitParam
-		if limit < 1 {
-			limit = 1
+		blogQuery.Limit = limitParam
+		if blogQuery.Limit < 1 {
+			blogQuery.Limit = 1
 		}
 	}
-	context := mtemplate.Context{}
-	context["Embedded"] = embed
-	context["Posts"], err = getBlogPosts(req, blogPath, s, limit)
+	page := 1
+	if pageParam, err := strconv.Atoi(query.Get("page")); err == nil &&
+		pageParam > 1 && embed == nil {
+		page = pageParam
+	}
+	blogQuery.Offset = (page - 1) * blogQuery.Limit
+	nodes, more, err := getBlogPosts(blog.Path, blogQuery, getChildrenFn)
 	if err != nil {
 		return nil, fmt.Errorf("Could not retrieve blog posts: %v", err)
 	}
-	rendered, err := renderer.Render("core/blogpost-list", context,
-		req.Session.Locale, settings.Monsti.GetSiteTemplatesPath(req.Site))
+	posts := make([]blogPost, 0, len(nodes))
+	for _, node := range nodes {
+		posts = append(posts, blogPost{node, getBlogPostTags(node)})
+	}
+	pageURL := func(page int) string {
+		values := url.Values{}
+		for _, param := range []string{"tag", "limit"} {
+			if len(query.Get(param)) > 0 {
+				values.Set(param, query.Get(param))
+			}
+		}
+		if page > 1 {
+			values.Set("page", strconv.Itoa(page))
+		}
+		return "?" + values.Encode()
+	}
+	context := mtemplate.Context{}
+	context["Embedded"] = embed
+	context["Posts"] = posts
+	context["BlogPath"] = strings.TrimSuffix(blog.Path, "/") + "/"
+	context["Archive"] = archive
+	context["Tag"] = blogQuery.Tag
+	if embed == nil {
+		if page > 1 {
+			context["PrevPage"] = pageURL(page - 1)
+		}
+		if more {
+			context["NextPage"] = pageURL(page + 1)
+		}
+	}
+	site, _ := settings.getSite(req.Site)
+	rendered, err := renderer.RenderEnv("core/blogpost-list", context,
+		&mtemplate.Env{
+			Locale:      req.Session.Locale,
+			Session:     s,
+			Site:        site,
+			UserSession: req.Session},
+		settings.getMonsti().GetSiteTemplatesPaths(req.Site)...)
 	if err != nil {
 		return nil, fmt.Errorf("Could not render template: %v", err)
 	}
@@ -138,6 +392,11 @@ func initBlog(settings *settings, session *service.Session, logger *log.Logger,
 		Fields: []*service.NodeField{
 			{Id: "core.Title"},
 			{Id: "core.Body"},
+			{
+				Id:   "core.Tags",
+				Name: util.GenLanguageMap(G("Tags"), availableLocales),
+				Type: "Text",
+			},
 		},
 		Hide:       true,
 		PathPrefix: "$year/$month",
@@ -0,0 +1,217 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestGetBlogPosts(t *testing.T) {
+	post := func(path string, day int, public bool, tags string) *service.Node {
+		tagsField := service.TextField(tags)
+		return &service.Node{
+			Path:        path,
+			Public:      public,
+			PublishTime: time.Date(2014, 1, day, 0, 0, 0, 0, time.UTC),
+			Fields:      map[string]service.Field{"core.Tags": &tagsField}}
+	}
+	tree := map[string][]*service.Node{
+		"/blog":      {{Path: "/blog/2013"}, {Path: "/blog/2014"}},
+		"/blog/2013": {{Path: "/blog/2013/12"}},
+		"/blog/2013/12": {
+			post("/blog/2013/12/a", -10, true, "Go, Monsti")},
+		"/blog/2014": {{Path: "/blog/2014/01"}, {Path: "/blog/2014/02"}},
+		"/blog/2014/01": {
+			post("/blog/2014/01/b", 1, true, "go"),
+			post("/blog/2014/01/c", 5, false, ""),
+			post("/blog/2014/01/d", 3, true, "")},
+		"/blog/2014/02": {
+			post("/blog/2014/02/e", 40, true, "monsti")}}
+	visited := make(map[string]bool)
+	getChildrenFn := func(path string) ([]*service.Node, error) {
+		visited[path] = true
+		return append([]*service.Node(nil), tree[path]...), nil
+	}
+	tests := []struct {
+		Query   blogQuery
+		Posts   []string
+		More    bool
+		Visited []string
+	}{
+		{blogQuery{}, []string{"/blog/2014/02/e", "/blog/2014/01/c",
+			"/blog/2014/01/d", "/blog/2014/01/b", "/blog/2013/12/a"}, false, nil},
+		{blogQuery{Public: true, Limit: 2},
+			[]string{"/blog/2014/02/e", "/blog/2014/01/d"}, true,
+			[]string{"/blog", "/blog/2014", "/blog/2014/01", "/blog/2014/02"}},
+		{blogQuery{Public: true, Limit: 2, Offset: 2},
+			[]string{"/blog/2014/01/b", "/blog/2013/12/a"}, false, nil},
+		{blogQuery{Limit: 2, Offset: 10}, nil, false, nil},
+		{blogQuery{Year: 2014, Month: 1},
+			[]string{"/blog/2014/01/c", "/blog/2014/01/d", "/blog/2014/01/b"},
+			false, nil},
+		{blogQuery{Year: 2013}, []string{"/blog/2013/12/a"}, false, nil},
+		{blogQuery{Tag: "GO"},
+			[]string{"/blog/2014/01/b", "/blog/2013/12/a"}, false, nil},
+	}
+	for i, test := range tests {
+		visited = make(map[string]bool)
+		posts, more, err := getBlogPosts("/blog", test.Query, getChildrenFn)
+		if err != nil {
+			t.Errorf("Test %v: getBlogPosts returned error: %v", i, err)
+			continue
+		}
+		var paths []string
+		for _, post := range posts {
+			paths = append(paths, post.Path)
+		}
+		if !reflect.DeepEqual(paths, test.Posts) || more != test.More {
+			t.Errorf("Test %v: getBlogPosts(...) = %v, %v, should be %v, %v",
+				i, paths, more, test.Posts, test.More)
+		}
+		if test.Visited != nil {
+			expected := make(map[string]bool)
+			for _, path := range test.Visited {
+				expected[path] = true
+			}
+			if !reflect.DeepEqual(visited, expected) {
+				t.Errorf("Test %v: getBlogPosts visited %v, should visit %v",
+					i, visited, expected)
+			}
+		}
+	}
+}
+
+func TestGetBlogPostsOrder(t *testing.T) {
+	est := time.FixedZone("EST", -5*60*60)
+	tree := map[string][]*service.Node{
+		"/blog":      {{Path: "/blog/2013"}, {Path: "/blog/2014"}},
+		"/blog/2013": {{Path: "/blog/2013/12"}},
+		"/blog/2013/12": {{Path: "/blog/2013/12/a",
+			PublishTime: time.Date(2013, 12, 1, 0, 0, 0, 0, time.UTC)}},
+		"/blog/2014": {{Path: "/blog/2014/01"}, {Path: "/blog/2014/02"}},
+		// Stored in January, but published after the February posts in
+		// UTC.
+		"/blog/2014/01": {{Path: "/blog/2014/01/b",
+			PublishTime: time.Date(2014, 1, 31, 23, 0, 0, 0, est)}},
+		"/blog/2014/02": {
+			{Path: "/blog/2014/02/c",
+				PublishTime: time.Date(2014, 2, 1, 1, 0, 0, 0, time.UTC)},
+			{Path: "/blog/2014/02/d",
+				PublishTime: time.Date(2014, 2, 1, 0, 30, 0, 0, time.UTC)}}}
+	visited := make(map[string]bool)
+	getChildrenFn := func(path string) ([]*service.Node, error) {
+		visited[path] = true
+		return append([]*service.Node(nil), tree[path]...), nil
+	}
+	posts, more, err := getBlogPosts("/blog", blogQuery{Limit: 1},
+		getChildrenFn)
+	if err != nil || len(posts) != 1 || posts[0].Path != "/blog/2014/01/b" ||
+		!more {
+		t.Errorf("getBlogPosts(...) = %v, %v, %v, should return the January post",
+			posts, more, err)
+	}
+	if visited["/blog/2013"] {
+		t.Errorf("getBlogPosts should not visit the archive of 2013")
+	}
+}
+
+func TestGetBlogPostsAnonymous(t *testing.T) {
+	pathType := &service.NodeType{Id: "core.Path"}
+	tree := map[string][]*service.Node{
+		"/blog":      {{Path: "/blog/2014", Type: pathType}},
+		"/blog/2014": {{Path: "/blog/2014/01", Type: pathType}},
+		"/blog/2014/01": {
+			{Path: "/blog/2014/01/a", Public: true},
+			{Path: "/blog/2014/01/draft"}}}
+	getChildrenFn := visibleChildren(
+		func(path string) ([]*service.Node, error) {
+			return append([]*service.Node(nil), tree[path]...), nil
+		},
+		func(string) (map[string][]string, error) { return nil, nil },
+		&service.UserSession{})
+	posts, _, err := getBlogPosts("/blog", blogQuery{Limit: 10},
+		getChildrenFn)
+	if err != nil || len(posts) != 1 || posts[0].Path != "/blog/2014/01/a" {
+		t.Errorf("getBlogPosts(...) = %v, %v, should return the public post",
+			posts, err)
+	}
+}
+
+func TestParseBlogArchivePath(t *testing.T) {
+	tests := []struct {
+		Path, BlogPath string
+		Archive        blogArchive
+		Ok             bool
+	}{
+		{"/blog/2014", "/blog", blogArchive{2014, 0}, true},
+		{"/blog/2014/", "/blog", blogArchive{2014, 0}, true},
+		{"/foo/blog/2014/03/", "/foo/blog", blogArchive{2014, time.March}, true},
+		{"/blog/2014/13", "", blogArchive{}, false},
+		{"/blog/03", "", blogArchive{}, false},
+		{"/2014", "", blogArchive{}, false},
+		{"/blog/foo", "", blogArchive{}, false},
+	}
+	for _, test := range tests {
+		blogPath, archive, ok := parseBlogArchivePath(test.Path)
+		if blogPath != test.BlogPath || archive != test.Archive || ok != test.Ok {
+			t.Errorf("parseBlogArchivePath(%q) = %q, %v, %v, should be %q, %v, %v",
+				test.Path, blogPath, archive, ok, test.BlogPath, test.Archive,
+				test.Ok)
+		}
+	}
+}
+
+func TestGetBlog(t *testing.T) {
+	blogType := &service.NodeType{Id: "core.Blog"}
+	docType := &service.NodeType{Id: "core.Document"}
+	nodes := map[string]*service.Node{
+		"/blog": {Path: "/blog", Type: blogType},
+		"/doc":  {Path: "/doc", Type: docType}}
+	getNodeFn := func(path string) (*service.Node, error) {
+		return nodes[path], nil
+	}
+	tests := []struct {
+		Path     string
+		BlogPath string
+		Archive  *blogArchive
+	}{
+		{"/blog", "/blog", nil},
+		{"/blog/2014/02", "/blog", &blogArchive{2014, time.February}},
+		{"/doc", "", nil},
+		{"/doc/2014", "", nil},
+		{"/unknown", "", nil},
+	}
+	for _, test := range tests {
+		blog, archive, err := getBlog(test.Path, getNodeFn)
+		if err != nil {
+			t.Errorf("getBlog(%q, _) returned error: %v", test.Path, err)
+			continue
+		}
+		blogPath := ""
+		if blog != nil {
+			blogPath = blog.Path
+		}
+		if blogPath != test.BlogPath || !reflect.DeepEqual(archive, test.Archive) {
+			t.Errorf("getBlog(%q, _) = %q, %v, should be %q, %v", test.Path,
+				blogPath, archive, test.BlogPath, test.Archive)
+		}
+	}
+}
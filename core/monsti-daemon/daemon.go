@@ -23,6 +23,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -30,8 +31,11 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	ossignal "os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
@@ -40,6 +44,14 @@ import (
 	"pkg.monsti.org/monsti/api/util/template"
 )
 
+// shutdownTimeout is the time to wait for pending HTTP requests and
+// modules to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// coreSignalWorkers is the number of sessions handling signals of the
+// core node types in parallel.
+const coreSignalWorkers = 4
+
 // Settings for the application and the sites.
 type settings struct {
 	Monsti util.MonstiSettings
@@ -57,6 +69,32 @@ type settings struct {
 		Password string
 		Debug    bool
 	}
+	// ModuleInitTimeout is the time in seconds to wait for the modules
+	// to finish their initialization before serving HTTP requests.
+	// Defaults to 30 seconds.
+	ModuleInitTimeout int
+	// Signals configures the dispatching of signals to modules.
+	Signals struct {
+		// Timeout is the time in seconds to wait for a module to handle
+		// a signal. Defaults to 10 seconds.
+		Timeout int
+		// Timeouts maps signal names to timeouts overriding the default.
+		Timeouts map[string]int
+		// MaxTimeouts is the number of consecutive timeouts after which a
+		// module is considered unhealthy and won't receive further
+		// signals until it waits for signals again. Defaults to 3.
+		MaxTimeouts int
+	}
+	// PageCache configures the cache of pages rendered for anonymous
+	// visitors.
+	PageCache struct {
+		// Disabled turns the page cache off.
+		Disabled bool
+		// Size is the maximum number of cached pages. Defaults to 1000.
+		Size int
+	}
+	// mutex protects the settings which may change on reload.
+	mutex sync.RWMutex
 }
 
 // moduleLog is a Writer used to log module messages on stderr.
@@ -98,105 +136,150 @@ func main() {
 			filepath.Base(os.Args[0]))
 	}
 	cfgPath := util.GetConfigPath(flag.Arg(0))
-	var settings settings
-	if err := util.LoadModuleSettings("daemon", cfgPath, &settings); err != nil {
-		logger.Fatal("Could not load settings: ", err)
-	}
-
-	if err := (&settings).Monsti.LoadSiteSettings(); err != nil {
-		logger.Fatal("Could not load site settings: ", err)
+	settings, err := loadSettings(cfgPath)
+	if err != nil {
+		logger.Fatal(err)
 	}
 
 	gettext.DefaultLocales.Domain = "monsti-daemon"
-	gettext.DefaultLocales.LocaleDir = settings.Monsti.Directories.Locale
-
-	var waitGroup sync.WaitGroup
+	gettext.DefaultLocales.LocaleDir = settings.getMonsti().Directories.Locale
 
 	// Start service handler
 	logger.Println("Setting up service")
-	monstiPath := settings.Monsti.GetServicePath(service.MonstiService.String())
+	monstiPath := settings.getMonsti().GetServicePath(service.MonstiService.String())
+	sessions := service.NewSessionPool(1, monstiPath)
 	monsti := new(MonstiService)
-	monsti.Settings = &settings
+	monsti.Settings = settings
 	monsti.Logger = logger
+	monsti.Sessions = sessions
+	for _, migration := range coreMigrations {
+		if err := monsti.migrator.register(migration); err != nil {
+			logger.Fatalf("Could not register migration: %v", err)
+		}
+	}
 	provider := service.NewProvider("Monsti", monsti)
 	provider.Logger = logger
 	if err := provider.Listen(monstiPath); err != nil {
 		logger.Fatalf("service: Could not start service: %v", err)
 	}
-	waitGroup.Add(1)
 	go func() {
-		defer waitGroup.Done()
 		if err := provider.Accept(); err != nil {
 			logger.Fatalf("Could not accept at service: %v", err)
 		}
 	}()
 
 	// Start modules
-	for _, module := range settings.Modules {
-		logger.Println("Starting module", module)
-		executable := "monsti-" + module
-		cmd := exec.Command(executable, cfgPath)
-		cmd.Stderr = moduleLog{module, logger}
-		go func() {
-			if err := cmd.Run(); err != nil {
-				logger.Fatalf("Module %q failed: %v", module, err)
-			}
-		}()
-	}
+	supervisor := newModuleSupervisor(settings.Modules, logger,
+		func(module string) *exec.Cmd {
+			cmd := exec.Command("monsti-"+module, cfgPath)
+			cmd.Stderr = moduleLog{module, logger}
+			return cmd
+		})
+	supervisor.Exited = monsti.disconnectProcess
+	monsti.Supervisor = supervisor
+	supervisor.start()
 
-	sessions := service.NewSessionPool(1, monstiPath)
-	renderer := template.Renderer{Root: settings.Monsti.GetTemplatesPath()}
+	renderer := template.Renderer{Root: settings.getMonsti().GetTemplatesPath(),
+		Dev: settings.getMonsti().Dev}
 
 	// Init core functionality
 	session, err := sessions.New()
 	if err != nil {
 		logger.Fatalf("Could not get session: %v", err)
 	}
-	if err := initNodeTypes(&settings, session, logger); err != nil {
+	if err := initNodeTypes(settings, session, logger); err != nil {
 		logger.Fatalf("Could not init node types: %v", err)
 	}
-	if err := initBlog(&settings, session, logger, &renderer); err != nil {
+	if err := initBlog(settings, session, logger, &renderer); err != nil {
 		logger.Fatalf("Could not init blog: %v", err)
 	}
 
 	// Wait for signals
-	go func() {
+	waitSignals := func(monsti *service.MonstiClient) {
 		for {
-			if err := session.Monsti().WaitSignal(); err != nil {
-				logger.Fatalf("Could not wait for signal: %v", err)
+			if err := monsti.WaitSignal(); err != nil {
+				logger.Printf("Could not wait for signal: %v", err)
 			}
 		}
-	}()
+	}
+	for i := 1; i < coreSignalWorkers; i++ {
+		worker, err := sessions.New()
+		if err != nil {
+			logger.Fatalf("Could not get session for signal worker: %v", err)
+		}
+		session.Monsti().AddSignalWorker(worker.Monsti())
+		go waitSignals(worker.Monsti())
+	}
+	go waitSignals(session.Monsti())
+
+	// Start emitting publish signals
+	if err := monsti.runScheduler(); err != nil {
+		logger.Fatalf("Could not start scheduler: %v", err)
+	}
 
 	// Setup up httpd
 	handler := nodeHandler{
-		Renderer: renderer,
-		Settings: &settings,
+		Renderer: &renderer,
+		Settings: settings,
 		Log:      logger,
 		Sessions: sessions,
 	}
+	handler.Supervisor = supervisor
+	handler.Migrator = &monsti.migrator
+	handler.PageCache = &monsti.pageCache
 	monsti.Handler = &handler
 
 	http.Handle("/static/", http.FileServer(http.Dir(
-		filepath.Dir(settings.Monsti.GetStaticsPath()))))
-	handler.Hosts = make(map[string]string)
-	for site_title, site := range settings.Monsti.Sites {
-		for _, host := range site.Hosts {
-			handler.Hosts[host] = site_title
-			http.Handle(host+"/site-static/", http.FileServer(http.Dir(
-				filepath.Dir(settings.Monsti.GetSiteStaticsPath(site_title)))))
-		}
-	}
+		filepath.Dir(settings.getMonsti().GetStaticsPath()))))
+	handler.setHosts(settings.getSites())
+	http.HandleFunc("/site-static/", handler.ServeSiteStatic)
+	http.HandleFunc("/theme-static/", handler.ServeThemeStatic)
+	http.HandleFunc(apiPrefix, handler.ServeAPI)
 	http.Handle("/", &handler)
-	waitGroup.Add(1)
+	initTimeout := settings.ModuleInitTimeout
+	if initTimeout <= 0 {
+		initTimeout = defaultModuleInitTimeout
+	}
+	if !supervisor.waitReady(time.Duration(initTimeout) * time.Second) {
+		logger.Printf("Some modules did not finish their initialization " +
+			"in time. Starting anyway.")
+	}
+	if err := monsti.checkSchemas(); err != nil {
+		logger.Fatalf("Could not check site schemas: %v", err)
+	}
+	server := &http.Server{Addr: settings.Listen}
 	go func() {
-		if err := http.ListenAndServe(settings.Listen, nil); err != nil {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
 			logger.Fatal("HTTP Listener failed: ", err)
 		}
-		waitGroup.Done()
 	}()
 
 	logger.Printf("Monsti is up and running, listening on %q", settings.Listen)
-	waitGroup.Wait()
+
+	// Reload on SIGHUP, shut down on SIGINT or SIGTERM
+	osSignals := make(chan os.Signal, 1)
+	ossignal.Notify(osSignals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range osSignals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		logger.Println("Reloading configuration")
+		if err := monsti.reloadSettings(cfgPath); err != nil {
+			logger.Printf("Could not reload configuration: %v", err)
+		}
+	}
+	ossignal.Stop(osSignals)
+
 	logger.Println("Monsti is shutting down.")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Printf("Could not drain HTTP connections: %v", err)
+	}
+	supervisor.stop(shutdownTimeout)
+	if err := provider.Close(); err != nil {
+		logger.Printf("Could not stop service: %v", err)
+	}
+	monsti.closeStores()
+	logger.Println("Monsti stopped.")
 }
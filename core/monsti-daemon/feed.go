@@ -0,0 +1,233 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// feedLimit is the number of posts in a feed if the request does not
+// specify a limit.
+const feedLimit = 20
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	Id        string      `xml:"id"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// feedContentTypes maps the supported feed formats to their content
+// types.
+var feedContentTypes = map[string]string{
+	"rss":  "application/rss+xml; charset=utf-8",
+	"atom": "application/atom+xml; charset=utf-8",
+}
+
+// absoluteURL returns the absolute URL of the given node path using
+// the site's base URL.
+func absoluteURL(site *util.SiteSettings, path string) string {
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return strings.TrimSuffix(site.BaseURL, "/") + path
+}
+
+// nodeFieldString returns the string value of the given field or the
+// empty string if the node does not have such a field.
+func nodeFieldString(node *service.Node, id string) string {
+	field := node.GetField(id)
+	if field == nil {
+		return ""
+	}
+	return field.String()
+}
+
+// writeBlogFeed writes a feed of the given format ("rss" or "atom")
+// containing the given blog posts.
+func writeBlogFeed(w io.Writer, format string, site *util.SiteSettings,
+	blog *service.Node, posts []*service.Node) error {
+	blogURL := absoluteURL(site, blog.Path)
+	title := nodeFieldString(blog, "core.Title")
+	updated := blog.Changed
+	for _, post := range posts {
+		if post.Changed.After(updated) {
+			updated = post.Changed
+		}
+	}
+	var feed interface{}
+	switch format {
+	case "rss":
+		channel := rssChannel{
+			Title:       title,
+			Link:        blogURL,
+			Description: title,
+		}
+		if !updated.IsZero() {
+			channel.LastBuildDate = updated.Format(time.RFC1123Z)
+		}
+		for _, post := range posts {
+			postURL := absoluteURL(site, post.Path)
+			channel.Items = append(channel.Items, rssItem{
+				Title:       nodeFieldString(post, "core.Title"),
+				Link:        postURL,
+				GUID:        rssGUID{true, postURL},
+				PubDate:     post.PublishTime.Format(time.RFC1123Z),
+				Description: nodeFieldString(post, "core.Body"),
+			})
+		}
+		feed = rssFeed{Version: "2.0", Channel: channel}
+	case "atom":
+		author := site.Owner.Name
+		if len(author) == 0 {
+			author = site.Title
+		}
+		atom := atomFeed{
+			Title:   title,
+			Id:      blogURL,
+			Updated: updated.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Href: blogURL + "?format=atom", Rel: "self",
+					Type: "application/atom+xml"},
+				{Href: blogURL, Rel: "alternate", Type: "text/html"},
+			},
+			Author: atomAuthor{author},
+		}
+		for _, post := range posts {
+			postURL := absoluteURL(site, post.Path)
+			atom.Entries = append(atom.Entries, atomEntry{
+				Title:     nodeFieldString(post, "core.Title"),
+				Id:        postURL,
+				Link:      atomLink{Href: postURL, Rel: "alternate"},
+				Published: post.PublishTime.UTC().Format(time.RFC3339),
+				Updated:   post.Changed.UTC().Format(time.RFC3339),
+				Content:   atomContent{"html", nodeFieldString(post, "core.Body")},
+			})
+		}
+		feed = atom
+	default:
+		return fmt.Errorf("Unknown feed format %q", format)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return fmt.Errorf("Could not write feed: %v", err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return fmt.Errorf("Could not encode feed: %v", err)
+	}
+	return nil
+}
+
+// serveBlogFeed writes a feed of the requested blog's public and
+// published posts.
+func (h *nodeHandler) serveBlogFeed(c *reqContext, format string) error {
+	contentType, ok := feedContentTypes[format]
+	if !ok {
+		return fmt.Errorf("Unknown feed format %q", format)
+	}
+	limit := feedLimit
+	if limitParam, err := strconv.Atoi(c.Req.FormValue("limit")); err == nil {
+		limit = limitParam
+		if limit < 1 {
+			limit = 1
+		}
+	}
+	getNodeFn := func(path string) (*service.Node, error) {
+		return c.Serv.Monsti().GetNode(c.Site.Name, path)
+	}
+	// Feeds are public, so they only list posts anonymous visitors
+	// may view.
+	getChildrenFn := visibleChildrenFn(c.Serv.Monsti(), c.Site.Name,
+		new(service.UserSession))
+	blog, archive, err := getBlog(c.Node.Path, getNodeFn)
+	if err != nil || blog == nil {
+		return fmt.Errorf("Could not get blog: %v", err)
+	}
+	query := blogQuery{Public: true, Tag: c.Req.FormValue("tag"), Limit: limit}
+	if archive != nil {
+		query.Year, query.Month = archive.Year, int(archive.Month)
+	}
+	posts, _, err := getBlogPosts(blog.Path, query, getChildrenFn)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve blog posts: %v", err)
+	}
+	c.Res.Header().Set("Content-Type", contentType)
+	return writeBlogFeed(c.Res, format, c.Site, blog, posts)
+}
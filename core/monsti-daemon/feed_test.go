@@ -0,0 +1,80 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestWriteBlogFeed(t *testing.T) {
+	site := &util.SiteSettings{Title: "Example", BaseURL: "http://example.com/"}
+	published := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+	title := service.TextField("My Blog")
+	blog := &service.Node{
+		Path:   "/blog",
+		Fields: map[string]service.Field{"core.Title": &title}}
+	postTitle := service.TextField("Hello & Goodbye")
+	postBody := service.HTMLField("<p>First post</p>")
+	posts := []*service.Node{{
+		Path:        "/blog/2014/03/hello",
+		PublishTime: published,
+		Changed:     published,
+		Fields: map[string]service.Field{
+			"core.Title": &postTitle, "core.Body": &postBody}}}
+	tests := []struct {
+		Format   string
+		Contains []string
+	}{
+		{"rss", []string{
+			`<rss version="2.0">`,
+			`<link>http://example.com/blog/</link>`,
+			`<title>Hello &amp; Goodbye</title>`,
+			`<guid isPermaLink="true">http://example.com/blog/2014/03/hello/</guid>`,
+			`<pubDate>Sat, 01 Mar 2014 12:00:00 +0000</pubDate>`,
+			`<description>&lt;p&gt;First post&lt;/p&gt;</description>`}},
+		{"atom", []string{
+			`<feed xmlns="http://www.w3.org/2005/Atom">`,
+			`<id>http://example.com/blog/</id>`,
+			`<updated>2014-03-01T12:00:00Z</updated>`,
+			`<name>Example</name>`,
+			`<link href="http://example.com/blog/2014/03/hello/" rel="alternate">`,
+			`<content type="html">&lt;p&gt;First post&lt;/p&gt;</content>`}},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := writeBlogFeed(&out, test.Format, site, blog, posts); err != nil {
+			t.Errorf("writeBlogFeed(%q, ...) returned error: %v", test.Format, err)
+			continue
+		}
+		for _, expected := range test.Contains {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("writeBlogFeed(%q, ...) = %v, should contain %q",
+					test.Format, out.String(), expected)
+			}
+		}
+	}
+	if err := writeBlogFeed(new(bytes.Buffer), "unknown", site, blog,
+		posts); err == nil {
+		t.Errorf(`writeBlogFeed("unknown", ...) should return an error`)
+	}
+}
@@ -0,0 +1,599 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// historyDir is the name of the directory inside a node's directory
+// which keeps the node's revisions.
+const historyDir = "__history"
+
+// isRevisionFile returns true iff the named node data file is part of
+// the node's revisions.
+func isRevisionFile(file string) bool {
+	return file == "node.json" || strings.HasPrefix(file, "__file_")
+}
+
+// storedRevision is the content of a revision's revision.json file.
+type storedRevision struct {
+	service.NodeRevision
+	// Sources maps the files which did not change since an earlier
+	// revision to the number of the revision keeping their content.
+	Sources map[string]int `json:",omitempty"`
+}
+
+// source returns the number of the revision keeping the content of
+// the given file of this revision or 0 if the file is not part of
+// the revision.
+func (r *storedRevision) source(file string) int {
+	if number, ok := r.Sources[file]; ok {
+		return number
+	}
+	for _, name := range r.Files {
+		if name == file {
+			return r.Number
+		}
+	}
+	return 0
+}
+
+// revisionFile returns the name of the given file of the given
+// revision below the node's data directory.
+func revisionFile(number int, file string) string {
+	return historyDir + "/" + strconv.Itoa(number) + "/" + file
+}
+
+// readRevision reads the given revision of the given node. If the
+// revision does not exist, it returns nil, nil.
+func readRevision(store nodeDataStore, path string, number int) (
+	*storedRevision, error) {
+	content, err := store.readData(path, revisionFile(number, "revision.json"))
+	if err != nil || content == nil {
+		return nil, err
+	}
+	var revision storedRevision
+	if err = json.Unmarshal(content, &revision); err != nil {
+		return nil, fmt.Errorf("Could not decode revision %v: %v", number, err)
+	}
+	return &revision, nil
+}
+
+// writeRevision writes the revision.json file of the given revision.
+func writeRevision(store nodeDataStore, path string,
+	revision *storedRevision) error {
+	content, err := json.MarshalIndent(revision, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not encode revision: %v", err)
+	}
+	if err := store.writeData(path, revisionFile(revision.Number,
+		"revision.json"), content); err != nil {
+		return fmt.Errorf("Could not write revision: %v", err)
+	}
+	return nil
+}
+
+// getNodeRevisions returns the archived revisions of the given node,
+// newest first.
+func getNodeRevisions(store nodeDataStore, path string) (
+	[]service.NodeRevision, error) {
+	entries, err := store.listData(path, historyDir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read history: %v", err)
+	}
+	revisions := make([]service.NodeRevision, 0, len(entries))
+	for _, entry := range entries {
+		number, err := strconv.Atoi(entry)
+		if err != nil {
+			continue
+		}
+		revision, err := readRevision(store, path, number)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read revision %v: %v", number, err)
+		}
+		if revision == nil {
+			continue
+		}
+		revisions = append(revisions, revision.NodeRevision)
+	}
+	sort.Sort(sort.Reverse(revisionsByNumber(revisions)))
+	return revisions, nil
+}
+
+type revisionsByNumber []service.NodeRevision
+
+func (r revisionsByNumber) Len() int           { return len(r) }
+func (r revisionsByNumber) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r revisionsByNumber) Less(i, j int) bool { return r[i].Number < r[j].Number }
+
+// getNodeRevisionData returns the content of the given file of the
+// given revision. If the file or revision does not exist, it returns
+// nil, nil.
+func getNodeRevisionData(store nodeDataStore, path string, number int,
+	file string) ([]byte, error) {
+	revision, err := readRevision(store, path, number)
+	if err != nil || revision == nil {
+		return nil, err
+	}
+	source := revision.source(file)
+	if source == 0 {
+		return nil, nil
+	}
+	return store.readData(path, revisionFile(source, file))
+}
+
+// archiveNodeData archives the node before the given data file gets
+// written if the file is part of the node's revisions.
+func archiveNodeData(store nodeDataStore, path, file string) error {
+	switch {
+	case file == "node.json":
+		return archiveNode(store, path, "")
+	case isRevisionFile(file):
+		return archiveNode(store, path, file)
+	}
+	return nil
+}
+
+// archiveNode saves the current state of the given node as a new
+// revision.
+//
+// If file is not empty, archiveNode will skip the archiving if the
+// current content of this file is already kept in the latest
+// revision. Nodes without node.json will not be archived.
+//
+// Files which did not change since the latest revision are not copied
+// but referenced.
+func archiveNode(store nodeDataStore, path, file string) error {
+	node, err := store.readData(path, "node.json")
+	if err != nil {
+		return fmt.Errorf("Could not read node: %v", err)
+	}
+	if node == nil {
+		return nil
+	}
+	revisions, err := getNodeRevisions(store, path)
+	if err != nil {
+		return fmt.Errorf("Could not get revisions: %v", err)
+	}
+	number := 1
+	var latest *storedRevision
+	if len(revisions) > 0 {
+		number = revisions[0].Number + 1
+		latest, err = readRevision(store, path, revisions[0].Number)
+		if err != nil {
+			return fmt.Errorf("Could not read latest revision: %v", err)
+		}
+		if len(file) > 0 {
+			current, err := store.readData(path, file)
+			if err != nil {
+				return fmt.Errorf("Could not read node data: %v", err)
+			}
+			if current == nil {
+				return nil
+			}
+			archived, err := getNodeRevisionData(store, path,
+				revisions[0].Number, file)
+			if err != nil {
+				return fmt.Errorf("Could not read revision data: %v", err)
+			}
+			if bytes.Equal(current, archived) {
+				return nil
+			}
+		}
+	}
+	entries, err := store.listData(path, "")
+	if err != nil {
+		return fmt.Errorf("Could not list node data: %v", err)
+	}
+	revision := storedRevision{NodeRevision: service.NodeRevision{
+		Number: number, Archived: time.Now().UTC()}}
+	for _, entry := range entries {
+		if !isRevisionFile(entry) {
+			continue
+		}
+		content, err := store.readData(path, entry)
+		if err != nil {
+			return fmt.Errorf("Could not read node data: %v", err)
+		}
+		revision.Files = append(revision.Files, entry)
+		if latest != nil {
+			if source := latest.source(entry); source > 0 {
+				archived, err := store.readData(path, revisionFile(source, entry))
+				if err != nil {
+					return fmt.Errorf("Could not read revision data: %v", err)
+				}
+				if bytes.Equal(content, archived) {
+					if revision.Sources == nil {
+						revision.Sources = make(map[string]int)
+					}
+					revision.Sources[entry] = source
+					continue
+				}
+			}
+		}
+		if err := store.writeData(path, revisionFile(number, entry),
+			content); err != nil {
+			return fmt.Errorf("Could not write revision data: %v", err)
+		}
+	}
+	return writeRevision(store, path, &revision)
+}
+
+// pruneNodeRevisions removes the oldest revisions of the given node
+// exceeding the given number of revisions to be kept. If max is not
+// positive, all revisions are kept.
+//
+// Files of removed revisions still referenced by kept revisions are
+// moved to the oldest revision referencing them.
+func pruneNodeRevisions(store nodeDataStore, path string, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	revisions, err := getNodeRevisions(store, path)
+	if err != nil {
+		return fmt.Errorf("Could not get revisions: %v", err)
+	}
+	if len(revisions) <= max {
+		return nil
+	}
+	oldestKept := revisions[max-1].Number
+	type archivedFile struct {
+		Number int
+		Name   string
+	}
+	moved := make(map[archivedFile]int)
+	for i := max - 1; i >= 0; i-- {
+		revision, err := readRevision(store, path, revisions[i].Number)
+		if err != nil || revision == nil {
+			return fmt.Errorf("Could not read revision %v: %v",
+				revisions[i].Number, err)
+		}
+		changed := false
+		for file, source := range revision.Sources {
+			if source >= oldestKept {
+				continue
+			}
+			changed = true
+			key := archivedFile{source, file}
+			if number, ok := moved[key]; ok {
+				revision.Sources[file] = number
+				continue
+			}
+			content, err := store.readData(path, revisionFile(source, file))
+			if err != nil {
+				return fmt.Errorf("Could not read revision data: %v", err)
+			}
+			if err := store.writeData(path, revisionFile(revision.Number, file),
+				content); err != nil {
+				return fmt.Errorf("Could not write revision data: %v", err)
+			}
+			delete(revision.Sources, file)
+			moved[key] = revision.Number
+		}
+		if changed {
+			if err := writeRevision(store, path, revision); err != nil {
+				return err
+			}
+		}
+	}
+	for _, revision := range revisions[max:] {
+		dir := historyDir + "/" + strconv.Itoa(revision.Number)
+		// Remove revision.json first to never leave incomplete revisions.
+		if err := store.removeData(path, dir+"/revision.json"); err != nil {
+			return fmt.Errorf("Could not remove revision %v: %v",
+				revision.Number, err)
+		}
+		files, err := store.listData(path, dir)
+		if err != nil {
+			return fmt.Errorf("Could not list revision %v: %v", revision.Number, err)
+		}
+		for _, file := range files {
+			if err := store.removeData(path, dir+"/"+file); err != nil {
+				return fmt.Errorf("Could not remove revision %v: %v",
+					revision.Number, err)
+			}
+		}
+		if err := store.removeData(path, dir); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove revision %v: %v",
+				revision.Number, err)
+		}
+	}
+	return nil
+}
+
+// restoreNodeRevision replaces the node's data with the data of the
+// given revision. Files of the node's revisions which are not part of
+// the given revision, e.g. files added later on, get removed.
+//
+// The current state of the node will be archived before.
+func restoreNodeRevision(store nodeDataStore, path string, number int) error {
+	revision, err := readRevision(store, path, number)
+	if err != nil {
+		return fmt.Errorf("Could not read revision: %v", err)
+	}
+	if revision == nil {
+		return fmt.Errorf("Unknown revision %v", number)
+	}
+	if err := archiveNode(store, path, ""); err != nil {
+		return fmt.Errorf("Could not archive current revision: %v", err)
+	}
+	for _, file := range revision.Files {
+		content, err := getNodeRevisionData(store, path, number, file)
+		if err != nil {
+			return fmt.Errorf("Could not read revision data: %v", err)
+		}
+		if file == "node.json" {
+			if content, err = touchNode(content); err != nil {
+				return fmt.Errorf("Could not update node: %v", err)
+			}
+		}
+		if err := store.writeData(path, file, content); err != nil {
+			return fmt.Errorf("Could not write node data: %v", err)
+		}
+	}
+	entries, err := store.listData(path, "")
+	if err != nil {
+		return fmt.Errorf("Could not list node data: %v", err)
+	}
+	for _, entry := range entries {
+		switch {
+		case isRevisionFile(entry) && revision.source(entry) == 0:
+			if err := store.removeData(path, entry); err != nil {
+				return fmt.Errorf("Could not remove node data: %v", err)
+			}
+		case strings.HasPrefix(entry, "__image_"):
+			// Resized images are regenerated on demand.
+			if err := store.removeData(path, entry); err != nil {
+				return fmt.Errorf("Could not remove resized image: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// touchNode sets the Changed attribute of the given encoded node to
+// the current time.
+func touchNode(content []byte) ([]byte, error) {
+	var node map[string]interface{}
+	if err := json.Unmarshal(content, &node); err != nil {
+		return nil, err
+	}
+	node["Changed"] = time.Now().UTC()
+	return json.MarshalIndent(node, "", "  ")
+}
+
+// pruneHistory removes the revisions of the given node exceeding the
+// site's revision limit and logs any errors.
+func (i *MonstiService) pruneHistory(store NodeStore, site, path string) {
+	settings, _ := i.Settings.getSite(site)
+	if err := store.PruneNodeRevisions(path,
+		settings.History.MaxRevisions); err != nil {
+		i.Logger.Printf("Could not prune history of %q: %v", path, err)
+	}
+}
+
+type GetNodeRevisionsArgs struct{ Site, Path string }
+
+func (i *MonstiService) GetNodeRevisions(args *GetNodeRevisionsArgs,
+	reply *[]service.NodeRevision) error {
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
+	}
+	*reply, err = store.GetNodeRevisions(args.Path)
+	return err
+}
+
+type GetNodeRevisionArgs struct {
+	Site, Path string
+	Number     int
+	File       string
+}
+
+func (i *MonstiService) GetNodeRevision(args *GetNodeRevisionArgs,
+	reply *[]byte) error {
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
+	}
+	ret, err := store.GetNodeRevisionData(args.Path, args.Number, args.File)
+	if err == nil && ret != nil && args.File == "node.json" {
+		ret = addNodePath(ret, args.Path)
+	}
+	*reply = ret
+	return err
+}
+
+type RestoreNodeRevisionArgs struct {
+	Site, Path string
+	Number     int
+}
+
+func (i *MonstiService) RestoreNodeRevision(args *RestoreNodeRevisionArgs,
+	reply *int) error {
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		defer i.lockNode(args.Site, args.Path)()
+		if err := store.RestoreNodeRevision(args.Path, args.Number); err != nil {
+			return err
+		}
+		i.pruneHistory(store, args.Site, args.Path)
+		i.nodeWritten(args.Site, args.Path)
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	i.emitNotification("monsti.NodeWritten",
+		service.NodeWrittenArgs{Site: args.Site, Path: args.Path})
+	return nil
+}
+
+// fieldChange describes the change of a field between two revisions.
+type fieldChange struct {
+	Name     string
+	Old, New string
+}
+
+// diffNodes returns the changes of the fields and attributes between
+// the old and the new node.
+func diffNodes(old, new *service.Node, locale string,
+	getData func(node *service.Node, file string) ([]byte, error)) (
+	[]fieldChange, error) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	changes := make([]fieldChange, 0)
+	attributes := []struct {
+		Name     string
+		Old, New interface{}
+	}{
+		{G("Hide"), old.Hide, new.Hide},
+		{G("Order"), old.Order, new.Order},
+		{G("Public"), old.Public, new.Public},
+		{G("Publish time"), old.PublishTime.UTC(), new.PublishTime.UTC()},
+		{G("Unpublish time"), old.UnpublishTime.UTC(), new.UnpublishTime.UTC()},
+	}
+	for _, attribute := range attributes {
+		oldValue := fmt.Sprint(attribute.Old)
+		newValue := fmt.Sprint(attribute.New)
+		if oldValue != newValue {
+			changes = append(changes, fieldChange{attribute.Name, oldValue, newValue})
+		}
+	}
+	seen := make(map[string]bool)
+	fields := append(append(append([]*service.NodeField{}, new.Type.Fields...),
+		new.LocalFields...), old.LocalFields...)
+	for _, field := range fields {
+		if seen[field.Id] {
+			continue
+		}
+		seen[field.Id] = true
+		name := field.Name[locale]
+		if len(name) == 0 {
+			name = field.Id
+		}
+		var oldValue, newValue string
+		if oldField := old.GetField(field.Id); oldField != nil {
+			oldValue = oldField.String()
+		}
+		if newField := new.GetField(field.Id); newField != nil {
+			newValue = newField.String()
+		}
+		if field.Type == "File" {
+			oldData, err := getData(old, "__file_"+field.Id)
+			if err != nil {
+				return nil, fmt.Errorf("Could not get old file: %v", err)
+			}
+			newData, err := getData(new, "__file_"+field.Id)
+			if err != nil {
+				return nil, fmt.Errorf("Could not get new file: %v", err)
+			}
+			if !bytes.Equal(oldData, newData) {
+				oldValue = fmt.Sprintf(G("%v bytes"), len(oldData))
+				newValue = fmt.Sprintf(G("%v bytes"), len(newData))
+			}
+		}
+		if oldValue != newValue {
+			changes = append(changes, fieldChange{name, oldValue, newValue})
+		}
+	}
+	return changes, nil
+}
+
+// History lists the revisions of a node, shows the changes of a
+// revision and restores revisions.
+func (h *nodeHandler) History(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	if err := c.Req.ParseForm(); err != nil {
+		return fmt.Errorf("Could not parse form: %v", err)
+	}
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		number, err := strconv.Atoi(c.Req.Form.Get("Revision"))
+		if err != nil {
+			return fmt.Errorf("Invalid revision: %v", err)
+		}
+		if err := m.RestoreNodeRevision(c.Site.Name, c.Node.Path,
+			number); err != nil {
+			return fmt.Errorf("Could not restore revision: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, c.Node.Path+"/", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	revisions, err := m.GetNodeRevisions(c.Site.Name, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get revisions: %v", err)
+	}
+	context := mtemplate.Context{"Revisions": revisions, "Node": c.Node,
+		"CSRFToken": c.UserSession.CSRFToken}
+	if diff := c.Req.Form.Get("diff"); len(diff) > 0 {
+		number, err := strconv.Atoi(diff)
+		if err != nil {
+			return fmt.Errorf("Invalid revision: %v", err)
+		}
+		old, err := m.GetNodeRevision(c.Site.Name, c.Node.Path, number)
+		if err != nil {
+			return fmt.Errorf("Could not get revision: %v", err)
+		}
+		if old == nil {
+			http.Error(c.Res, "Revision not found", http.StatusNotFound)
+			return nil
+		}
+		getData := func(node *service.Node, file string) ([]byte, error) {
+			if node == old {
+				return m.GetNodeRevisionData(c.Site.Name, c.Node.Path, number, file)
+			}
+			return m.GetNodeData(c.Site.Name, c.Node.Path, file)
+		}
+		context["Revision"] = number
+		context["Changes"], err = diffNodes(old, c.Node, c.UserSession.Locale,
+			getData)
+		if err != nil {
+			return fmt.Errorf("Could not compare revisions: %v", err)
+		}
+	}
+	body, err := h.Renderer.Render("actions/history", context,
+		c.UserSession.Locale,
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
+	if err != nil {
+		return fmt.Errorf("Can't render history: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: fmt.Sprintf(G("History of \"%v\""), c.Node.Path)}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
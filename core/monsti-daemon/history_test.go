@@ -0,0 +1,173 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestArchiveNode(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.json":        `{"Type":"core.Foo","Order":1}`,
+		"/foo/__file_core.File": "first",
+		"/foo/__image_10x10":    "resized"},
+		"TestArchiveNode")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	store := &fsNodeStore{root}
+	if err := archiveNode(store, "/foo", ""); err != nil {
+		t.Fatalf("archiveNode returned error: %v", err)
+	}
+	// The file did not change since the last revision.
+	if err := archiveNode(store, "/foo", "__file_core.File"); err != nil {
+		t.Fatalf("archiveNode returned error: %v", err)
+	}
+	revisions, err := getNodeRevisions(store, "/foo")
+	if err != nil {
+		t.Fatalf("getNodeRevisions returned error: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Number != 1 ||
+		len(revisions[0].Files) != 2 {
+		t.Fatalf("getNodeRevisions returned %v, expected one revision "+
+			"with two files", revisions)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "foo", "__file_core.File"),
+		[]byte("second"), 0600); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if err := archiveNode(store, "/foo", "__file_core.File"); err != nil {
+		t.Fatalf("archiveNode returned error: %v", err)
+	}
+	// The unchanged node should be referenced instead of copied.
+	if _, err := os.Stat(filepath.Join(root, "foo", historyDir, "2",
+		"node.json")); !os.IsNotExist(err) {
+		t.Errorf("Unchanged node.json should not be copied: %v", err)
+	}
+	content, err := getNodeRevisionData(store, "/foo", 2, "node.json")
+	if err != nil || string(content) != `{"Type":"core.Foo","Order":1}` {
+		t.Errorf("getNodeRevisionData(_, %q, 2, %q) = %s, %v", "/foo",
+			"node.json", content, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "foo", "node.json"),
+		[]byte(`{"Type":"core.Foo","Order":2}`), 0600); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "foo", "__file_core.Other"),
+		[]byte("added"), 0600); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if err := restoreNodeRevision(store, "/foo", 1); err != nil {
+		t.Fatalf("restoreNodeRevision returned error: %v", err)
+	}
+	revisions, err = getNodeRevisions(store, "/foo")
+	if err != nil {
+		t.Fatalf("getNodeRevisions returned error: %v", err)
+	}
+	if len(revisions) != 3 || revisions[0].Number != 3 {
+		t.Errorf("getNodeRevisions returned %v, expected three revisions",
+			revisions)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(root, "foo", "node.json"))
+	if err != nil {
+		t.Fatalf("Could not read node: %v", err)
+	}
+	var node struct{ Order int }
+	if err := json.Unmarshal(content, &node); err != nil || node.Order != 1 {
+		t.Errorf("Restored node is %s, should have order 1", content)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(root, "foo", "__file_core.File"))
+	if err != nil || string(content) != "first" {
+		t.Errorf("Restored file is %q, should be %q", content, "first")
+	}
+	if _, err := ioutil.ReadFile(
+		filepath.Join(root, "foo", "__image_10x10")); err == nil {
+		t.Errorf("Resized image should have been removed on restore")
+	}
+	if _, err := ioutil.ReadFile(
+		filepath.Join(root, "foo", "__file_core.Other")); err == nil {
+		t.Errorf("File added after the revision should have been removed")
+	}
+	children, err := getChildren(root, "/foo")
+	if err != nil || len(children) != 0 {
+		t.Errorf("getChildren(%q, %q) = %s, %v, should not list the history",
+			root, "/foo", children, err)
+	}
+}
+
+func TestPruneNodeRevisions(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti_prune_test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	stores := map[string]NodeStore{
+		"filesystem": &fsNodeStore{root},
+		"kv":         &kvNodeStore{newMemoryBackend()},
+	}
+	for name, store := range stores {
+		// Revision 1 keeps the node without the file. Revision 2 keeps
+		// the file, which is referenced by revisions 3 to 5.
+		for order := 0; order <= 4; order++ {
+			if order == 1 {
+				if err := store.WriteNodeData("/foo", "__file_core.File",
+					[]byte("file")); err != nil {
+					t.Fatalf("%v: WriteNodeData returned error: %v", name, err)
+				}
+			}
+			if err := store.WriteNodeData("/foo", "node.json", []byte(
+				fmt.Sprintf(`{"Type":"core.Foo","Order":%v}`, order))); err != nil {
+				t.Fatalf("%v: WriteNodeData returned error: %v", name, err)
+			}
+		}
+		if err := store.PruneNodeRevisions("/foo", 2); err != nil {
+			t.Fatalf("%v: PruneNodeRevisions returned error: %v", name, err)
+		}
+		revisions, err := store.GetNodeRevisions("/foo")
+		if err != nil || len(revisions) != 2 || revisions[1].Number != 4 {
+			t.Fatalf("%v: GetNodeRevisions = %v, %v, should return "+
+				"revisions 5 and 4", name, revisions, err)
+		}
+		for _, revision := range revisions {
+			content, err := store.GetNodeRevisionData("/foo", revision.Number,
+				"__file_core.File")
+			if err != nil || string(content) != "file" {
+				t.Errorf("%v: File of revision %v is %q, %v, should be %q", name,
+					revision.Number, content, err, "file")
+			}
+		}
+		content, err := store.GetNodeRevisionData("/foo", 2, "__file_core.File")
+		if err != nil || content != nil {
+			t.Errorf("%v: Revision 2 should have been removed: %s, %v", name,
+				content, err)
+		}
+		entries, err := store.(nodeDataStore).listData("/foo", historyDir)
+		if err != nil || !reflect.DeepEqual(entries, []string{"4", "5"}) {
+			t.Errorf("%v: History contains %v, %v, should contain 4 and 5", name,
+				entries, err)
+		}
+	}
+}
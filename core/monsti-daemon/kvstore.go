@@ -0,0 +1,436 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// kvBackend is a simple key value database.
+type kvBackend interface {
+	// Get returns the value of the given key. If the key does not exist,
+	// it returns nil, nil.
+	Get(key string) ([]byte, error)
+	// Put sets the value of the given key.
+	Put(key string, value []byte) error
+	// Delete removes the given key.
+	Delete(key string) error
+	// Keys returns all keys with the given prefix in ascending order.
+	Keys(prefix string) ([]string, error)
+	// Names returns the distinct names of the keys with the given
+	// prefix in ascending order. The name of a key is the part after
+	// the prefix up to the first of the given separators. Backends may
+	// skip the remaining keys of a name instead of visiting them.
+	Names(prefix, separators string) ([]string, error)
+	// Move moves each key having one of the given map's keys as prefix
+	// to the key with the prefix replaced by the corresponding map
+	// value. Either all or none of the keys are moved.
+	Move(prefixes map[string]string) error
+	// Close closes the database.
+	Close() error
+}
+
+// memoryBackend keeps all values in memory.
+type memoryBackend struct {
+	mutex  sync.RWMutex
+	values map[string][]byte
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{values: make(map[string][]byte)}
+}
+
+func (b *memoryBackend) Get(key string) ([]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	value, ok := b.values[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (b *memoryBackend) Put(key string, value []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.values[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memoryBackend) Delete(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.values, key)
+	return nil
+}
+
+func (b *memoryBackend) Keys(prefix string) ([]string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	var keys []string
+	for key := range b.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b *memoryBackend) Names(prefix, separators string) ([]string, error) {
+	keys, err := b.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		name := key[len(prefix):]
+		if i := strings.IndexAny(name, separators); i >= 0 {
+			name = name[:i]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (b *memoryBackend) Move(prefixes map[string]string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	moved := make(map[string][]byte)
+	for key, value := range b.values {
+		if newKey, ok := movedKey(key, prefixes); ok {
+			moved[newKey] = value
+			delete(b.values, key)
+		}
+	}
+	for key, value := range moved {
+		b.values[key] = value
+	}
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+// boltBucket is the name of the bucket holding the node data.
+var boltBucket = []byte("nodes")
+
+// boltBackend stores all values in a single bolt database file.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+// openBoltBackend opens or creates the bolt database at the given path.
+func openBoltBackend(path string) (*boltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not create bucket: %v", err)
+	}
+	return &boltBackend{db}, nil
+}
+
+func (b *boltBackend) Get(key string) (value []byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid during the transaction.
+		if v := tx.Bucket(boltBucket).Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return
+}
+
+func (b *boltBackend) Put(key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), value)
+	})
+}
+
+func (b *boltBackend) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltBackend) Keys(prefix string) (keys []string, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil &&
+			strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return
+}
+
+func (b *boltBackend) Names(prefix, separators string) (names []string,
+	err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		seen := make(map[string]bool)
+		k, _ := c.Seek([]byte(prefix))
+		for k != nil && strings.HasPrefix(string(k), prefix) {
+			name := string(k[len(prefix):])
+			i := strings.IndexAny(name, separators)
+			if i < 0 {
+				k, _ = c.Next()
+			} else {
+				name = name[:i]
+				// Skip all keys starting with the name and this separator.
+				next := append([]byte{}, k[:len(prefix)+i+1]...)
+				next[len(next)-1]++
+				k, _ = c.Seek(next)
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (b *boltBackend) Move(prefixes map[string]string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		// The bucket must not be modified while iterating over it.
+		var keys []string
+		moved := make(map[string][]byte)
+		for prefix := range prefixes {
+			c := bucket.Cursor()
+			for k, v := c.Seek([]byte(prefix)); k != nil &&
+				strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+				newKey, _ := movedKey(string(k), prefixes)
+				keys = append(keys, string(k))
+				moved[newKey] = append([]byte{}, v...)
+			}
+		}
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		for key, value := range moved {
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// movedKey returns the new key of the given key if it has one of the
+// given prefixes to be moved.
+func movedKey(key string, prefixes map[string]string) (string, bool) {
+	for prefix, target := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return target + key[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+// kvNodeStore stores nodes in a key value database.
+//
+// The key of a node's data file is the node's path followed by a null
+// byte and the name of the file, e.g. "/foo/bar\x00node.json". The
+// root node's path is the empty string.
+type kvNodeStore struct {
+	db kvBackend
+}
+
+// kvNodePath returns the normalized path of the given node as used
+// in keys.
+func kvNodePath(path string) string {
+	path = pathpkg.Clean("/" + path)
+	if path == "/" {
+		return ""
+	}
+	return path
+}
+
+// kvKey returns the key of the given data file of the given node.
+func kvKey(path, file string) string {
+	return kvNodePath(path) + "\x00" + file
+}
+
+func (s *kvNodeStore) GetNode(path string) ([]byte, error) {
+	node, err := s.readData(path, "node.json")
+	if err != nil || node == nil {
+		return nil, err
+	}
+	return addNodePath(node, path), nil
+}
+
+func (s *kvNodeStore) GetChildren(path string) ([][]byte, error) {
+	prefix := kvNodePath(path) + "/"
+	names, err := s.db.Names(prefix, "/\x00")
+	if err != nil {
+		return nil, fmt.Errorf("Could not get child names: %v", err)
+	}
+	var nodes [][]byte
+	for _, name := range names {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		childPath := prefix + name
+		node, err := s.GetNode(childPath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get child %q: %v", childPath, err)
+		}
+		if node == nil {
+			node = []byte(fmt.Sprintf(`{"Path":%q,"Type":"core.Path"}`, childPath))
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (s *kvNodeStore) GetNodeData(path, file string) ([]byte, error) {
+	return s.readData(path, file)
+}
+
+func (s *kvNodeStore) WriteNodeData(path, file string, content []byte) error {
+	if err := archiveNodeData(s, path, file); err != nil {
+		return fmt.Errorf("Could not archive node: %v", err)
+	}
+	if err := s.writeData(path, file, content); err != nil {
+		return fmt.Errorf("Could not write node data: %v", err)
+	}
+	return nil
+}
+
+// nodeKeys returns all keys of the given node and its descendants.
+func (s *kvNodeStore) nodeKeys(path string) ([]string, error) {
+	own, err := s.db.Keys(kvNodePath(path) + "\x00")
+	if err != nil {
+		return nil, err
+	}
+	descendants, err := s.db.Keys(kvNodePath(path) + "/")
+	if err != nil {
+		return nil, err
+	}
+	return append(own, descendants...), nil
+}
+
+func (s *kvNodeStore) RemoveNode(path string) error {
+	keys, err := s.nodeKeys(path)
+	if err != nil {
+		return fmt.Errorf("Can't get node keys: %v", err)
+	}
+	for _, key := range keys {
+		if err := s.db.Delete(key); err != nil {
+			return fmt.Errorf("Can't remove node: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *kvNodeStore) RenameNode(source, target string) error {
+	source, target = kvNodePath(source), kvNodePath(target)
+	if err := s.db.Move(map[string]string{
+		source + "\x00": target + "\x00",
+		source + "/":    target + "/"}); err != nil {
+		return fmt.Errorf("Can't move node: %v", err)
+	}
+	return nil
+}
+
+func (s *kvNodeStore) GetNodeRevisions(path string) (
+	[]service.NodeRevision, error) {
+	return getNodeRevisions(s, path)
+}
+
+func (s *kvNodeStore) GetNodeRevisionData(path string, number int,
+	file string) ([]byte, error) {
+	return getNodeRevisionData(s, path, number, file)
+}
+
+func (s *kvNodeStore) RestoreNodeRevision(path string, number int) error {
+	return restoreNodeRevision(s, path, number)
+}
+
+func (s *kvNodeStore) PruneNodeRevisions(path string, max int) error {
+	return pruneNodeRevisions(s, path, max)
+}
+
+func (s *kvNodeStore) ListNodeData(path string) ([]string, error) {
+	prefix := kvKey(path, "")
+	keys, err := s.db.Keys(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get keys: %v", err)
+	}
+	var names []string
+	for _, key := range keys {
+		name := key[len(prefix):]
+		if isDataFileAccessible(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *kvNodeStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *kvNodeStore) readData(path, file string) ([]byte, error) {
+	return s.db.Get(kvKey(path, file))
+}
+
+func (s *kvNodeStore) writeData(path, file string, content []byte) error {
+	return s.db.Put(kvKey(path, file), content)
+}
+
+func (s *kvNodeStore) removeData(path, file string) error {
+	return s.db.Delete(kvKey(path, file))
+}
+
+func (s *kvNodeStore) listData(path, dir string) ([]string, error) {
+	prefix := kvKey(path, dir)
+	if len(dir) > 0 {
+		prefix += "/"
+	}
+	return s.db.Names(prefix, "/")
+}
@@ -0,0 +1,178 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// localeCookie is the name of the cookie remembering the locale
+// chosen by visiting a locale prefixed URL.
+const localeCookie = "monsti-locale"
+
+// isMultilingual returns true if the site has several locales.
+func isMultilingual(site util.SiteSettings) bool {
+	return len(site.Locales) > 1
+}
+
+// hasLocale returns true if the locale is one of the site's locales.
+func hasLocale(site util.SiteSettings, locale string) bool {
+	for _, l := range site.Locales {
+		if l == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// splitLocalePrefix splits a leading locale of the site from the URL
+// path, e.g. "/de/foo/" into "de" and "/foo/". The locale is empty if
+// the path has no such prefix.
+func splitLocalePrefix(site util.SiteSettings, urlPath string) (string,
+	string) {
+	parts := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+	if !hasLocale(site, parts[0]) {
+		return "", urlPath
+	}
+	if len(parts) == 1 {
+		return parts[0], "/"
+	}
+	return parts[0], "/" + parts[1]
+}
+
+type languageRange struct {
+	Tag     string
+	Quality float64
+}
+
+type languageRanges []languageRange
+
+func (l languageRanges) Len() int           { return len(l) }
+func (l languageRanges) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l languageRanges) Less(i, j int) bool { return l[i].Quality > l[j].Quality }
+
+// parseAcceptLanguage returns the lower cased language tags of the
+// given Accept-Language header, most preferred first.
+func parseAcceptLanguage(header string) []string {
+	var ranges languageRanges
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(tag) == 0 {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			ranges = append(ranges, languageRange{tag, quality})
+		}
+	}
+	sort.Stable(ranges)
+	tags := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		tags = append(tags, r.Tag)
+	}
+	return tags
+}
+
+// matchLocale returns the site's locale matching the language tag,
+// e.g. "de" for "de-AT", or the empty string.
+func matchLocale(site util.SiteSettings, tag string) string {
+	for _, locale := range site.Locales {
+		if strings.ToLower(locale) == tag {
+			return locale
+		}
+	}
+	base := strings.SplitN(tag, "-", 2)[0]
+	for _, locale := range site.Locales {
+		if strings.ToLower(locale) == base {
+			return locale
+		}
+	}
+	return ""
+}
+
+// negotiateLocale returns the locale of the request and the URL path
+// without locale prefix.
+//
+// The locale is taken from the URL prefix, the locale cookie or the
+// Accept-Language header, in this order, and defaults to the site's
+// locale. A locale given by URL prefix gets remembered in the locale
+// cookie.
+func negotiateLocale(w http.ResponseWriter, r *http.Request,
+	site util.SiteSettings) (string, string) {
+	if !isMultilingual(site) {
+		return site.Locale, r.URL.Path
+	}
+	locale, urlPath := splitLocalePrefix(site, r.URL.Path)
+	if len(locale) > 0 {
+		cookie, err := r.Cookie(localeCookie)
+		if err != nil || cookie.Value != locale {
+			http.SetCookie(w, &http.Cookie{
+				Name:   localeCookie,
+				Value:  locale,
+				Path:   "/",
+				MaxAge: 365 * 24 * 60 * 60,
+			})
+		}
+		return locale, urlPath
+	}
+	if cookie, err := r.Cookie(localeCookie); err == nil &&
+		hasLocale(site, cookie.Value) {
+		return cookie.Value, urlPath
+	}
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if locale := matchLocale(site, tag); len(locale) > 0 {
+			return locale, urlPath
+		}
+	}
+	return site.Locale, urlPath
+}
+
+// translationLink links to a translation of a node.
+type translationLink struct {
+	Locale, URL string
+}
+
+// getTranslationLinks returns links to the node in all locales of a
+// multilingual site.
+func getTranslationLinks(site util.SiteSettings,
+	nodePath string) []translationLink {
+	if !isMultilingual(site) {
+		return nil
+	}
+	links := make([]translationLink, 0, len(site.Locales))
+	for _, locale := range site.Locales {
+		urlPath := path.Join("/", locale, nodePath) + "/"
+		links = append(links, translationLink{locale,
+			strings.TrimSuffix(site.BaseURL, "/") + urlPath})
+	}
+	return links
+}
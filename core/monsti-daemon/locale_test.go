@@ -0,0 +1,104 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		Header string
+		Tags   []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"en-US,en;q=0.8,de;q=0.9", []string{"en-us", "de", "en"}},
+		{"fr;q=0, DE-at ; q=0.5, *;q=0.1", []string{"de-at", "*"}},
+	}
+	for _, test := range tests {
+		if tags := parseAcceptLanguage(test.Header); !reflect.DeepEqual(tags,
+			test.Tags) {
+			t.Errorf("parseAcceptLanguage(%q) = %v, should be %v", test.Header,
+				tags, test.Tags)
+		}
+	}
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	site := util.SiteSettings{Locale: "en", Locales: []string{"en", "de"}}
+	tests := []struct {
+		Path, Cookie, AcceptLanguage string
+		Locale, URLPath              string
+		SetCookie                    bool
+	}{
+		{"/foo/", "", "", "en", "/foo/", false},
+		{"/de/foo/@@edit", "", "", "de", "/foo/@@edit", true},
+		{"/de", "de", "", "de", "/", false},
+		{"/deutsch/", "", "", "en", "/deutsch/", false},
+		{"/foo/", "de", "en", "de", "/foo/", false},
+		{"/foo/", "fr", "de-AT,en;q=0.5", "de", "/foo/", false},
+		{"/foo/", "", "fr, it", "en", "/foo/", false},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com"+test.Path, nil)
+		if len(test.Cookie) > 0 {
+			req.AddCookie(&http.Cookie{Name: localeCookie, Value: test.Cookie})
+		}
+		req.Header.Set("Accept-Language", test.AcceptLanguage)
+		w := httptest.NewRecorder()
+		locale, urlPath := negotiateLocale(w, req, site)
+		if locale != test.Locale || urlPath != test.URLPath {
+			t.Errorf("Test %v: negotiateLocale = %q, %q, should be %q, %q", i,
+				locale, urlPath, test.Locale, test.URLPath)
+		}
+		if setCookie := len(w.Header().Get("Set-Cookie")) > 0; setCookie !=
+			test.SetCookie {
+			t.Errorf("Test %v: Cookie set: %v, should be %v", i, setCookie,
+				test.SetCookie)
+		}
+	}
+	site.Locales = nil
+	req, _ := http.NewRequest("GET", "http://example.com/de/foo/", nil)
+	if locale, urlPath := negotiateLocale(httptest.NewRecorder(), req,
+		site); locale != "en" || urlPath != "/de/foo/" {
+		t.Errorf("Single locale sites should ignore locale prefixes, got %q, %q",
+			locale, urlPath)
+	}
+}
+
+func TestGetTranslationLinks(t *testing.T) {
+	site := util.SiteSettings{BaseURL: "http://example.com/",
+		Locales: []string{"en", "de"}}
+	expected := []translationLink{
+		{"en", "http://example.com/en/foo/"},
+		{"de", "http://example.com/de/foo/"}}
+	if links := getTranslationLinks(site, "/foo"); !reflect.DeepEqual(links,
+		expected) {
+		t.Errorf("getTranslationLinks = %v, should be %v", links, expected)
+	}
+	if links := getTranslationLinks(site, "/"); links[1].URL !=
+		"http://example.com/de/" {
+		t.Errorf("Link to the root should be %q, got %q",
+			"http://example.com/de/", links[1].URL)
+	}
+}
@@ -0,0 +1,367 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// schemaFile is the name of the file in the site's data directory
+// holding the site's schema versions.
+const schemaFile = "schema.json"
+
+// coreMigrations are the migrations of Monsti's node documents.
+var coreMigrations = []service.Migration{
+	{
+		Namespace: "core",
+		Version:   1,
+		Description: "Publish nodes written before publication times " +
+			"have been introduced",
+		Migrate: migratePublication,
+	},
+}
+
+// migratePublication publishes nodes without publication attributes
+// as of their last change.
+func migratePublication(site, path string, node map[string]interface{}) error {
+	if _, ok := node["PublishTime"]; ok {
+		return nil
+	}
+	published, ok := node["Changed"]
+	if !ok {
+		published = time.Now().UTC().Format(time.RFC3339Nano)
+		node["Changed"] = published
+	}
+	node["PublishTime"] = published
+	if _, ok := node["Public"]; !ok {
+		node["Public"] = true
+	}
+	return nil
+}
+
+// readSchemaVersions returns the schema versions of the site with the
+// given data directory. The versions of sites without schema file are
+// all zero.
+func readSchemaVersions(dataDir string) (map[string]int, error) {
+	versions := make(map[string]int)
+	content, err := ioutil.ReadFile(filepath.Join(dataDir, schemaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return versions, nil
+		}
+		return nil, fmt.Errorf("Could not read schema versions: %v", err)
+	}
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return nil, fmt.Errorf("Could not decode schema versions: %v", err)
+	}
+	return versions, nil
+}
+
+// writeSchemaVersions writes the schema versions of the site with the
+// given data directory.
+func writeSchemaVersions(dataDir string, versions map[string]int) error {
+	content, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not encode schema versions: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, schemaFile), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write schema versions: %v", err)
+	}
+	return nil
+}
+
+// migrator keeps track of the registered migrations and of the sites
+// which have to be migrated.
+//
+// The zero value is a migrator without migrations.
+type migrator struct {
+	mutex sync.RWMutex
+	// migrations maps namespaces to their migrations.
+	migrations map[string][]service.Migration
+	// outdated holds the names of the sites which have to be migrated.
+	outdated map[string]bool
+}
+
+// register adds the given migration. It replaces a registered
+// migration with the same namespace and version.
+func (m *migrator) register(migration service.Migration) error {
+	if len(migration.Namespace) == 0 || migration.Version < 1 {
+		return fmt.Errorf("Invalid migration %v of %q", migration.Version,
+			migration.Namespace)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.migrations == nil {
+		m.migrations = make(map[string][]service.Migration)
+	}
+	migrations := m.migrations[migration.Namespace]
+	for i := range migrations {
+		if migrations[i].Version == migration.Version {
+			migrations[i] = migration
+			return nil
+		}
+	}
+	migrations = append(migrations, migration)
+	sort.Sort(migrationsByVersion(migrations))
+	m.migrations[migration.Namespace] = migrations
+	return nil
+}
+
+type migrationsByVersion []service.Migration
+
+func (m migrationsByVersion) Len() int      { return len(m) }
+func (m migrationsByVersion) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m migrationsByVersion) Less(i, j int) bool {
+	return m[i].Version < m[j].Version
+}
+
+// pending returns the migrations to be applied to a site with the
+// given schema versions in the order of their application: The core
+// migrations first, then those of the modules sorted by namespace.
+func (m *migrator) pending(versions map[string]int) []service.Migration {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	namespaces := make([]string, 0, len(m.migrations))
+	for namespace := range m.migrations {
+		if namespace != "core" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	namespaces = append([]string{"core"}, namespaces...)
+	var pending []service.Migration
+	for _, namespace := range namespaces {
+		for _, migration := range m.migrations[namespace] {
+			if migration.Version > versions[namespace] {
+				pending = append(pending, migration)
+			}
+		}
+	}
+	return pending
+}
+
+// setOutdated marks the site as outdated or up to date.
+func (m *migrator) setOutdated(site string, outdated bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.outdated == nil {
+		m.outdated = make(map[string]bool)
+	}
+	if outdated {
+		m.outdated[site] = true
+	} else {
+		delete(m.outdated, site)
+	}
+}
+
+// isOutdated returns true if the site has to be migrated.
+func (m *migrator) isOutdated(site string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.outdated[site]
+}
+
+func (i *MonstiService) RegisterMigration(migration *service.Migration,
+	reply *int) error {
+	if migration.Namespace == "core" {
+		return fmt.Errorf("The core namespace is reserved for Monsti")
+	}
+	return i.migrator.register(*migration)
+}
+
+// checkSchemas marks the sites with pending migrations as outdated.
+// Outdated sites will not be served until they have been migrated.
+func (i *MonstiService) checkSchemas() error {
+	for site := range i.Settings.getSites() {
+		versions, err := readSchemaVersions(
+			i.Settings.getMonsti().GetSiteDataPath(site))
+		if err != nil {
+			return fmt.Errorf("Could not check schema of site %q: %v", site, err)
+		}
+		pending := i.migrator.pending(versions)
+		i.migrator.setOutdated(site, len(pending) > 0)
+		if len(pending) > 0 {
+			i.Logger.Printf("Site %q has %v pending migrations and will not be "+
+				"served. Run monsti-admin migrate.", site, len(pending))
+		}
+	}
+	return nil
+}
+
+// applyMigration applies the migration to the node document.
+func (i *MonstiService) applyMigration(migration service.Migration,
+	site, nodePath string, content []byte) ([]byte, error) {
+	if migration.Migrate == nil {
+		var rets []service.MigrateNodeRet
+		if err := i.emitSignal("monsti.MigrateNode", service.MigrateNodeArgs{
+			Site: site, Path: nodePath, Namespace: migration.Namespace,
+			Version: migration.Version, Node: content}, &rets); err != nil {
+			return nil, fmt.Errorf("Could not emit signal: %v", err)
+		}
+		for _, ret := range rets {
+			if ret.Handled {
+				return ret.Node, nil
+			}
+		}
+		return nil, fmt.Errorf("No module handled the migration (not running?)")
+	}
+	var node map[string]interface{}
+	if err := json.Unmarshal(content, &node); err != nil {
+		return nil, fmt.Errorf("Could not decode node: %v", err)
+	}
+	if err := migration.Migrate(site, nodePath, node); err != nil {
+		return nil, err
+	}
+	return json.Marshal(node)
+}
+
+// sameNode returns true if both JSON documents are equal.
+func sameNode(a, b []byte) (bool, error) {
+	var nodeA, nodeB interface{}
+	if err := json.Unmarshal(a, &nodeA); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, &nodeB); err != nil {
+		return false, err
+	}
+	encodedA, _ := json.Marshal(nodeA)
+	encodedB, _ := json.Marshal(nodeB)
+	return bytes.Equal(encodedA, encodedB), nil
+}
+
+type MigrateSiteArgs struct {
+	Site           string
+	DryRun, Backup bool
+}
+
+// MigrateSite applies the pending migrations to the site's nodes.
+func (i *MonstiService) MigrateSite(args *MigrateSiteArgs,
+	ret *service.MigrateSiteResult) error {
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
+	}
+	dataDir := i.Settings.getMonsti().GetSiteDataPath(args.Site)
+	versions, err := readSchemaVersions(dataDir)
+	if err != nil {
+		return err
+	}
+	pending := i.migrator.pending(versions)
+	if len(pending) == 0 {
+		return nil
+	}
+	for _, migration := range pending {
+		ret.Migrations = append(ret.Migrations, service.MigrationResult{
+			Namespace:   migration.Namespace,
+			Version:     migration.Version,
+			Description: migration.Description,
+		})
+	}
+	if args.Backup && !args.DryRun {
+		ret.Backup = filepath.Join(dataDir, "backups",
+			"migration-"+time.Now().UTC().Format("20060102150405"))
+	}
+	var changed []string
+	err = func() error {
+		defer i.lockSite(args.Site)()
+		return i.walkNodes(args.Site, "/", func(nodePath string, _ []byte) error {
+			original, err := store.GetNodeData(nodePath, "node.json")
+			if err != nil {
+				return fmt.Errorf("Could not read node %q: %v", nodePath, err)
+			}
+			content := original
+			for idx, migration := range pending {
+				migrated, err := i.applyMigration(migration, args.Site, nodePath,
+					content)
+				if err != nil {
+					return fmt.Errorf("Migration %v of %q failed for node %q: %v",
+						migration.Version, migration.Namespace, nodePath, err)
+				}
+				same, err := sameNode(content, migrated)
+				if err != nil {
+					return fmt.Errorf("Could not compare node %q: %v", nodePath, err)
+				}
+				if !same {
+					ret.Migrations[idx].Nodes = append(ret.Migrations[idx].Nodes,
+						nodePath)
+					content = migrated
+				}
+			}
+			if args.DryRun || bytes.Equal(content, original) {
+				return nil
+			}
+			if len(ret.Backup) > 0 {
+				dir := filepath.Join(ret.Backup, "nodes", filepath.FromSlash(nodePath))
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					return fmt.Errorf("Could not create backup directory: %v", err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "node.json"),
+					original, 0600); err != nil {
+					return fmt.Errorf("Could not backup node %q: %v", nodePath, err)
+				}
+			}
+			var node interface{}
+			if err := json.Unmarshal(content, &node); err != nil {
+				return fmt.Errorf("Could not decode node %q: %v", nodePath, err)
+			}
+			content, err = json.MarshalIndent(node, "", "  ")
+			if err != nil {
+				return fmt.Errorf("Could not encode node %q: %v", nodePath, err)
+			}
+			if err := store.WriteNodeData(nodePath, "node.json",
+				content); err != nil {
+				return fmt.Errorf("Could not write node %q: %v", nodePath, err)
+			}
+			changed = append(changed, nodePath)
+			return nil
+		})
+	}()
+	for _, nodePath := range changed {
+		i.nodeWritten(args.Site, nodePath)
+	}
+	if err != nil || args.DryRun {
+		return err
+	}
+	if len(ret.Backup) > 0 {
+		if err := os.MkdirAll(ret.Backup, 0700); err != nil {
+			return fmt.Errorf("Could not create backup directory: %v", err)
+		}
+		if err := writeSchemaVersions(ret.Backup, versions); err != nil {
+			return fmt.Errorf("Could not backup schema versions: %v", err)
+		}
+	}
+	for _, migration := range pending {
+		versions[migration.Namespace] = migration.Version
+	}
+	if err := writeSchemaVersions(dataDir, versions); err != nil {
+		return err
+	}
+	i.migrator.setOutdated(args.Site, false)
+	i.Logger.Printf("Migrated site %q", args.Site)
+	return nil
+}
@@ -0,0 +1,185 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestMigratePublication(t *testing.T) {
+	tests := []struct {
+		Node, Expected string
+	}{
+		{`{"Changed":"2014-01-02T00:00:00Z"}`,
+			`{"Changed":"2014-01-02T00:00:00Z",` +
+				`"Public":true,"PublishTime":"2014-01-02T00:00:00Z"}`},
+		{`{"Changed":"2014-01-02T00:00:00Z","Public":false}`,
+			`{"Changed":"2014-01-02T00:00:00Z",` +
+				`"Public":false,"PublishTime":"2014-01-02T00:00:00Z"}`},
+		{`{"Public":false,"PublishTime":"2014-01-02T00:00:00Z"}`,
+			`{"Public":false,"PublishTime":"2014-01-02T00:00:00Z"}`},
+	}
+	for _, test := range tests {
+		var node map[string]interface{}
+		if err := json.Unmarshal([]byte(test.Node), &node); err != nil {
+			t.Fatalf("Could not decode node: %v", err)
+		}
+		if err := migratePublication("foo", "/", node); err != nil {
+			t.Errorf("migratePublication(%v) returned error: %v", test.Node, err)
+			continue
+		}
+		migrated, _ := json.Marshal(node)
+		if string(migrated) != test.Expected {
+			t.Errorf("migratePublication(%v) = %s, should be %v", test.Node,
+				migrated, test.Expected)
+		}
+	}
+}
+
+func TestMigratorPending(t *testing.T) {
+	var m migrator
+	for _, migration := range []service.Migration{
+		{Namespace: "foo", Version: 2},
+		{Namespace: "core", Version: 1},
+		{Namespace: "foo", Version: 1},
+		{Namespace: "bar", Version: 1},
+		{Namespace: "core", Version: 2},
+		{Namespace: "foo", Version: 2, Description: "replaced"}} {
+		if err := m.register(migration); err != nil {
+			t.Fatalf("register(%v) returned error: %v", migration, err)
+		}
+	}
+	if err := m.register(service.Migration{Namespace: "foo"}); err == nil {
+		t.Errorf("register should fail for version 0")
+	}
+	tests := []struct {
+		Versions map[string]int
+		Pending  []string
+	}{
+		{nil, []string{"core#1", "core#2", "bar#1", "foo#1", "foo#2"}},
+		{map[string]int{"core": 1, "foo": 2}, []string{"core#2", "bar#1"}},
+		{map[string]int{"core": 2, "foo": 2, "bar": 1}, nil},
+	}
+	for i, test := range tests {
+		var pending []string
+		for _, migration := range m.pending(test.Versions) {
+			pending = append(pending,
+				fmt.Sprintf("%v#%v", migration.Namespace, migration.Version))
+		}
+		if !reflect.DeepEqual(pending, test.Pending) {
+			t.Errorf("Test %v: pending = %v, should be %v", i, pending,
+				test.Pending)
+		}
+	}
+	if m.migrations["foo"][1].Description != "replaced" {
+		t.Errorf("register should replace migrations with the same version")
+	}
+}
+
+func TestMigrateSite(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti_migrations_test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	monsti := &MonstiService{
+		Settings: &settings{},
+		Logger:   log.New(ioutil.Discard, "", 0),
+	}
+	monsti.Settings.Monsti.Directories.Data = root
+	monsti.Settings.Monsti.Sites = map[string]util.SiteSettings{"foo": {}}
+	dataDir := monsti.Settings.Monsti.GetSiteDataPath("foo")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		t.Fatalf("Could not create data dir: %v", err)
+	}
+	store := &kvNodeStore{newMemoryBackend()}
+	monsti.stores = map[string]NodeStore{"foo": store}
+	for path, content := range map[string]string{
+		"/":    `{"Type":"core.Document","Changed":"2014-01-02T00:00:00Z"}`,
+		"/bar": `{"Type":"core.Document","PublishTime":"2014-01-02T00:00:00Z"}`,
+	} {
+		if err := store.WriteNodeData(path, "node.json",
+			[]byte(content)); err != nil {
+			t.Fatalf("Could not write node: %v", err)
+		}
+	}
+	for _, migration := range coreMigrations {
+		monsti.migrator.register(migration)
+	}
+	if err := monsti.checkSchemas(); err != nil {
+		t.Fatalf("checkSchemas returned error: %v", err)
+	}
+	if !monsti.migrator.isOutdated("foo") {
+		t.Errorf("Site without schema versions should be outdated")
+	}
+
+	var ret service.MigrateSiteResult
+	if err := monsti.MigrateSite(&MigrateSiteArgs{Site: "foo", DryRun: true},
+		&ret); err != nil {
+		t.Fatalf("MigrateSite returned error: %v", err)
+	}
+	if len(ret.Migrations) != 1 ||
+		!reflect.DeepEqual(ret.Migrations[0].Nodes, []string{"/"}) {
+		t.Errorf("Dry run should report changes of the root node: %v", ret)
+	}
+	content, _ := store.GetNodeData("/", "node.json")
+	if string(content) !=
+		`{"Type":"core.Document","Changed":"2014-01-02T00:00:00Z"}` {
+		t.Errorf("Dry run should not change nodes, got %s", content)
+	}
+	if !monsti.migrator.isOutdated("foo") {
+		t.Errorf("Site should be outdated after dry run")
+	}
+
+	ret = service.MigrateSiteResult{}
+	if err := monsti.MigrateSite(&MigrateSiteArgs{Site: "foo", Backup: true},
+		&ret); err != nil {
+		t.Fatalf("MigrateSite returned error: %v", err)
+	}
+	var node map[string]interface{}
+	content, _ = store.GetNodeData("/", "node.json")
+	if err := json.Unmarshal(content, &node); err != nil ||
+		node["PublishTime"] != "2014-01-02T00:00:00Z" {
+		t.Errorf("Root node should have been migrated, got %s", content)
+	}
+	backup, err := ioutil.ReadFile(filepath.Join(ret.Backup, "nodes",
+		"node.json"))
+	if err != nil || string(backup) !=
+		`{"Type":"core.Document","Changed":"2014-01-02T00:00:00Z"}` {
+		t.Errorf("Backup should hold the original node: %s, %v", backup, err)
+	}
+	if _, err := os.Stat(filepath.Join(ret.Backup, "nodes", "bar")); err == nil {
+		t.Errorf("Unchanged nodes should not be backed up")
+	}
+	versions, err := readSchemaVersions(dataDir)
+	if err != nil || versions["core"] != 1 {
+		t.Errorf("Schema version should be updated: %v, %v", versions, err)
+	}
+	if monsti.migrator.isOutdated("foo") {
+		t.Errorf("Migrated site should not be outdated")
+	}
+}
@@ -0,0 +1,296 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+const (
+	// minModuleBackoff is the time to wait before restarting a crashed
+	// module for the first time.
+	minModuleBackoff = time.Second
+	// maxModuleBackoff is the maximum time to wait before restarting a
+	// crashed module.
+	maxModuleBackoff = time.Minute
+	// moduleStableTime is the time after which a running module is
+	// considered stable. The backoff gets reset if a stable module
+	// crashes.
+	moduleStableTime = time.Minute
+	// defaultModuleInitTimeout is the time in seconds to wait for
+	// modules to finish their initialization if no timeout has been
+	// configured.
+	defaultModuleInitTimeout = 30
+)
+
+// moduleStatus describes the state of a module process.
+type moduleStatus struct {
+	Name string
+	// Pid is the process id of the running module or 0 if the module
+	// is not running.
+	Pid int
+	// Ready is true if the running module finished its initialization.
+	Ready bool
+	// Started is the time the module has been started last.
+	Started time.Time
+	// Restarts is the number of times the module has been restarted.
+	Restarts int
+	// LastError describes why the module exited the last time.
+	LastError string
+}
+
+// moduleBackoff returns the time to wait before restarting a module
+// which crashed the given number of times in a row.
+func moduleBackoff(crashes int) time.Duration {
+	backoff := minModuleBackoff
+	for i := 1; i < crashes && backoff < maxModuleBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxModuleBackoff {
+		backoff = maxModuleBackoff
+	}
+	return backoff
+}
+
+// moduleSupervisor starts the modules and restarts them if they
+// crash.
+type moduleSupervisor struct {
+	Logger *log.Logger
+	// Command returns the command to start the named module.
+	Command func(name string) *exec.Cmd
+	// Exited gets called with the process id of an exited module.
+	Exited  func(pid int)
+	mutex   sync.Mutex
+	modules map[string]*moduleStatus
+	// processes maps the names of running modules to their processes.
+	processes map[string]*os.Process
+	// running counts the running modules.
+	running sync.WaitGroup
+	// stopping is true if the modules are being stopped and must not
+	// be restarted.
+	stopping bool
+	// changed notifies waitReady about modules finishing their
+	// initialization.
+	changed chan struct{}
+}
+
+// newModuleSupervisor returns a supervisor for the given modules.
+func newModuleSupervisor(names []string, logger *log.Logger,
+	command func(name string) *exec.Cmd) *moduleSupervisor {
+	s := &moduleSupervisor{
+		Logger:    logger,
+		Command:   command,
+		modules:   make(map[string]*moduleStatus),
+		processes: make(map[string]*os.Process),
+		changed:   make(chan struct{}, 1),
+	}
+	for _, name := range names {
+		s.modules[name] = &moduleStatus{Name: name}
+	}
+	return s
+}
+
+// start starts all modules.
+func (s *moduleSupervisor) start() {
+	for name := range s.modules {
+		go s.supervise(name)
+	}
+}
+
+// supervise runs the named module and restarts it if it exits until
+// the supervisor gets stopped.
+func (s *moduleSupervisor) supervise(name string) {
+	crashes := 0
+	for {
+		s.mutex.Lock()
+		if s.stopping {
+			s.mutex.Unlock()
+			return
+		}
+		s.Logger.Println("Starting module", name)
+		cmd := s.Command(name)
+		started := time.Now()
+		err := cmd.Start()
+		if err == nil {
+			status := s.modules[name]
+			status.Pid = cmd.Process.Pid
+			status.Ready = false
+			status.Started = started
+			s.processes[name] = cmd.Process
+			s.running.Add(1)
+		}
+		s.mutex.Unlock()
+		if err == nil {
+			err = cmd.Wait()
+			s.mutex.Lock()
+			delete(s.processes, name)
+			s.modules[name].Pid = 0
+			s.modules[name].Ready = false
+			stopping := s.stopping
+			s.mutex.Unlock()
+			if s.Exited != nil {
+				s.Exited(cmd.Process.Pid)
+			}
+			s.running.Done()
+			if stopping {
+				s.Logger.Printf("Module %q stopped", name)
+				return
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("Module exited")
+		}
+		if time.Since(started) > moduleStableTime {
+			crashes = 0
+		}
+		crashes += 1
+		backoff := moduleBackoff(crashes)
+		s.Logger.Printf("Module %q failed: %v. Restarting in %v.", name, err,
+			backoff)
+		s.mutex.Lock()
+		status := s.modules[name]
+		status.LastError = err.Error()
+		s.mutex.Unlock()
+		time.Sleep(backoff)
+		s.mutex.Lock()
+		status.Restarts += 1
+		s.mutex.Unlock()
+	}
+}
+
+// stop stops all modules and waits for them to exit. Modules still
+// running after the timeout get killed.
+func (s *moduleSupervisor) stop(timeout time.Duration) {
+	s.mutex.Lock()
+	s.stopping = true
+	for name, process := range s.processes {
+		if err := process.Signal(syscall.SIGTERM); err != nil {
+			s.Logger.Printf("Could not stop module %q: %v", name, err)
+		}
+	}
+	s.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	s.mutex.Lock()
+	for name, process := range s.processes {
+		s.Logger.Printf("Killing module %q", name)
+		process.Kill()
+	}
+	s.mutex.Unlock()
+	<-done
+}
+
+// initDone marks the named module as ready.
+func (s *moduleSupervisor) initDone(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status, ok := s.modules[name]
+	if !ok {
+		return fmt.Errorf("Unknown module %q", name)
+	}
+	status.Ready = true
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ready returns true if all modules are ready.
+func (s *moduleSupervisor) ready() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, status := range s.modules {
+		if !status.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// waitReady waits until all modules are ready or the timeout is
+// reached. It returns false on timeout.
+func (s *moduleSupervisor) waitReady(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !s.ready() {
+		select {
+		case <-s.changed:
+		case <-timer.C:
+			return false
+		}
+	}
+	return true
+}
+
+// status returns the status of all modules sorted by name.
+func (s *moduleSupervisor) status() []moduleStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := make([]string, 0, len(s.modules))
+	for name := range s.modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]moduleStatus, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, *s.modules[name])
+	}
+	return ret
+}
+
+// Modules shows the status of the modules.
+func (h *nodeHandler) Modules(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if c.Req.Method != "GET" {
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	var modules []moduleStatus
+	if h.Supervisor != nil {
+		modules = h.Supervisor.status()
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Modules")}
+	body, err := h.Renderer.Render("actions/modules",
+		mtemplate.Context{"Modules": modules},
+		c.UserSession.Locale,
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
+	if err != nil {
+		return fmt.Errorf("Can't render modules: %v", err)
+	}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,168 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestModuleBackoff(t *testing.T) {
+	tests := []struct {
+		Crashes int
+		Backoff time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, test := range tests {
+		if ret := moduleBackoff(test.Crashes); ret != test.Backoff {
+			t.Errorf("moduleBackoff(%v) = %v, should be %v", test.Crashes, ret,
+				test.Backoff)
+		}
+	}
+}
+
+func TestModuleSupervisor(t *testing.T) {
+	exited := make(chan int, 10)
+	s := newModuleSupervisor([]string{"a", "b"},
+		log.New(ioutil.Discard, "", 0), func(name string) *exec.Cmd {
+			return exec.Command("sh", "-c", "exit 1")
+		})
+	s.Exited = func(pid int) { exited <- pid }
+	if s.waitReady(10 * time.Millisecond) {
+		t.Errorf("waitReady should time out")
+	}
+	s.start()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Modules should have exited")
+		}
+	}
+	// Modules get restarted after one second.
+	time.Sleep(1500 * time.Millisecond)
+	for _, status := range s.status() {
+		if status.Restarts < 1 || status.LastError == "" {
+			t.Errorf("Module %q should have been restarted: %v", status.Name,
+				status)
+		}
+	}
+	if err := s.initDone("unknown"); err == nil {
+		t.Errorf("initDone should fail for unknown modules")
+	}
+	go func() {
+		s.initDone("a")
+		s.initDone("b")
+	}()
+	if !s.waitReady(time.Second) {
+		t.Errorf("waitReady should not time out")
+	}
+}
+
+func TestDisconnectProcess(t *testing.T) {
+	m := &MonstiService{}
+	for _, id := range []string{"12#1", "12#2", "123#1"} {
+		if err := m.ConnectSignal(&ConnectSignalArgs{id, "foo"}, nil); err != nil {
+			t.Fatalf("Could not connect signal: %v", err)
+		}
+	}
+	m.setTimedOut("12#1", true)
+	m.disconnectProcess(12)
+	if !reflect.DeepEqual(m.subscriptions["foo"], []string{"123#1"}) {
+		t.Errorf("Subscriptions should be [123#1], got %v", m.subscriptions)
+	}
+	if len(m.subscriber) != 1 || len(m.timeouts) != 0 {
+		t.Errorf("Subscribers of process 12 should be removed: %v, %v",
+			m.subscriber, m.timeouts)
+	}
+}
+
+func TestModuleSupervisorStop(t *testing.T) {
+	s := newModuleSupervisor([]string{"a"}, log.New(ioutil.Discard, "", 0),
+		func(name string) *exec.Cmd {
+			return exec.Command("sleep", "10")
+		})
+	s.start()
+	for i := 0; s.status()[0].Pid == 0; i++ {
+		if i > 100 {
+			t.Fatalf("Module should have been started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	s.stop(5 * time.Second)
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("Module should have been stopped by SIGTERM")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if status := s.status()[0]; status.Pid != 0 || status.Restarts != 0 {
+		t.Errorf("Module should be stopped and not restarted: %v", status)
+	}
+}
+
+func TestModuleRestartRegistration(t *testing.T) {
+	monsti := &MonstiService{Settings: &settings{}}
+	started := make(chan int, 10)
+	runs := 0
+	s := newModuleSupervisor([]string{"foo"}, log.New(ioutil.Discard, "", 0),
+		func(name string) *exec.Cmd {
+			runs++
+			started <- runs
+			if runs == 1 {
+				return exec.Command("sh", "-c", "exit 1")
+			}
+			return exec.Command("sleep", "10")
+		})
+	s.Exited = monsti.disconnectProcess
+	s.start()
+	defer s.stop(time.Second)
+	for run := 1; run <= 2; run++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Module should have been started (run %v)", run)
+		}
+		// The module registers its node type on every start.
+		nodeType := &service.NodeType{Id: "foo.Bar",
+			Fields: []*service.NodeField{{Id: "foo.Baz", Type: "Text"}}}
+		if err := monsti.RegisterNodeType(nodeType, new(int)); err != nil {
+			t.Fatalf("Run %v: RegisterNodeType returned error: %v", run, err)
+		}
+	}
+	if err := s.initDone("foo"); err != nil || !s.waitReady(time.Second) {
+		t.Errorf("Restarted module should be ready: %v", err)
+	}
+	if status := s.status()[0]; status.Restarts != 1 || status.Pid == 0 {
+		t.Errorf("Module should be running after one restart: %v", status)
+	}
+	changed := &service.NodeType{Id: "foo.Bar"}
+	if err := monsti.RegisterNodeType(changed, new(int)); err == nil {
+		t.Errorf("RegisterNodeType should fail for a different node type " +
+			"with the same id")
+	}
+}
@@ -77,12 +77,13 @@ type getChildrenFunc func(path string) ([]*service.Node, error)
 
 // getNav returns the navigation for the given node.
 //
-// If public is true, show only public pages.
+// If public is true, show only public and published pages.
 // nodePath is the absolute path of the node for which to get the navigation.
 // active is the absolute path to the currently active node.
 func getNav(nodePath, active string, public bool,
 	getNodeFn getNodeFunc, getChildrenFn getChildrenFunc) (
 	navLinks navigation, err error) {
+	now := time.Now()
 
 	// Search children
 	children, err := getChildrenFn(nodePath)
@@ -91,7 +92,7 @@ func getNav(nodePath, active string, public bool,
 	}
 	childrenNavLinks := navLinks[:]
 	for _, child := range children {
-		if child.Hide || child.Type.Hide || public && !child.Public {
+		if child.Hide || child.Type.Hide || public && !child.IsPublished(now) {
 			continue
 		}
 		childrenNavLinks = append(childrenNavLinks, navLink{
@@ -123,7 +124,7 @@ func getNav(nodePath, active string, public bool,
 			return nil, fmt.Errorf("Could not get siblings: %v", err)
 		}
 		for _, sibling := range siblings {
-			if sibling.Hide || sibling.Type.Hide || public && !sibling.Public {
+			if sibling.Hide || sibling.Type.Hide || public && !sibling.IsPublished(now) {
 				continue
 			}
 			siblingsNavLinks = append(siblingsNavLinks, navLink{
@@ -170,8 +171,9 @@ func (nav *navigation) MakeAbsolute(root string) {
 }
 
 type addFormData struct {
-	NodeType string
-	New      string
+	NodeType  string
+	New       string
+	CSRFToken string
 }
 
 // Add handles add requests.
@@ -197,10 +199,11 @@ func (h *nodeHandler) Add(c *reqContext) error {
 	form.AddWidget(&htmlwidgets.SelectWidget{Options: nodeTypeOptions},
 		"NodeType", G("Content type"), "")
 	form.AddWidget(new(htmlwidgets.HiddenWidget), "New", "", "")
+	c.UserSession.AddCSRFWidget(form, &data.CSRFToken)
 	form.Action = path.Join(c.Node.Path, "@@edit")
 	body, err := h.Renderer.Render("actions/addform", mtemplate.Context{
 		"Form": form.RenderData()}, c.UserSession.Locale,
-		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
 	if err != nil {
 		return fmt.Errorf("Can't render node add formular: %v", err)
 	}
@@ -212,7 +215,8 @@ func (h *nodeHandler) Add(c *reqContext) error {
 }
 
 type removeFormData struct {
-	Confirm string
+	Confirm   string
+	CSRFToken string
 }
 
 // Remove handles remove requests.
@@ -221,6 +225,7 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 	data := removeFormData{}
 	form := htmlwidgets.NewForm(&data)
 	form.AddWidget(new(htmlwidgets.HiddenWidget), "Confirm", G("Confirm"), "")
+	c.UserSession.AddCSRFWidget(form, &data.CSRFToken)
 	switch c.Req.Method {
 	case "GET":
 		data.Confirm = "ok"
@@ -240,7 +245,8 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 	}
 	body, err := h.Renderer.Render("actions/removeform", mtemplate.Context{
 		"Form": form.RenderData(), "Node": c.Node},
-		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+		c.UserSession.Locale,
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
 	if err != nil {
 		panic("Can't render node remove formular: " + err.Error())
 	}
@@ -336,11 +342,19 @@ func (h *nodeHandler) View(c *reqContext) error {
 				serveError("Could not parse request URL: %v", err)
 			}
 			url := c.Req.URL.ResolveReference(newPath)
+			url.RawQuery = c.Req.URL.RawQuery
 			http.Redirect(c.Res, c.Req, url.String(), http.StatusSeeOther)
 		}
 		return nil
 	}
 
+	if c.Node.Type.Id == "core.Blog" {
+		format := c.Req.FormValue("format")
+		if _, ok := feedContentTypes[format]; ok {
+			return h.serveBlogFeed(c, format)
+		}
+	}
+
 	rendered, err := h.RenderNode(c, nil)
 	if err != nil {
 		return fmt.Errorf("Could not render node: %v", err)
@@ -351,7 +365,22 @@ func (h *nodeHandler) View(c *reqContext) error {
 	content = []byte(renderInMaster(h.Renderer, rendered, env, h.Settings,
 		*c.Site, c.UserSession.Locale, c.Serv))
 
-	c.Res.Write(content)
+	// Pages containing forms protected by the visitor's CSRF token must
+	// not be shared.
+	public := c.UserSession.User == nil &&
+		!bytes.Contains(content, []byte(c.UserSession.CSRFToken))
+	etag := pageETag(content)
+	if public && len(c.cacheKey) > 0 {
+		h.Settings.mutex.RLock()
+		size := h.Settings.PageCache.Size
+		h.Settings.mutex.RUnlock()
+		if size <= 0 {
+			size = defaultPageCacheSize
+		}
+		h.PageCache.put(&cachedPage{c.cacheKey, c.Site.Name, content, etag},
+			c.cacheGeneration, size)
+	}
+	writePage(c.Res, c.Req, content, etag, public, isMultilingual(*c.Site))
 	return nil
 }
 
@@ -391,13 +420,20 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 		if err := renderContactForm(c, context, c.Req.Form, h); err != nil {
 			return nil, fmt.Errorf("Could not render contact form: %v", err)
 		}
+	case "core.SearchPage":
+		if err := renderSearchPage(c, context, c.Req.Form); err != nil {
+			return nil, fmt.Errorf("Could not render search page: %v", err)
+		}
 	}
 	context["Embedded"] = embedNode != nil
 
 	var ret []map[string]string
 	err := c.Serv.Monsti().EmitSignal("monsti.NodeContext",
 		service.NodeContextArgs{c.Id, reqNode.Type.Id, embedNode}, &ret)
-	if err != nil {
+	if _, ok := err.(*service.SignalError); ok {
+		// Render the node without the context of failed modules.
+		h.Log.Printf("Could not get node context: %v", err)
+	} else if err != nil {
 		return nil, fmt.Errorf("Could not emit signal: %v", err)
 	}
 	for i, _ := range ret {
@@ -406,14 +442,27 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 		}
 	}
 
+	embed := func(uri string) (template.HTML, error) {
+		rendered, err := h.RenderNode(c, &service.EmbedNode{URI: uri})
+		if err != nil {
+			return "", fmt.Errorf("Could not render embed node: %v", err)
+		}
+		return template.HTML(rendered), nil
+	}
+
 	template := strings.Replace(reqNode.Type.Id, ".", "/", 1) + "-view"
 	if overwrite, ok := reqNode.TemplateOverwrites[template]; ok {
 		template = overwrite.Template
 	}
 
 	context["Site"] = c.Site
-	rendered, err := h.Renderer.Render(template, context,
-		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	rendered, err := h.Renderer.RenderEnv(template, context, &mtemplate.Env{
+		Locale:      c.UserSession.Locale,
+		Session:     c.Serv,
+		Site:        *c.Site,
+		UserSession: c.UserSession,
+		Embed:       embed},
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
 	if err != nil {
 		return nil, fmt.Errorf("Could not render template: %v", err)
 	}
@@ -423,8 +472,15 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 type editFormData struct {
 	NodeType string
 	Name     string
-	Node     service.Node
-	Fields   util.NestedMap
+	// Changed keeps the node's change time at the time the form has
+	// been rendered to detect concurrent edits.
+	Changed string
+	// Unpublish is true if the node should be unpublished at
+	// Node.UnpublishTime.
+	Unpublish bool
+	Node      service.Node
+	Fields    util.NestedMap
+	CSRFToken string
 }
 
 // EditNode handles node edits.
@@ -475,9 +531,36 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		formData.Node.Public = true
 	} else {
 		formData.Node = *c.Node
+		formData.Changed = c.Node.Changed.Format(time.RFC3339Nano)
+		formData.Unpublish = !c.Node.UnpublishTime.IsZero()
+	}
+	if !formData.Unpublish {
+		formData.Node.UnpublishTime = time.Now().UTC()
+	}
+	// Translatable fields of multilingual sites are edited in the
+	// locale given by the translation parameter.
+	var editLocale string
+	var editLocales []string
+	var translations []translationLink
+	if isMultilingual(*c.Site) {
+		editLocale = c.UserSession.Locale
+		if translation := c.Req.FormValue("translation"); hasLocale(*c.Site,
+			translation) {
+			editLocale = translation
+		}
+		editLocales = []string{editLocale, c.Site.Locale}
+		formData.Node.SetLocale(editLocales...)
+		if !newNode {
+			for _, locale := range c.Site.Locales {
+				translations = append(translations, translationLink{locale,
+					path.Join(c.Node.Path, "@@edit") + "?translation=" + locale})
+			}
+		}
 	}
 	form := htmlwidgets.NewForm(&formData)
 	form.AddWidget(new(htmlwidgets.HiddenWidget), "NodeType", "", "")
+	form.AddWidget(new(htmlwidgets.HiddenWidget), "Changed", "", "")
+	c.UserSession.AddCSRFWidget(form, &formData.CSRFToken)
 	if !nodeType.Hide {
 		form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Hide", G("Hide"), G("Don't show node in navigation."))
 	}
@@ -495,6 +578,11 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 	form.AddWidget(&htmlwidgets.TimeWidget{
 		Location: location}, "Node.PublishTime", G("Publish time"),
 		G("The node won't be accessible to the public until it is published."))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Unpublish", G("Unpublish"),
+		G("Should the node be unpublished at the unpublish time?"))
+	form.AddWidget(&htmlwidgets.TimeWidget{
+		Location: location}, "Node.UnpublishTime", G("Unpublish time"),
+		G("The node won't be accessible to the public after this time."))
 	if newNode || c.Node.Name() != "" {
 		form.AddWidget(&htmlwidgets.TextWidget{
 			Regexp:          `^[-\w]+$`,
@@ -524,6 +612,9 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		if len(c.Req.FormValue("New")) == 0 && form.Fill(c.Req.Form) {
 			node := formData.Node
 			node.Type = nodeType
+			if !formData.Unpublish {
+				node.UnpublishTime = time.Time{}
+			}
 			pathPrefix := node.GetPathPrefix()
 			oldPath := c.Node.Path
 			parentPath := c.Node.GetParentPath()
@@ -533,6 +624,17 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 			node.Path = path.Join(parentPath, pathPrefix, formData.Name)
 			renamed := !newNode && c.Node.Name() != "" && oldPath != node.Path
 			writeNode := true
+			if !newNode {
+				changed, err := time.Parse(time.RFC3339Nano, formData.Changed)
+				if err == nil {
+					node.Changed = changed
+				}
+				if !node.Changed.Equal(c.Node.Changed) {
+					form.AddError("", G("Someone else edited this node in the meantime. Saving again will overwrite the other changes."))
+					formData.Changed = c.Node.Changed.Format(time.RFC3339Nano)
+					writeNode = false
+				}
+			}
 			if newNode || renamed {
 				existing, err := c.Serv.Monsti().GetNode(c.Site.Name, node.Path)
 				if err != nil {
@@ -547,45 +649,63 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 				}
 			}
 			if writeNode {
-				if renamed {
-					err := c.Serv.Monsti().RenameNode(c.Site.Name, c.Node.Path, node.Path)
-					if err != nil {
-						return fmt.Errorf("Could not move node: ", err)
-					}
+				if editLocales != nil {
+					node.SetLocale(editLocales...)
 				}
 				for _, field := range nodeFields {
 					node.GetField(field.Id).FromFormField(formData.Fields, field)
 				}
-				err := c.Serv.Monsti().WriteNode(c.Site.Name, node.Path, &node)
-				if err != nil {
-					return fmt.Errorf("Could not update node: ", err)
+				writePath := node.Path
+				if renamed {
+					writePath = oldPath
 				}
-
-				if len(fileFields) > 0 && c.Req.MultipartForm != nil {
-					for _, name := range fileFields {
-						file, _, err := c.Req.FormFile("Fields." + name)
-						if err == nil {
-							content, err := ioutil.ReadAll(file)
-							if err != nil {
-								return fmt.Errorf("Could not read multipart file: %v", err)
-							}
-							if err = c.Serv.Monsti().WriteNodeData(c.Site.Name, node.Path,
-								"__file_"+name, content); err != nil {
-								return fmt.Errorf("Could not save file: %v", err)
+				err := saveNode(c.Serv.Monsti(), c.Site.Name, writePath, &node)
+				if err == service.ErrNodeChanged {
+					// The node has been changed after the check above.
+					form.AddError("", G("Someone else edited this node in the meantime. Saving again will overwrite the other changes."))
+					current, err := c.Serv.Monsti().GetNode(c.Site.Name, writePath)
+					if err != nil {
+						return fmt.Errorf("Could not get node: %v", err)
+					}
+					if current != nil {
+						formData.Changed = current.Changed.Format(time.RFC3339Nano)
+					}
+				} else if veto, ok := err.(*service.WriteVetoedError); ok {
+					form.AddError("", veto.Reason)
+				} else if err != nil {
+					return fmt.Errorf("Could not update node: ", err)
+				} else {
+					if len(fileFields) > 0 && c.Req.MultipartForm != nil {
+						for _, name := range fileFields {
+							file, _, err := c.Req.FormFile("Fields." + name)
+							if err == nil {
+								content, err := ioutil.ReadAll(file)
+								if err != nil {
+									return fmt.Errorf("Could not read multipart file: %v", err)
+								}
+								if err = c.Serv.Monsti().WriteNodeData(c.Site.Name, node.Path,
+									"__file_"+name, content); err != nil {
+									return fmt.Errorf("Could not save file: %v", err)
+								}
 							}
 						}
 					}
+					http.Redirect(c.Res, c.Req, node.Path+"/", http.StatusSeeOther)
+					return nil
 				}
-				http.Redirect(c.Res, c.Req, node.Path+"/", http.StatusSeeOther)
-				return nil
 			}
 		}
 	default:
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
 	rendered, err := h.Renderer.Render("edit",
-		mtemplate.Context{"Form": form.RenderData()},
-		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+		mtemplate.Context{
+			"Form":         form.RenderData(),
+			"Translations": translations,
+			"Translation":  editLocale,
+		},
+		c.UserSession.Locale,
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
 
 	if err != nil {
 		return fmt.Errorf("Could not render template: %v", err)
@@ -602,6 +722,28 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 	return nil
 }
 
+// nodeSaver writes and moves nodes, e.g. a *service.MonstiClient.
+type nodeSaver interface {
+	WriteNode(site, path string, node *service.Node) error
+	RenameNode(site, source, target string) error
+}
+
+// saveNode writes the given node at the given path and then moves it
+// to the node's path if it differs. The node is not moved if the
+// write fails, e.g. with service.ErrNodeChanged or a
+// *service.WriteVetoedError.
+func saveNode(m nodeSaver, site, nodePath string, node *service.Node) error {
+	if err := m.WriteNode(site, nodePath, node); err != nil {
+		return err
+	}
+	if nodePath != node.Path {
+		if err := m.RenameNode(site, nodePath, node.Path); err != nil {
+			return fmt.Errorf("Could not move node: %v", err)
+		}
+	}
+	return nil
+}
+
 /*
 	err = c.Session.Save(c.Req, c.Res)
 	if err != nil {
@@ -133,3 +133,49 @@ func TestNavigationMakeAbsolute(t *testing.T) {
 			nav, expected)
 	}
 }
+
+// testNodeSaver records the written and moved nodes.
+type testNodeSaver struct {
+	WriteErr error
+	Written  []string
+	Renamed  [][2]string
+}
+
+func (s *testNodeSaver) WriteNode(site, path string, node *service.Node) error {
+	if s.WriteErr != nil {
+		return s.WriteErr
+	}
+	s.Written = append(s.Written, path)
+	return nil
+}
+
+func (s *testNodeSaver) RenameNode(site, source, target string) error {
+	s.Renamed = append(s.Renamed, [2]string{source, target})
+	return nil
+}
+
+func TestSaveNode(t *testing.T) {
+	tests := []struct {
+		WriteErr error
+		Written  []string
+		Renamed  [][2]string
+	}{
+		{nil, []string{"/old"}, [][2]string{{"/old", "/new"}}},
+		{service.ErrNodeChanged, nil, nil},
+		{&service.WriteVetoedError{Reason: "no"}, nil, nil},
+	}
+	for i, test := range tests {
+		saver := &testNodeSaver{WriteErr: test.WriteErr}
+		err := saveNode(saver, "site", "/old", &service.Node{Path: "/new"})
+		if err != test.WriteErr {
+			t.Errorf("Test %v: saveNode returned %v, should be %v", i, err,
+				test.WriteErr)
+		}
+		if !reflect.DeepEqual(saver.Written, test.Written) ||
+			!reflect.DeepEqual(saver.Renamed, test.Renamed) {
+			t.Errorf("Test %v: saveNode wrote %v and moved %v, should write %v "+
+				"and move %v", i, saver.Written, saver.Renamed, test.Written,
+				test.Renamed)
+		}
+	}
+}
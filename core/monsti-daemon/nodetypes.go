@@ -21,6 +21,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"path"
 	"github.com/chrneumann/htmlwidgets"
@@ -50,16 +51,18 @@ func initNodeTypes(settings *settings, session *service.Session, logger *log.Log
 		Name:      util.GenLanguageMap(G("Document"), availableLocales),
 		Fields: []*service.NodeField{
 			{
-				Id:       "core.Title",
-				Required: true,
-				Name:     util.GenLanguageMap(G("Title"), availableLocales),
-				Type:     "Text",
+				Id:           "core.Title",
+				Required:     true,
+				Name:         util.GenLanguageMap(G("Title"), availableLocales),
+				Type:         "Text",
+				Translatable: true,
 			},
 			{
-				Id:       "core.Body",
-				Required: true,
-				Name:     util.GenLanguageMap(G("Body"), availableLocales),
-				Type:     "HTMLArea",
+				Id:           "core.Body",
+				Required:     true,
+				Name:         util.GenLanguageMap(G("Body"), availableLocales),
+				Type:         "HTMLArea",
+				Translatable: true,
 			},
 		},
 	}
@@ -111,11 +114,25 @@ func initNodeTypes(settings *settings, session *service.Session, logger *log.Log
 	if err := session.Monsti().RegisterNodeType(&contactFormType); err != nil {
 		return fmt.Errorf("Could not register contactform node type: %v", err)
 	}
+
+	searchPageType := service.NodeType{
+		Id:        "core.SearchPage",
+		AddableTo: []string{"."},
+		Name:      util.GenLanguageMap(G("Search page"), availableLocales),
+		Fields: []*service.NodeField{
+			{Id: "core.Title"},
+			{Id: "core.Body"},
+		},
+	}
+	if err := session.Monsti().RegisterNodeType(&searchPageType); err != nil {
+		return fmt.Errorf("Could not register search page node type: %v", err)
+	}
 	return nil
 }
 
 type contactFormData struct {
 	Name, Email, Subject, Message string
+	CSRFToken                     string
 }
 
 func renderContactForm(c *reqContext, context template.Context,
@@ -131,6 +148,7 @@ func renderContactForm(c *reqContext, context template.Context,
 		ValidationError: G("Required.")}, "Subject", G("Subject"), "")
 	form.AddWidget(&htmlwidgets.TextAreaWidget{MinLength: 1,
 		ValidationError: G("Required.")}, "Message", G("Message"), "")
+	c.UserSession.AddCSRFWidget(form, &data.CSRFToken)
 
 	switch c.Req.Method {
 	case "GET":
@@ -143,7 +161,7 @@ func renderContactForm(c *reqContext, context template.Context,
 				From:    mimemail.Address{data.Name, data.Email},
 				Subject: data.Subject,
 				Body:    []byte(data.Message)}
-			site := h.Settings.Monsti.Sites[c.Site.Name]
+			site := *c.Site
 			owner := mimemail.Address{site.Owner.Name, site.Owner.Email}
 			mail.To = []mimemail.Address{owner}
 			err := c.Serv.Monsti().SendMail(&mail)
@@ -159,3 +177,25 @@ func renderContactForm(c *reqContext, context template.Context,
 	context["Form"] = form.RenderData()
 	return nil
 }
+
+// searchResultsLimit is the maximum number of results shown on search
+// pages.
+const searchResultsLimit = 50
+
+// renderSearchPage adds the results of the search query given by the
+// "q" parameter to the context of a search page.
+func renderSearchPage(c *reqContext, context template.Context,
+	formValues url.Values) error {
+	query := strings.TrimSpace(formValues.Get("q"))
+	context["Query"] = query
+	if len(query) == 0 {
+		return nil
+	}
+	results, err := c.Serv.Monsti().Search(c.Site.Name, query,
+		searchResultsLimit, c.UserSession)
+	if err != nil {
+		return fmt.Errorf("Could not search: %v", err)
+	}
+	context["Results"] = results
+	return nil
+}
@@ -0,0 +1,174 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultPageCacheSize is the default maximum number of cached pages.
+const defaultPageCacheSize = 1000
+
+// cachedPage is a page rendered for anonymous visitors.
+type cachedPage struct {
+	key, site string
+	Content   []byte
+	ETag      string
+}
+
+// pageCache keeps the pages rendered for anonymous visitors.
+//
+// All pages of a site are dropped when one of its nodes changes, as
+// the change may show up in the navigation, listings or search
+// results of any page. If the cache is full, the least recently used
+// page gets dropped.
+//
+// The zero value is an empty cache.
+type pageCache struct {
+	mutex sync.Mutex
+	pages map[string]*list.Element
+	// lru holds the cached pages, most recently used first.
+	lru list.List
+	// generations counts the invalidations per site, cleared the
+	// invalidations of all sites.
+	generations map[string]uint64
+	cleared     uint64
+}
+
+// pageCacheKey returns the key of the page at the given URL path and
+// query in the given locale.
+func pageCacheKey(site, locale, urlPath, query string) string {
+	return strings.Join([]string{site, locale, urlPath, query}, "\x00")
+}
+
+// generation returns the number of invalidations of the site's pages.
+// Pass it to put to make sure that no page rendered before an
+// invalidation gets cached.
+func (p *pageCache) generation(site string) uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.cleared + p.generations[site]
+}
+
+// get returns the page with the given key or nil if it's not cached.
+func (p *pageCache) get(key string) *cachedPage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	element, ok := p.pages[key]
+	if !ok {
+		return nil
+	}
+	p.lru.MoveToFront(element)
+	return element.Value.(*cachedPage)
+}
+
+// put adds the page unless the site's pages have been invalidated
+// since the given generation. size is the maximum number of cached
+// pages.
+func (p *pageCache) put(page *cachedPage, generation uint64, size int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.cleared+p.generations[page.site] != generation {
+		return
+	}
+	if p.pages == nil {
+		p.pages = make(map[string]*list.Element)
+	}
+	if element, ok := p.pages[page.key]; ok {
+		p.lru.Remove(element)
+	}
+	p.pages[page.key] = p.lru.PushFront(page)
+	for p.lru.Len() > size {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.pages, oldest.Value.(*cachedPage).key)
+	}
+}
+
+// invalidate drops the pages of the given site.
+func (p *pageCache) invalidate(site string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.generations == nil {
+		p.generations = make(map[string]uint64)
+	}
+	p.generations[site]++
+	for element := p.lru.Front(); element != nil; {
+		next := element.Next()
+		if page := element.Value.(*cachedPage); page.site == site {
+			p.lru.Remove(element)
+			delete(p.pages, page.key)
+		}
+		element = next
+	}
+}
+
+// clear drops all pages.
+func (p *pageCache) clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.cleared++
+	p.pages = nil
+	p.lru.Init()
+}
+
+// pageETag returns the entity tag of the page's content.
+func pageETag(content []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(content))
+}
+
+// etagMatches returns true if the If-None-Match header matches the
+// entity tag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// writePage writes the rendered page. Clients may keep the page but
+// have to revalidate it using the page's entity tag. Shared caches
+// may only keep public pages.
+//
+// If the page's content varies with the negotiated locale, vary has
+// to be true.
+func writePage(w http.ResponseWriter, r *http.Request, content []byte,
+	etag string, public, vary bool) {
+	header := w.Header()
+	header.Set("ETag", etag)
+	if public {
+		header.Set("Cache-Control", "public, no-cache")
+	} else {
+		header.Set("Cache-Control", "private, no-cache")
+	}
+	if vary {
+		header.Add("Vary", "Accept-Language, Cookie")
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(content)
+}
@@ -0,0 +1,117 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPageCache(t *testing.T) {
+	var cache pageCache
+	put := func(site, path string) {
+		key := pageCacheKey(site, "en", path, "")
+		cache.put(&cachedPage{key, site, []byte(path), pageETag([]byte(path))},
+			cache.generation(site), 3)
+	}
+	cached := func(site, path string) bool {
+		return cache.get(pageCacheKey(site, "en", path, "")) != nil
+	}
+	put("foo", "/a")
+	put("foo", "/b")
+	put("bar", "/a")
+	if !cached("foo", "/a") || !cached("foo", "/b") || !cached("bar", "/a") {
+		t.Fatalf("Pages should be cached")
+	}
+	if cached("foo", "/c") {
+		t.Errorf("Unknown page should not be cached")
+	}
+	// bar:/a is the least recently used page after these lookups.
+	cache.get(pageCacheKey("foo", "en", "/b", ""))
+	cache.get(pageCacheKey("foo", "en", "/a", ""))
+	put("bar", "/b")
+	if cached("bar", "/a") || !cached("foo", "/a") || !cached("bar", "/b") {
+		t.Errorf("Least recently used page should have been dropped")
+	}
+
+	cache.invalidate("foo")
+	if cached("foo", "/a") || cached("foo", "/b") || !cached("bar", "/b") {
+		t.Errorf("invalidate should drop the pages of the site only")
+	}
+
+	generation := cache.generation("foo")
+	cache.invalidate("foo")
+	cache.put(&cachedPage{pageCacheKey("foo", "en", "/a", ""), "foo", nil, ""},
+		generation, 3)
+	if cached("foo", "/a") {
+		t.Errorf("Pages rendered before an invalidation should not be cached")
+	}
+
+	generation = cache.generation("baz")
+	cache.clear()
+	cache.put(&cachedPage{pageCacheKey("baz", "en", "/a", ""), "baz", nil, ""},
+		generation, 3)
+	if cached("bar", "/b") || cached("baz", "/a") {
+		t.Errorf("clear should drop all pages")
+	}
+}
+
+func TestWritePage(t *testing.T) {
+	content := []byte("<html></html>")
+	etag := pageETag(content)
+	tests := []struct {
+		IfNoneMatch  string
+		Public, Vary bool
+		Status       int
+		CacheControl string
+		VaryHeader   string
+	}{
+		{"", true, false, http.StatusOK, "public, no-cache", ""},
+		{`"foo", ` + etag, false, true, http.StatusNotModified,
+			"private, no-cache", "Accept-Language, Cookie"},
+		{"W/" + etag, true, false, http.StatusNotModified, "public, no-cache", ""},
+		{`"foo"`, true, false, http.StatusOK, "public, no-cache", ""},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if len(test.IfNoneMatch) > 0 {
+			req.Header.Set("If-None-Match", test.IfNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		writePage(w, req, content, etag, test.Public, test.Vary)
+		if w.Code != test.Status {
+			t.Errorf("Test %v: Status = %v, should be %v", i, w.Code, test.Status)
+		}
+		if w.Header().Get("ETag") != etag {
+			t.Errorf("Test %v: ETag = %q, should be %q", i, w.Header().Get("ETag"),
+				etag)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != test.CacheControl {
+			t.Errorf("Test %v: Cache-Control = %q, should be %q", i, cc,
+				test.CacheControl)
+		}
+		if vary := w.Header().Get("Vary"); vary != test.VaryHeader {
+			t.Errorf("Test %v: Vary = %q, should be %q", i, vary, test.VaryHeader)
+		}
+		body := w.Body.String()
+		if test.Status == http.StatusOK && body != string(content) ||
+			test.Status == http.StatusNotModified && len(body) > 0 {
+			t.Errorf("Test %v: Unexpected body %q", i, body)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// nodeActions are the actions which may be restricted by node ACLs.
+var nodeActions = []service.Action{
+	service.ViewAction, service.EditAction, service.AddAction,
+	service.RemoveAction, service.HistoryAction}
+
+// rolePermissions maps roles to the node actions they may perform if
+// not overridden by an ACL.
+var rolePermissions = map[string][]service.Action{
+	service.RoleAnonymous: {service.ViewAction},
+	service.RoleReader:    {service.ViewAction},
+	service.RoleAuthor: {service.ViewAction, service.EditAction,
+		service.AddAction, service.HistoryAction},
+	service.RoleEditor: {service.ViewAction, service.EditAction,
+		service.AddAction, service.RemoveAction, service.HistoryAction},
+}
+
+// getRoles returns the roles of the session's user.
+func getRoles(session *service.UserSession) []string {
+	if session.User == nil {
+		return []string{service.RoleAnonymous}
+	}
+	return session.User.Roles
+}
+
+// checkPermission checks if the session's user might perform the
+// given action on a node with the given ACL.
+//
+// acl is the ACL of the node or of its nearest ancestor having one,
+// or nil.
+func checkPermission(action service.Action, session *service.UserSession,
+	acl map[string][]string) bool {
+	switch action {
+	case service.LoginAction, service.RequestPasswordTokenAction,
+		service.ChangePasswordAction:
+		return true
+	case service.LogoutAction:
+		return session.User != nil
+	case service.UsersAction, service.ModulesAction:
+		return inStringSlice(service.RoleAdmin, getRoles(session))
+	}
+	for _, role := range getRoles(session) {
+		if role == service.RoleAdmin {
+			return true
+		}
+		if actions, ok := acl[role]; ok {
+			if inStringSlice(action.String(), actions) {
+				return true
+			}
+			continue
+		}
+		for _, allowed := range rolePermissions[role] {
+			if allowed == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameACL returns true if both ACLs grant the same permissions.
+func sameACL(a, b map[string][]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// visibleNodes returns the given children of a node which the
+// session's user may view at the given time.
+//
+// parentACL is the ACL of the parent node or of its nearest ancestor
+// having one.
+func visibleNodes(session *service.UserSession, parentACL map[string][]string,
+	children []*service.Node, now time.Time) []*service.Node {
+	visible := make([]*service.Node, 0, len(children))
+	for _, child := range children {
+		if session.User == nil && !child.IsListed(now) {
+			continue
+		}
+		acl := child.ACL
+		if len(acl) == 0 {
+			acl = parentACL
+		}
+		if checkPermission(service.ViewAction, session, acl) {
+			visible = append(visible, child)
+		}
+	}
+	return visible
+}
+
+// getPermissions returns a map of action names to the permission of
+// the session's user to perform the action on a node with the given
+// ACL.
+func getPermissions(session *service.UserSession,
+	acl map[string][]string) map[string]bool {
+	permissions := make(map[string]bool)
+	for _, action := range append(nodeActions, service.UsersAction,
+		service.ModulesAction) {
+		permissions[action.String()] = checkPermission(action, session, acl)
+	}
+	return permissions
+}
+
+// getNodeACL returns the ACL of the given node or, if it has none,
+// of its nearest ancestor having one. getACL returns the ACL of the
+// given node or nil if the node has no ACL or does not exist.
+func getNodeACL(nodePath string,
+	getACL func(nodePath string) (map[string][]string, error)) (
+	map[string][]string, error) {
+	nodePath = path.Clean("/" + nodePath)
+	for {
+		acl, err := getACL(nodePath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get ACL of %q: %v", nodePath, err)
+		}
+		if len(acl) > 0 || nodePath == "/" {
+			return acl, nil
+		}
+		nodePath = path.Dir(nodePath)
+	}
+}
+
+// getNodeACLFn returns a function to be used with getNodeACL which
+// fetches the nodes using the given client.
+func getNodeACLFn(m *service.MonstiClient, site string) func(
+	string) (map[string][]string, error) {
+	return func(nodePath string) (map[string][]string, error) {
+		node, err := m.GetNode(site, nodePath)
+		if err != nil || node == nil {
+			return nil, err
+		}
+		return node.ACL, nil
+	}
+}
+
+type CheckPermissionArgs struct {
+	Site, Path string
+	Action     service.Action
+	Session    *service.UserSession
+}
+
+// visibleChildrenFn returns a function to get the children of a node
+// which the session's user may view.
+func visibleChildrenFn(m *service.MonstiClient, site string,
+	session *service.UserSession) getChildrenFunc {
+	return visibleChildren(func(nodePath string) ([]*service.Node, error) {
+		return m.GetChildren(site, nodePath)
+	}, getNodeACLFn(m, site), session)
+}
+
+// visibleChildren wraps getChildrenFn to only return the children
+// which the session's user may view. getACL is used with getNodeACL.
+func visibleChildren(getChildrenFn getChildrenFunc,
+	getACL func(string) (map[string][]string, error),
+	session *service.UserSession) getChildrenFunc {
+	return func(nodePath string) ([]*service.Node, error) {
+		children, err := getChildrenFn(nodePath)
+		if err != nil {
+			return nil, err
+		}
+		acl, err := getNodeACL(nodePath, getACL)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get node ACL: %v", err)
+		}
+		return visibleNodes(session, acl, children, time.Now()), nil
+	}
+}
+
+// getStoredNodeACL returns the ACL applying to the given node of the
+// site, read directly from the site's node store.
+func (i *MonstiService) getStoredNodeACL(site, nodePath string) (
+	map[string][]string, error) {
+	store, err := i.getStore(site)
+	if err != nil {
+		return nil, err
+	}
+	return getNodeACL(nodePath, func(nodePath string) (
+		map[string][]string, error) {
+		content, err := store.GetNode(nodePath)
+		if err != nil || content == nil {
+			return nil, err
+		}
+		var node struct{ ACL map[string][]string }
+		if err := json.Unmarshal(content, &node); err != nil {
+			return nil, fmt.Errorf("Could not decode node: %v", err)
+		}
+		return node.ACL, nil
+	})
+}
+
+func (i *MonstiService) CheckPermission(args *CheckPermissionArgs,
+	reply *bool) error {
+	acl, err := i.getStoredNodeACL(args.Site, args.Path)
+	if err != nil {
+		return err
+	}
+	session := args.Session
+	if session == nil {
+		session = new(service.UserSession)
+	}
+	*reply = checkPermission(args.Action, session, acl)
+	return nil
+}
@@ -0,0 +1,167 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestCheckPermission(t *testing.T) {
+	acl := map[string][]string{
+		"author":    {"view"},
+		"anonymous": {}}
+	tests := []struct {
+		Action service.Action
+		Auth   bool
+		Roles  []string
+		ACL    map[string][]string
+		Grant  bool
+	}{
+		{service.LoginAction, false, nil, nil, true},
+		{service.LoginAction, true, nil, nil, true},
+		{service.LogoutAction, false, nil, nil, false},
+		{service.LogoutAction, true, nil, nil, true},
+		{service.EditAction, false, nil, nil, false},
+		{service.EditAction, true, []string{"admin"}, nil, true},
+		{service.AddAction, false, nil, nil, false},
+		{service.AddAction, true, []string{"admin"}, nil, true},
+		{service.RemoveAction, false, nil, nil, false},
+		{service.RemoveAction, true, []string{"admin"}, nil, true},
+		{service.HistoryAction, false, nil, nil, false},
+		{service.HistoryAction, true, []string{"admin"}, nil, true},
+		{service.ViewAction, false, nil, nil, true},
+		{service.ViewAction, false, nil, acl, false},
+		{service.RemoveAction, true, []string{"admin"}, acl, true},
+		{service.RemoveAction, true, []string{"editor"}, nil, true},
+		{service.RemoveAction, true, []string{"author"}, nil, false},
+		{service.EditAction, true, []string{"author"}, nil, true},
+		{service.EditAction, true, []string{"author"}, acl, false},
+		{service.ViewAction, true, []string{"author"}, acl, true},
+		{service.EditAction, true, []string{"author", "editor"}, acl, true},
+		{service.EditAction, true, []string{"reader"}, nil, false},
+		{service.ViewAction, true, []string{"reader"}, nil, true},
+		{service.LogoutAction, true, []string{"reader"}, nil, true},
+		{service.ViewAction, true, []string{"unknown"}, nil, false},
+		{service.UsersAction, false, nil, nil, false},
+		{service.UsersAction, true, []string{"admin"}, nil, true},
+		{service.UsersAction, true, nil, nil, false},
+		{service.EditAction, true, nil, nil, false},
+		{service.UsersAction, true, []string{"editor"}, nil, false}}
+	for _, v := range tests {
+		var user *service.User
+		if v.Auth {
+			user = &service.User{Roles: v.Roles}
+		}
+		ret := checkPermission(v.Action, &service.UserSession{User: user}, v.ACL)
+		if ret != v.Grant {
+			t.Errorf("checkPermission(%v, %v, %v) = %v, expected %v", v.Action,
+				user, v.ACL, ret, v.Grant)
+		}
+	}
+}
+
+func TestGetNodeACL(t *testing.T) {
+	acls := map[string]map[string][]string{
+		"/":        {"author": {"view"}},
+		"/foo/bar": {"author": {"view", "edit"}},
+	}
+	getACL := func(nodePath string) (map[string][]string, error) {
+		return acls[nodePath], nil
+	}
+	tests := []struct {
+		Path string
+		ACL  map[string][]string
+	}{
+		{"/", acls["/"]},
+		{"/foo", acls["/"]},
+		{"/foo/bar", acls["/foo/bar"]},
+		{"/foo/bar/baz/", acls["/foo/bar"]},
+	}
+	for _, test := range tests {
+		acl, err := getNodeACL(test.Path, getACL)
+		if err != nil || !reflect.DeepEqual(acl, test.ACL) {
+			t.Errorf("getNodeACL(%q, _) = %v, %v, should be %v, nil", test.Path,
+				acl, err, test.ACL)
+		}
+	}
+}
+
+func TestVisibleNodes(t *testing.T) {
+	now := time.Now()
+	children := []*service.Node{
+		{Path: "/public", Public: true},
+		{Path: "/draft"},
+		{Path: "/restricted", Public: true,
+			ACL: map[string][]string{"anonymous": {}, "author": {}}},
+		{Path: "/open", Public: true,
+			ACL: map[string][]string{"anonymous": {"view"}}},
+		{Path: "/2014", Type: &service.NodeType{Id: "core.Path"}},
+	}
+	tests := []struct {
+		Roles     []string
+		Auth      bool
+		ParentACL map[string][]string
+		Visible   []string
+	}{
+		{nil, false, nil, []string{"/public", "/open", "/2014"}},
+		{nil, false, map[string][]string{"anonymous": {}}, []string{"/open"}},
+		{[]string{"author"}, true, nil,
+			[]string{"/public", "/draft", "/open", "/2014"}},
+		{[]string{"editor"}, true, nil,
+			[]string{"/public", "/draft", "/restricted", "/open", "/2014"}},
+	}
+	for i, test := range tests {
+		var user *service.User
+		if test.Auth {
+			user = &service.User{Roles: test.Roles}
+		}
+		var visible []string
+		for _, node := range visibleNodes(&service.UserSession{User: user},
+			test.ParentACL, children, now) {
+			visible = append(visible, node.Path)
+		}
+		if !reflect.DeepEqual(visible, test.Visible) {
+			t.Errorf("Test %v: visibleNodes returned %v, should be %v", i, visible,
+				test.Visible)
+		}
+	}
+}
+
+func TestSameACL(t *testing.T) {
+	tests := []struct {
+		A, B map[string][]string
+		Same bool
+	}{
+		{nil, nil, true},
+		{map[string][]string{}, nil, true},
+		{map[string][]string{"author": {"view"}}, nil, false},
+		{map[string][]string{"author": {"view"}},
+			map[string][]string{"author": {"view"}}, true},
+		{map[string][]string{"author": {"view", "edit"}},
+			map[string][]string{"author": {"view"}}, false},
+	}
+	for _, test := range tests {
+		if ret := sameACL(test.A, test.B); ret != test.Same {
+			t.Errorf("sameACL(%v, %v) = %v, should be %v", test.A, test.B, ret,
+				test.Same)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// getMonsti returns the current Monsti settings. The settings must not
+// be modified.
+func (s *settings) getMonsti() util.MonstiSettings {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Monsti
+}
+
+// getSite returns the settings of the named site.
+func (s *settings) getSite(name string) (util.SiteSettings, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	site, ok := s.Monsti.Sites[name]
+	return site, ok
+}
+
+// getSites returns the settings of all sites.
+func (s *settings) getSites() map[string]util.SiteSettings {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Monsti.Sites
+}
+
+// loadSettings loads the daemon's and the sites' settings.
+func loadSettings(cfgPath string) (*settings, error) {
+	var settings settings
+	if err := util.LoadModuleSettings("daemon", cfgPath, &settings); err != nil {
+		return nil, fmt.Errorf("Could not load settings: %v", err)
+	}
+	if err := settings.Monsti.LoadSiteSettings(); err != nil {
+		return nil, fmt.Errorf("Could not load site settings: %v", err)
+	}
+	return &settings, nil
+}
+
+// reload replaces the site settings and those daemon settings which
+// may change at runtime by the given ones. It returns the names of
+// changed settings which need a restart to take effect.
+func (s *settings) reload(fresh *settings) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var restart []string
+	if fresh.Listen != s.Listen {
+		restart = append(restart, "listen")
+	}
+	if !reflect.DeepEqual(fresh.Modules, s.Modules) {
+		restart = append(restart, "modules")
+	}
+	if fresh.Monsti.Directories != s.Monsti.Directories {
+		restart = append(restart, "directories")
+	}
+	if fresh.Monsti.Dev != s.Monsti.Dev {
+		restart = append(restart, "dev")
+	}
+	for name, site := range fresh.Monsti.Sites {
+		if old, ok := s.Monsti.Sites[name]; ok && old.Storage != site.Storage {
+			restart = append(restart, fmt.Sprintf("storage of site %q", name))
+		}
+	}
+	s.Monsti.Sites = fresh.Monsti.Sites
+	s.Mail = fresh.Mail
+	s.Signals = fresh.Signals
+	s.PageCache = fresh.PageCache
+	s.ModuleInitTimeout = fresh.ModuleInitTimeout
+	return restart
+}
+
+// setHosts updates the mapping of hosts to sites.
+func (h *nodeHandler) setHosts(sites map[string]util.SiteSettings) {
+	hosts := make(map[string]string)
+	for name, site := range sites {
+		for _, host := range site.Hosts {
+			hosts[host] = name
+		}
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.Hosts = hosts
+}
+
+// getSiteName returns the name of the site served at the given host.
+func (h *nodeHandler) getSiteName(host string) (string, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	name, ok := h.Hosts[host]
+	return name, ok
+}
+
+// ServeSiteStatic serves the static files of the requested site.
+func (h *nodeHandler) ServeSiteStatic(w http.ResponseWriter, r *http.Request) {
+	site, ok := h.getSiteName(r.Host)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.FileServer(http.Dir(filepath.Dir(
+		h.Settings.getMonsti().GetSiteStaticsPath(site)))).ServeHTTP(w, r)
+}
+
+// reloadSettings reloads the configuration from the given directory.
+func (i *MonstiService) reloadSettings(cfgPath string) error {
+	fresh, err := loadSettings(cfgPath)
+	if err != nil {
+		return err
+	}
+	restart := i.Settings.reload(fresh)
+	if len(restart) > 0 {
+		i.Logger.Printf("Restart Monsti to apply changed settings: %v", restart)
+	}
+	if i.Handler != nil {
+		i.Handler.setHosts(fresh.Monsti.Sites)
+	}
+	i.pageCache.clear()
+	return i.checkSchemas()
+}
+
+// closeStores closes the opened node stores.
+func (i *MonstiService) closeStores() {
+	i.storesMutex.Lock()
+	defer i.storesMutex.Unlock()
+	for site, store := range i.stores {
+		if err := store.Close(); err != nil {
+			i.Logger.Printf("Could not close node store of site %q: %v", site, err)
+		}
+	}
+	i.stores = nil
+}
@@ -0,0 +1,120 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestSettingsReload(t *testing.T) {
+	current := &settings{Listen: ":8080", Modules: []string{"a"}}
+	current.Monsti.Sites = map[string]util.SiteSettings{
+		"foo": {Title: "Foo", Hosts: []string{"foo.example"}}}
+	foo := util.SiteSettings{Title: "New Foo", Hosts: []string{"foo.example"}}
+	foo.Storage.Type = "bolt"
+	fresh := &settings{Listen: ":8081", Modules: []string{"a"}}
+	fresh.Monsti.Sites = map[string]util.SiteSettings{
+		"foo": foo,
+		"bar": {Title: "Bar", Hosts: []string{"bar.example"}}}
+	fresh.Mail.Debug = true
+	restart := current.reload(fresh)
+	expected := []string{"listen", `storage of site "foo"`}
+	if !reflect.DeepEqual(restart, expected) {
+		t.Errorf("reload(...) = %v, should be %v", restart, expected)
+	}
+	if site, ok := current.getSite("bar"); !ok || site.Title != "Bar" {
+		t.Errorf("Site bar should have been added: %v", site)
+	}
+	if site, _ := current.getSite("foo"); site.Title != "New Foo" {
+		t.Errorf("Site foo should have been updated: %v", site)
+	}
+	if !current.Mail.Debug || current.Listen != ":8080" {
+		t.Errorf("Only runtime settings should have been updated: %v", current)
+	}
+
+	var handler nodeHandler
+	handler.setHosts(current.getSites())
+	if name, ok := handler.getSiteName("bar.example"); !ok || name != "bar" {
+		t.Errorf(`getSiteName("bar.example") = %q, %v, should be "bar", true`,
+			name, ok)
+	}
+	if _, ok := handler.getSiteName("unknown.example"); ok {
+		t.Errorf("getSiteName should fail for unknown hosts")
+	}
+}
+
+// TestReloadDuringRequests should be run with the race detector.
+func TestReloadDuringRequests(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/themes/base/theme.yaml":       "title: Base",
+		"/themes/base/static/style.css": "style"}, "TestReloadDuringRequests")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	sites := func() map[string]util.SiteSettings {
+		return map[string]util.SiteSettings{"foo": {
+			Hosts: []string{"foo.example"}, Themes: []string{"base"}}}
+	}
+	current := &settings{}
+	current.Monsti.Directories.Share = root
+	current.Monsti.Sites = sites()
+	handler := &nodeHandler{Settings: current}
+	handler.setHosts(current.getSites())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("GET",
+					"http://foo.example/theme-static/style.css", nil)
+				handler.ServeThemeStatic(w, r)
+				if w.Code != http.StatusOK {
+					t.Errorf("ServeThemeStatic returned status %v", w.Code)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		fresh := &settings{}
+		fresh.Monsti.Directories = current.getMonsti().Directories
+		fresh.Monsti.Sites = sites()
+		current.reload(fresh)
+		handler.setHosts(fresh.Monsti.Sites)
+	}
+}
@@ -51,9 +51,17 @@ func splitFirstDir(path string) string {
 }
 
 // renderInMaster renders the content in the master template.
-func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
+func renderInMaster(r *template.Renderer, content []byte, env masterTmplEnv,
 	settings *settings, site util.SiteSettings, locale string,
 	s *service.Session) string {
+	var permissions map[string]bool
+	if env.Session.User != nil {
+		acl, err := getNodeACL(env.Node.Path, getNodeACLFn(s.Monsti(), site.Name))
+		if err != nil {
+			panic(fmt.Sprint("Could not get node ACL: ", err))
+		}
+		permissions = getPermissions(env.Session, acl)
+	}
 	if env.Flags&EDIT_VIEW != 0 {
 		ret, err := r.Render("admin/master", template.Context{
 			"Site": site,
@@ -63,8 +71,9 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 				"EditView": env.Flags&EDIT_VIEW != 0,
 				"Content":  htmlT.HTML(content),
 			},
-			"Session": env.Session}, locale,
-			settings.Monsti.GetSiteTemplatesPath(site.Name))
+			"Permissions": permissions,
+			"Session":     env.Session}, locale,
+			settings.getMonsti().GetSiteTemplatesPaths(site.Name)...)
 		if err != nil {
 			panic("Can't render: " + err.Error())
 		}
@@ -75,9 +84,7 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 		node, err := s.Monsti().GetNode(site.Name, path)
 		return node, err
 	}
-	getChildrenFn := func(path string) ([]*service.Node, error) {
-		return s.Monsti().GetChildren(site.Name, path)
-	}
+	getChildrenFn := visibleChildrenFn(s.Monsti(), site.Name, env.Session)
 	prinav, err := getNav("/", path.Join("/", firstDir), env.Session.User == nil,
 		getNodeFn, getChildrenFn)
 	if err != nil {
@@ -95,7 +102,7 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 	}
 
 	title := getNodeTitle(env.Node)
-	ret, err := r.Render("master", template.Context{
+	ret, err := r.RenderEnv("master", template.Context{
 		"Site": site,
 		"Page": template.Context{
 			"Node":             env.Node,
@@ -104,9 +111,15 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 			"EditView":         env.Flags&EDIT_VIEW != 0,
 			"Title":            title,
 			"Content":          htmlT.HTML(content),
-			"ShowSecondaryNav": len(secnav) > 0},
-		"Session": env.Session}, locale,
-		settings.Monsti.GetSiteTemplatesPath(site.Name))
+			"ShowSecondaryNav": len(secnav) > 0,
+			"Translations":     getTranslationLinks(site, env.Node.Path)},
+		"Permissions": permissions,
+		"Session":     env.Session}, &template.Env{
+		Locale:      locale,
+		Session:     s,
+		Site:        site,
+		UserSession: env.Session},
+		settings.getMonsti().GetSiteTemplatesPaths(site.Name)...)
 	if err != nil {
 		panic("Can't render: " + err.Error())
 	}
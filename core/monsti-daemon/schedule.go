@@ -0,0 +1,302 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// scheduleFile is the name of the file in the site's data directory
+// holding the time the scheduler last emitted the site's due events.
+const scheduleFile = "schedule.json"
+
+// readLastRun returns the time the scheduler last emitted the due
+// events of the site with the given data directory, or the zero time
+// if it never did.
+func readLastRun(dataDir string) (time.Time, error) {
+	var lastRun time.Time
+	content, err := ioutil.ReadFile(filepath.Join(dataDir, scheduleFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lastRun, nil
+		}
+		return lastRun, fmt.Errorf("Could not read last run: %v", err)
+	}
+	if err := json.Unmarshal(content, &lastRun); err != nil {
+		return lastRun, fmt.Errorf("Could not decode last run: %v", err)
+	}
+	return lastRun, nil
+}
+
+// writeLastRun writes the time the scheduler last emitted the due
+// events of the site with the given data directory.
+func writeLastRun(dataDir string, lastRun time.Time) error {
+	content, err := json.Marshal(lastRun)
+	if err != nil {
+		return fmt.Errorf("Could not encode last run: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dataDir, scheduleFile), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write last run: %v", err)
+	}
+	return nil
+}
+
+// publishEvent is a scheduled change of the publication state of a
+// node.
+type publishEvent struct {
+	Time       time.Time
+	Site, Path string
+	// Unpublish is true if the node will be unpublished, false if it
+	// will be published.
+	Unpublish bool
+}
+
+type publishEvents []publishEvent
+
+func (e publishEvents) Len() int           { return len(e) }
+func (e publishEvents) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e publishEvents) Less(i, j int) bool { return e[i].Time.Before(e[j].Time) }
+
+// publishScheduler keeps track of upcoming publish and unpublish
+// times of the nodes.
+//
+// The zero value is an empty scheduler.
+type publishScheduler struct {
+	mutex sync.Mutex
+	// events holds the upcoming events, sorted by time.
+	events publishEvents
+	// wakeup notifies the running scheduler about changed events.
+	wakeup chan struct{}
+}
+
+// removeEvents removes the events of the given node. If subtree is
+// true, the events of the node's descendants are removed, too.
+func (s *publishScheduler) removeEvents(site, path string, subtree bool) {
+	events := s.events[:0]
+	for _, event := range s.events {
+		if event.Site == site && (event.Path == path ||
+			subtree && strings.HasPrefix(event.Path, path+"/")) {
+			continue
+		}
+		events = append(events, event)
+	}
+	s.events = events
+}
+
+// notify wakes up the running scheduler.
+func (s *publishScheduler) notify() {
+	if s.wakeup == nil {
+		s.wakeup = make(chan struct{}, 1)
+	}
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// set replaces the scheduled events of the given node by the node's
+// publish and unpublish times after the given time. Events which are
+// already past are due immediately.
+func (s *publishScheduler) set(site, path string, node *service.Node,
+	since time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeEvents(site, path, false)
+	if node.Public {
+		if node.PublishTime.After(since) {
+			s.events = append(s.events,
+				publishEvent{node.PublishTime, site, path, false})
+		}
+		if node.UnpublishTime.After(since) &&
+			node.UnpublishTime.After(node.PublishTime) {
+			s.events = append(s.events,
+				publishEvent{node.UnpublishTime, site, path, true})
+		}
+	}
+	sort.Stable(s.events)
+	s.notify()
+}
+
+// remove removes the scheduled events of the given node and its
+// descendants.
+func (s *publishScheduler) remove(site, path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeEvents(site, path, true)
+	s.notify()
+}
+
+// due removes and returns the events due at the given time. It also
+// returns the time of the next event or the zero time if there is no
+// further event.
+func (s *publishScheduler) due(now time.Time) ([]publishEvent, time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var due []publishEvent
+	for len(s.events) > 0 && !s.events[0].Time.After(now) {
+		due = append(due, s.events[0])
+		s.events = s.events[1:]
+	}
+	if len(s.events) == 0 {
+		return due, time.Time{}
+	}
+	return due, s.events[0].Time
+}
+
+// run calls emit for each event when it is due and done after each
+// pass with the time up to which all due events have been emitted. It
+// never returns.
+func (s *publishScheduler) run(emit func(event publishEvent),
+	done func(now time.Time)) {
+	s.mutex.Lock()
+	if s.wakeup == nil {
+		s.wakeup = make(chan struct{}, 1)
+	}
+	wakeup := s.wakeup
+	s.mutex.Unlock()
+	for {
+		now := time.Now()
+		events, next := s.due(now)
+		for _, event := range events {
+			emit(event)
+		}
+		done(now)
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(time.Now()))
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+		case <-wakeup:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// scheduleNode updates the scheduled events of the given node after
+// it has been written.
+func (i *MonstiService) scheduleNode(site, nodePath string) {
+	err := func() error {
+		store, err := i.getStore(site)
+		if err != nil {
+			return err
+		}
+		content, err := store.GetNode(nodePath)
+		if err != nil {
+			return fmt.Errorf("Could not get node: %v", err)
+		}
+		if content == nil {
+			i.scheduler.remove(site, nodePath)
+			return nil
+		}
+		var node service.Node
+		if err := json.Unmarshal(content, &node); err != nil {
+			return fmt.Errorf("Could not decode node: %v", err)
+		}
+		i.scheduler.set(site, nodePath, &node, time.Now())
+		return nil
+	}()
+	if err != nil {
+		i.Logger.Printf("Could not schedule node %q of site %q: %v", nodePath,
+			site, err)
+	}
+}
+
+// scheduleTree schedules the events of the given node and its
+// descendants after the given time.
+func (i *MonstiService) scheduleTree(site, nodePath string,
+	since time.Time) error {
+	return i.walkNodes(site, nodePath, func(path string, content []byte) error {
+		var node service.Node
+		if err := json.Unmarshal(content, &node); err != nil {
+			return fmt.Errorf("Could not decode node %q: %v", path, err)
+		}
+		i.scheduler.set(site, path, &node, since)
+		return nil
+	})
+}
+
+// unscheduleTree removes the scheduled events of the given node and
+// its descendants.
+//
+// If target is not empty, the nodes have been moved to the target
+// path and will be scheduled again.
+func (i *MonstiService) unscheduleTree(site, nodePath, target string) {
+	i.scheduler.remove(site, nodePath)
+	if len(target) > 0 {
+		if err := i.scheduleTree(site, target, time.Now()); err != nil {
+			i.Logger.Printf("Could not schedule nodes of site %q: %v", site, err)
+		}
+	}
+}
+
+// runScheduler schedules the nodes of all sites and starts emitting
+// the monsti.NodePublished and monsti.NodeUnpublished signals when
+// their publish or unpublish times are reached.
+//
+// Events missed while the daemon was not running are emitted right
+// away. Sites which have never been scheduled before don't get any
+// missed events.
+func (i *MonstiService) runScheduler() error {
+	now := time.Now()
+	for site := range i.Settings.getSites() {
+		since, err := readLastRun(i.Settings.getMonsti().GetSiteDataPath(site))
+		if err != nil {
+			return fmt.Errorf("Could not get last run of site %q: %v", site, err)
+		}
+		if since.IsZero() {
+			since = now
+		}
+		if err := i.scheduleTree(site, "/", since); err != nil {
+			return fmt.Errorf("Could not schedule nodes of site %q: %v", site, err)
+		}
+	}
+	go i.scheduler.run(func(event publishEvent) {
+		i.pageCache.invalidate(event.Site)
+		if event.Unpublish {
+			i.emitNotification("monsti.NodeUnpublished",
+				service.NodeUnpublishedArgs{Site: event.Site, Path: event.Path})
+		} else {
+			i.emitNotification("monsti.NodePublished",
+				service.NodePublishedArgs{Site: event.Site, Path: event.Path})
+		}
+	}, func(now time.Time) {
+		for site := range i.Settings.getSites() {
+			if err := writeLastRun(i.Settings.getMonsti().GetSiteDataPath(site),
+				now); err != nil {
+				i.Logger.Printf("Could not record last run of site %q: %v", site,
+					err)
+			}
+		}
+	})
+	return nil
+}
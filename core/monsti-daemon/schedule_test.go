@@ -0,0 +1,122 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestPublishScheduler(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return now.Add(time.Duration(hours) * time.Hour)
+	}
+	var scheduler publishScheduler
+	scheduler.set("site", "/a", &service.Node{Public: true,
+		PublishTime: at(2), UnpublishTime: at(4)}, now)
+	scheduler.set("site", "/a/b", &service.Node{Public: true,
+		PublishTime: at(-1), UnpublishTime: at(1)}, now)
+	scheduler.set("site", "/c", &service.Node{Public: false,
+		PublishTime: at(3)}, now)
+	scheduler.set("site", "/d", &service.Node{Public: true,
+		PublishTime: at(3)}, now)
+	scheduler.set("other", "/a", &service.Node{Public: true,
+		PublishTime: at(5)}, now)
+	// Replaces the earlier events of /d.
+	scheduler.set("site", "/d", &service.Node{Public: true,
+		PublishTime: at(6)}, now)
+
+	tests := []struct {
+		Now    time.Time
+		Events []publishEvent
+		Next   time.Time
+	}{
+		{now, nil, at(1)},
+		{at(2), []publishEvent{
+			{at(1), "site", "/a/b", true},
+			{at(2), "site", "/a", false}}, at(4)},
+		{at(2), nil, at(4)},
+	}
+	for i, test := range tests {
+		events, next := scheduler.due(test.Now)
+		if !reflect.DeepEqual(events, test.Events) || !next.Equal(test.Next) {
+			t.Errorf("Test %v: due(%v) = %v, %v, should be %v, %v", i, test.Now,
+				events, next, test.Events, test.Next)
+		}
+	}
+
+	scheduler.remove("site", "/a")
+	events, next := scheduler.due(at(5))
+	expected := []publishEvent{{at(5), "other", "/a", false}}
+	if !reflect.DeepEqual(events, expected) || !next.Equal(at(6)) {
+		t.Errorf("due(%v) after remove = %v, %v, should be %v, %v", at(5),
+			events, next, expected, at(6))
+	}
+}
+
+func TestPublishSchedulerMissedEvents(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return now.Add(time.Duration(hours) * time.Hour)
+	}
+	var scheduler publishScheduler
+	// The scheduler last ran five hours ago.
+	since := at(-5)
+	scheduler.set("site", "/a", &service.Node{Public: true,
+		PublishTime: at(-6), UnpublishTime: at(-1)}, since)
+	scheduler.set("site", "/b", &service.Node{Public: true,
+		PublishTime: at(-2), UnpublishTime: at(2)}, since)
+	scheduler.set("site", "/c", &service.Node{Public: false,
+		PublishTime: at(-3)}, since)
+
+	events, next := scheduler.due(now)
+	expected := []publishEvent{
+		{at(-2), "site", "/b", false},
+		{at(-1), "site", "/a", true}}
+	if !reflect.DeepEqual(events, expected) || !next.Equal(at(2)) {
+		t.Errorf("due(%v) = %v, %v, should be %v, %v", now, events, next,
+			expected, at(2))
+	}
+}
+
+func TestLastRun(t *testing.T) {
+	root, err := ioutil.TempDir("", "_monsti_TestLastRun")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	lastRun, err := readLastRun(root)
+	if err != nil || !lastRun.IsZero() {
+		t.Errorf("readLastRun without schedule file = %v, %v, should be "+
+			"zero time, nil", lastRun, err)
+	}
+	now := time.Date(2014, 1, 1, 12, 30, 0, 0, time.UTC)
+	if err := writeLastRun(root, now); err != nil {
+		t.Fatalf("writeLastRun returned error: %v", err)
+	}
+	lastRun, err = readLastRun(root)
+	if err != nil || !lastRun.Equal(now) {
+		t.Errorf("readLastRun = %v, %v, should be %v, nil", lastRun, err, now)
+	}
+}
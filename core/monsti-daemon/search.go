@@ -0,0 +1,430 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// titleWeight is the weight of a term occurring in the node's title
+// compared to other fields.
+const titleWeight = 5
+
+// snippetLength is the approximate length of search result snippets
+// in characters.
+const snippetLength = 160
+
+// htmlTagRegexp matches HTML tags to be removed from indexed fields.
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// indexedNode is a node as kept by the search index.
+type indexedNode struct {
+	Path          string
+	Title         string
+	Text          string
+	Public        bool
+	PublishTime   time.Time
+	UnpublishTime time.Time
+	// terms maps the node's terms to their weighted count.
+	terms map[string]int
+}
+
+// searchTerms splits the text into lower case terms.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// decodeTexts decodes the JSON value of a text field. Translatable
+// fields yield their values sorted by locale.
+func decodeTexts(raw json.RawMessage) ([]string, error) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return []string{value}, nil
+	}
+	var translations map[string]string
+	if err := json.Unmarshal(raw, &translations); err != nil {
+		return nil, err
+	}
+	locales := make([]string, 0, len(translations))
+	for locale := range translations {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	values := make([]string, 0, len(locales))
+	for _, locale := range locales {
+		values = append(values, translations[locale])
+	}
+	return values, nil
+}
+
+// newIndexedNode parses the given JSON document of a node to be
+// indexed.
+//
+// nodeTypes are used to look up the types of the node's fields. Only
+// text and HTML fields will be indexed.
+func newIndexedNode(path string, content []byte,
+	nodeTypes map[string]*service.NodeType) (*indexedNode, error) {
+	var data struct {
+		Type          string
+		Public        bool
+		PublishTime   time.Time
+		UnpublishTime time.Time
+		LocalFields   []*service.NodeField
+		Fields        map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("Could not decode node: %v", err)
+	}
+	node := &indexedNode{
+		Path:          path,
+		Public:        data.Public,
+		PublishTime:   data.PublishTime,
+		UnpublishTime: data.UnpublishTime,
+		terms:         make(map[string]int)}
+	var fields []*service.NodeField
+	if nodeType, ok := nodeTypes[data.Type]; ok {
+		fields = append(fields, nodeType.Fields...)
+	}
+	fields = append(fields, data.LocalFields...)
+	var texts []string
+	for _, field := range fields {
+		if field.Type != "Text" && field.Type != "HTMLArea" &&
+			field.Type != "Markdown" {
+			continue
+		}
+		parts := strings.SplitN(field.Id, ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		raw, ok := data.Fields[parts[0]][parts[1]]
+		if !ok {
+			continue
+		}
+		values, err := decodeTexts(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode field %q: %v", field.Id, err)
+		}
+		for i, value := range values {
+			if field.Type == "HTMLArea" {
+				value = html.UnescapeString(htmlTagRegexp.ReplaceAllString(value, " "))
+			}
+			weight := 1
+			if field.Id == "core.Title" {
+				if i == 0 {
+					node.Title = value
+				}
+				weight = titleWeight
+			} else {
+				texts = append(texts, value)
+			}
+			for _, term := range searchTerms(value) {
+				node.terms[term] += weight
+			}
+		}
+	}
+	node.Text = strings.Join(strings.Fields(strings.Join(texts, " ")), " ")
+	return node, nil
+}
+
+// snippet returns an excerpt of the node's text around the first
+// occurence of one of the given terms.
+func (n *indexedNode) snippet(terms []string) string {
+	text := []rune(n.Text)
+	lower := strings.ToLower(n.Text)
+	start := -1
+	for _, term := range terms {
+		if pos := strings.Index(lower, term); pos >= 0 {
+			// Lower casing keeps the number of runes.
+			pos = len([]rune(lower[:pos]))
+			if start == -1 || pos < start {
+				start = pos
+			}
+		}
+	}
+	if start == -1 {
+		start = 0
+	}
+	start -= snippetLength / 4
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLength
+	if end > len(text) {
+		end = len(text)
+	}
+	snippet := string(text[start:end])
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// searchIndex is a full text index of the nodes of a site.
+type searchIndex struct {
+	mutex sync.RWMutex
+	nodes map[string]*indexedNode
+	// terms maps terms to the paths of the nodes containing them and
+	// the weighted count of the terms in these nodes.
+	terms map[string]map[string]int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		nodes: make(map[string]*indexedNode),
+		terms: make(map[string]map[string]int)}
+}
+
+// add adds the node to the index, replacing any earlier version.
+func (s *searchIndex) add(node *indexedNode) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeNode(node.Path)
+	s.nodes[node.Path] = node
+	for term, count := range node.terms {
+		if s.terms[term] == nil {
+			s.terms[term] = make(map[string]int)
+		}
+		s.terms[term][node.Path] = count
+	}
+}
+
+// remove removes the node with the given path and its descendants
+// from the index.
+func (s *searchIndex) remove(nodePath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	prefix := strings.TrimSuffix(nodePath, "/") + "/"
+	for path := range s.nodes {
+		if path == nodePath || strings.HasPrefix(path, prefix) {
+			s.removeNode(path)
+		}
+	}
+}
+
+// removeNode removes the node with the given path. The index must be
+// locked by the caller.
+func (s *searchIndex) removeNode(nodePath string) {
+	node, ok := s.nodes[nodePath]
+	if !ok {
+		return
+	}
+	for term := range node.terms {
+		delete(s.terms[term], nodePath)
+		if len(s.terms[term]) == 0 {
+			delete(s.terms, term)
+		}
+	}
+	delete(s.nodes, nodePath)
+}
+
+type searchResults []service.SearchResult
+
+func (r searchResults) Len() int      { return len(r) }
+func (r searchResults) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r searchResults) Less(i, j int) bool {
+	if r[i].Score != r[j].Score {
+		return r[i].Score > r[j].Score
+	}
+	return r[i].Path < r[j].Path
+}
+
+// search returns the nodes containing all terms of the query ordered
+// by relevance. Nodes which are not public or not published at the
+// given time are omitted, as are nodes for which visible returns
+// false if it's not nil. If limit is greater than zero, at most limit
+// results will be returned.
+func (s *searchIndex) search(query string, limit int, now time.Time,
+	visible func(nodePath string) bool) []service.SearchResult {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var results searchResults
+	for path, count := range s.terms[terms[0]] {
+		node := s.nodes[path]
+		if !node.Public || node.PublishTime.After(now) ||
+			!node.UnpublishTime.IsZero() && !node.UnpublishTime.After(now) {
+			continue
+		}
+		score := count
+		for _, term := range terms[1:] {
+			termCount, ok := s.terms[term][path]
+			if !ok {
+				score = 0
+				break
+			}
+			score += termCount
+		}
+		if score == 0 || visible != nil && !visible(path) {
+			continue
+		}
+		results = append(results, service.SearchResult{
+			Path:    path,
+			Title:   node.Title,
+			Snippet: node.snippet(terms),
+			Score:   score})
+	}
+	sort.Sort(results)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// getSearchIndex returns the search index of the given site. The
+// index will be built on first use.
+func (i *MonstiService) getSearchIndex(site string) (*searchIndex, error) {
+	i.searchMutex.Lock()
+	defer i.searchMutex.Unlock()
+	if index, ok := i.searchIndexes[site]; ok {
+		return index, nil
+	}
+	index := newSearchIndex()
+	if err := i.indexTree(site, index, "/"); err != nil {
+		return nil, fmt.Errorf("Could not build search index: %v", err)
+	}
+	if i.searchIndexes == nil {
+		i.searchIndexes = make(map[string]*searchIndex)
+	}
+	i.searchIndexes[site] = index
+	return index, nil
+}
+
+// indexTree adds the given node and its descendants to the index.
+func (i *MonstiService) indexTree(site string, index *searchIndex,
+	nodePath string) error {
+	i.mutex.RLock()
+	nodeTypes := i.Settings.Config.NodeTypes
+	i.mutex.RUnlock()
+	return i.walkNodes(site, nodePath, func(path string, content []byte) error {
+		node, err := newIndexedNode(path, content, nodeTypes)
+		if err != nil {
+			return fmt.Errorf("Could not index node %q: %v", path, err)
+		}
+		index.add(node)
+		return nil
+	})
+}
+
+// builtSearchIndex returns the search index of the given site or nil
+// if it has not been built yet.
+func (i *MonstiService) builtSearchIndex(site string) *searchIndex {
+	i.searchMutex.Lock()
+	defer i.searchMutex.Unlock()
+	return i.searchIndexes[site]
+}
+
+// updateSearchIndex updates the site's search index after the given
+// node has been written.
+func (i *MonstiService) updateSearchIndex(site, nodePath string) {
+	index := i.builtSearchIndex(site)
+	if index == nil {
+		return
+	}
+	err := func() error {
+		store, err := i.getStore(site)
+		if err != nil {
+			return err
+		}
+		content, err := store.GetNode(nodePath)
+		if err != nil {
+			return fmt.Errorf("Could not get node: %v", err)
+		}
+		if content == nil {
+			index.remove(nodePath)
+			return nil
+		}
+		i.mutex.RLock()
+		nodeTypes := i.Settings.Config.NodeTypes
+		i.mutex.RUnlock()
+		node, err := newIndexedNode(nodePath, content, nodeTypes)
+		if err != nil {
+			return fmt.Errorf("Could not index node: %v", err)
+		}
+		index.add(node)
+		return nil
+	}()
+	if err != nil {
+		i.Logger.Printf("Could not update search index of site %q: %v", site, err)
+	}
+}
+
+// removeFromSearchIndex removes the given node and its descendants
+// from the site's search index.
+//
+// If target is not empty, the nodes have been moved to the target
+// path and will be indexed again.
+func (i *MonstiService) removeFromSearchIndex(site, nodePath, target string) {
+	index := i.builtSearchIndex(site)
+	if index == nil {
+		return
+	}
+	index.remove(nodePath)
+	if len(target) > 0 {
+		if err := i.indexTree(site, index, target); err != nil {
+			i.Logger.Printf("Could not update search index of site %q: %v",
+				site, err)
+		}
+	}
+}
+
+type SearchArgs struct {
+	Site, Query string
+	Limit       int
+	// Session is the session of the searching user. Nil for anonymous
+	// visitors.
+	Session *service.UserSession
+}
+
+func (i *MonstiService) Search(args *SearchArgs,
+	reply *[]service.SearchResult) error {
+	index, err := i.getSearchIndex(args.Site)
+	if err != nil {
+		return err
+	}
+	session := args.Session
+	if session == nil {
+		session = new(service.UserSession)
+	}
+	*reply = index.search(args.Query, args.Limit, time.Now(),
+		func(nodePath string) bool {
+			acl, err := i.getStoredNodeACL(args.Site, nodePath)
+			if err != nil {
+				i.Logger.Printf("Could not get ACL of %q: %v", nodePath, err)
+				return false
+			}
+			return checkPermission(service.ViewAction, session, acl)
+		})
+	return nil
+}
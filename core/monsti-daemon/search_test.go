@@ -0,0 +1,97 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestSearchIndex(t *testing.T) {
+	nodeTypes := map[string]*service.NodeType{
+		"core.Document": {
+			Id: "core.Document",
+			Fields: []*service.NodeField{
+				{Id: "core.Title", Type: "Text"},
+				{Id: "core.Body", Type: "HTMLArea"}}}}
+	nodes := map[string]string{
+		"/foo": `{"Type":"core.Document","Public":true,"Fields":{"core":{
+      "Title":"Apples","Body":"<p>Apples &amp; pears are <b>fruits</b>.</p>"}}}`,
+		"/foo/bar": `{"Type":"core.Document","Public":true,"Fields":{"core":{
+      "Title":"Pears","Body":"<p>Pears, not apples.</p>"}}}`,
+		"/private": `{"Type":"core.Document","Public":false,"Fields":{"core":{
+      "Title":"Private apples","Body":""}}}`,
+		"/future": `{"Type":"core.Document","Public":true,
+      "PublishTime":"2100-01-01T00:00:00Z","Fields":{"core":{
+      "Title":"Future apples","Body":""}}}`,
+		"/expired": `{"Type":"core.Document","Public":true,
+      "UnpublishTime":"2000-01-01T00:00:00Z","Fields":{"core":{
+      "Title":"Expired apples","Body":""}}}`,
+		"/tree": `{"Type":"core.Document","Public":true,"Fields":{"core":{
+      "Title":{"de":"Baum","en":"Tree"},
+      "Body":{"de":"<p>Ein Baum.</p>","en":"<p>A tree.</p>"}}}}`}
+	index := newSearchIndex()
+	for path, content := range nodes {
+		node, err := newIndexedNode(path, []byte(content), nodeTypes)
+		if err != nil {
+			t.Fatalf("newIndexedNode(%q, ...) returned error: %v", path, err)
+		}
+		index.add(node)
+	}
+	tests := []struct {
+		Query string
+		Paths []string
+	}{
+		{"apples", []string{"/foo", "/foo/bar"}},
+		{"PEARS", []string{"/foo/bar", "/foo"}},
+		{"pears fruits", []string{"/foo"}},
+		{"amp", nil},
+		{"tree", []string{"/tree"}},
+		{"baum", []string{"/tree"}},
+		{"unknown", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		var paths []string
+		for _, result := range index.search(test.Query, 0, time.Now(), nil) {
+			paths = append(paths, result.Path)
+		}
+		if !reflect.DeepEqual(paths, test.Paths) {
+			t.Errorf("search(%q) returned %v, should be %v", test.Query, paths,
+				test.Paths)
+		}
+	}
+	results := index.search("fruits", 0, time.Now(), nil)
+	if len(results) != 1 || results[0].Title != "Apples" ||
+		results[0].Snippet != "Apples & pears are fruits ." {
+		t.Errorf("search(%q) returned %v", "fruits", results)
+	}
+	results = index.search("apples", 0, time.Now(), func(path string) bool {
+		return path != "/foo/bar"
+	})
+	if len(results) != 1 || results[0].Path != "/foo" {
+		t.Errorf("search should omit nodes which are not visible, got %v",
+			results)
+	}
+	index.remove("/foo")
+	if results := index.search("apples", 0, time.Now(), nil); len(results) != 0 {
+		t.Errorf("Removed nodes should not be found, got %v", results)
+	}
+}
@@ -44,19 +44,31 @@ type reqContext struct {
 	UserSession *service.UserSession
 	Site        *util.SiteSettings
 	Serv        *service.Session
+	// cacheKey is the page cache key of cacheable requests.
+	cacheKey string
+	// cacheGeneration is the page cache generation of the site at the
+	// start of the request.
+	cacheGeneration uint64
 }
 
 // nodeHandler is a net/http handler to process incoming HTTP requests.
 type nodeHandler struct {
-	Renderer template.Renderer
+	Renderer *template.Renderer
 	Settings *settings
 	// Hosts is a map from hosts to site names.
 	Hosts map[string]string
 	// Log is the logger used by the node handler.
 	Log *log.Logger
 	// Info is a connection to an INFO service.
-	Monsti        *service.MonstiClient
-	Sessions      *service.SessionPool
+	Monsti   *service.MonstiClient
+	Sessions *service.SessionPool
+	// Supervisor provides the status of the modules.
+	Supervisor *moduleSupervisor
+	// Migrator tells which sites have to be migrated before they can
+	// be served.
+	Migrator *migrator
+	// PageCache keeps the pages rendered for anonymous visitors.
+	PageCache     *pageCache
 	requests      map[uint]*reqContext
 	lastRequestID uint
 	mutex         sync.RWMutex
@@ -144,23 +156,16 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		serveError("Could not get session: %v", err)
 	}
 	defer h.Sessions.Free(c.Serv)
-	var nodePath string
-	nodePath, action := splitAction(c.Req.URL.Path)
-	c.Action = map[string]service.Action{
-		"view":                   service.ViewAction,
-		"edit":                   service.EditAction,
-		"login":                  service.LoginAction,
-		"logout":                 service.LogoutAction,
-		"add":                    service.AddAction,
-		"remove":                 service.RemoveAction,
-		"request-password-token": service.RequestPasswordTokenAction,
-		"change-password":        service.ChangePasswordAction,
-	}[action]
-	site_name, ok := h.Hosts[c.Req.Host]
+	site_name, ok := h.getSiteName(c.Req.Host)
 	if !ok {
 		serveError("No site found for host %v", c.Req.Host)
 	}
-	site := h.Settings.Monsti.Sites[site_name]
+	if h.Migrator != nil && h.Migrator.isOutdated(site_name) {
+		http.Error(c.Res, "Site is being upgraded. Please try again later.",
+			http.StatusServiceUnavailable)
+		return
+	}
+	site, _ := h.Settings.getSite(site_name)
 	c.Site = &site
 	c.Site.Name = site_name
 	c.Session, err = getSession(c.Req, *c.Site)
@@ -169,27 +174,82 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer context.Clear(c.Req)
 	c.UserSession, err = getClientSession(c.Session,
-		h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+		h.Settings.getMonsti().GetSiteDataPath(c.Site.Name))
 	if err != nil {
 		serveError("Could not get client session: %v", err)
 	}
-	c.UserSession.Locale = c.Site.Locale
+	locale, urlPath := negotiateLocale(c.Res, c.Req, *c.Site)
+	c.UserSession.Locale = locale
+	if isMultilingual(*c.Site) {
+		c.Serv.Monsti().SetLocales(locale, c.Site.Locale)
+	}
+	nodePath, action := splitAction(urlPath)
+	c.Action, _ = service.ParseAction(action)
+	h.Settings.mutex.RLock()
+	cacheDisabled := h.Settings.PageCache.Disabled || h.Settings.Monsti.Dev
+	h.Settings.mutex.RUnlock()
+	if h.PageCache != nil && !cacheDisabled &&
+		c.UserSession.User == nil && c.Action == service.ViewAction &&
+		(c.Req.Method == "GET" || c.Req.Method == "HEAD") {
+		c.cacheKey = pageCacheKey(c.Site.Name, locale, urlPath,
+			c.Req.URL.RawQuery)
+		c.cacheGeneration = h.PageCache.generation(c.Site.Name)
+		if page := h.PageCache.get(c.cacheKey); page != nil {
+			h.Log.Printf("(%v) %v %v (cached)", c.Site.Name, c.Req.Method,
+				c.Req.URL.Path)
+			writePage(c.Res, c.Req, page.Content, page.ETag, true,
+				isMultilingual(*c.Site))
+			return
+		}
+	}
 	c.Node, err = c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
 	if err != nil {
 		serveError("Error getting node: %v", err)
 	}
+	if c.Node == nil && c.Action == service.ViewAction {
+		// Year and month archives of blogs are not stored as nodes.
+		c.Node, err = getBlogArchiveNode(c.Serv.Monsti(), c.Site.Name, nodePath)
+		if err != nil {
+			serveError("Error getting blog archive: %v", err)
+		}
+	}
 	if c.Node == nil ||
-		(c.UserSession.User == nil &&
-			(c.Node.Public == false || c.Node.PublishTime.After(time.Now()))) {
+		(c.UserSession.User == nil && !c.Node.IsPublished(time.Now())) {
 		h.Log.Printf("Node not found: %v @ %v", nodePath, c.Site.Name)
 		c.Node = &service.Node{Path: nodePath}
 		http.Error(c.Res, "Document not found", http.StatusNotFound)
 		return
 	}
-	if !checkPermission(c.Action, c.UserSession) {
+	acl, err := getNodeACL(c.Node.Path,
+		getNodeACLFn(c.Serv.Monsti(), c.Site.Name))
+	if err != nil {
+		serveError("Could not get node ACL: %v", err)
+	}
+	permAction := c.Action
+	if c.Action == service.EditAction && len(c.Req.FormValue("NodeType")) > 0 {
+		// New nodes get added using the edit action.
+		permAction = service.AddAction
+	}
+	if !checkPermission(permAction, c.UserSession, acl) {
 		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 		return
 	}
+	var newToken bool
+	c.UserSession.CSRFToken, newToken, err = getCSRFToken(c.Session)
+	if err != nil {
+		serveError("Could not get CSRF token: %v", err)
+	}
+	if newToken {
+		if err = c.Session.Save(c.Req, c.Res); err != nil {
+			serveError("Could not save session: %v", err)
+		}
+	}
+	if c.Req.Method == "POST" &&
+		!c.UserSession.CheckCSRFToken(c.Req.FormValue(service.CSRFTokenField)) {
+		h.Log.Printf("Invalid CSRF token: %v @ %v", nodePath, c.Site.Name)
+		http.Error(w, "Invalid CSRF token.", http.StatusForbidden)
+		return
+	}
 	switch c.Action {
 	case service.LoginAction:
 		err = h.Login(&c)
@@ -205,6 +265,12 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		err = h.RequestPasswordToken(&c)
 	case service.ChangePasswordAction:
 		err = h.ChangePassword(&c)
+	case service.HistoryAction:
+		err = h.History(&c)
+	case service.UsersAction:
+		err = h.Users(&c)
+	case service.ModulesAction:
+		err = h.Modules(&c)
 	default:
 		err = h.View(&c)
 	}
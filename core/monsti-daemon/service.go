@@ -17,13 +17,13 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/smtp"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -34,31 +34,47 @@ import (
 	"pkg.monsti.org/monsti/api/service"
 )
 
-type subscription struct {
-}
-
-type emitRet struct {
-	Ret   []byte
-	Error string
-}
-
-type signal struct {
-	Name string
-	Args []byte
-	Ret  chan emitRet
-}
-
 type MonstiService struct {
 	// Services maps service names to service paths
 	Services map[string][]string
 	// Mutex to syncronize data access
-	mutex         sync.RWMutex
-	Settings      *settings
-	Logger        *log.Logger
-	Handler       *nodeHandler
+	mutex    sync.RWMutex
+	Settings *settings
+	Logger   *log.Logger
+	Handler  *nodeHandler
+	// Supervisor runs the modules.
+	Supervisor *moduleSupervisor
+	// Sessions is used to emit signals.
+	Sessions *service.SessionPool
+	// signalMutex synchronizes access to the subscriptions.
+	signalMutex   sync.RWMutex
 	subscriptions map[string][]string
 	subscriber    map[string]chan *signal
-	subscriberRet map[string]chan emitRet
+	// pendingSignals maps tickets of sent signals to the channels
+	// receiving the responses.
+	pendingSignals map[uint64]pendingSignal
+	lastTicket     uint64
+	// timeouts maps subscribers to their number of consecutive
+	// timeouts.
+	timeouts map[string]int
+	// stores maps site names to their node stores.
+	stores      map[string]NodeStore
+	storesMutex sync.Mutex
+	// siteLocks and nodeLocks synchronize writes to the sites' nodes.
+	siteLocks keyedLocks
+	nodeLocks keyedLocks
+	// searchIndexes maps site names to their search indexes.
+	searchIndexes map[string]*searchIndex
+	searchMutex   sync.Mutex
+	// scheduler emits signals when nodes get published or unpublished.
+	scheduler publishScheduler
+	// migrator keeps track of the migrations and outdated sites.
+	migrator migrator
+	// fieldTypes holds the ids of the field types registered by
+	// modules.
+	fieldTypes map[string]bool
+	// pageCache keeps the pages rendered for anonymous visitors.
+	pageCache pageCache
 }
 
 type PublishServiceArgs struct {
@@ -85,16 +101,22 @@ func (i *MonstiService) PublishService(args PublishServiceArgs,
 	return nil
 }
 
+// ModuleInitDone marks the given module as ready.
 func (i *MonstiService) ModuleInitDone(args string, reply *int) error {
-	// TODO Implement me
-	return nil
+	if i.Supervisor == nil {
+		return nil
+	}
+	return i.Supervisor.initDone(args)
 }
 
 func (m *MonstiService) SendMail(mail mimemail.Mail, reply *int) error {
-	if !m.Settings.Mail.Debug {
-		auth := smtp.PlainAuth("", m.Settings.Mail.Username,
-			m.Settings.Mail.Password, strings.Split(m.Settings.Mail.Host, ":")[0])
-		if err := smtp.SendMail(m.Settings.Mail.Host, auth,
+	m.Settings.mutex.RLock()
+	settings := m.Settings.Mail
+	m.Settings.mutex.RUnlock()
+	if !settings.Debug {
+		auth := smtp.PlainAuth("", settings.Username,
+			settings.Password, strings.Split(settings.Host, ":")[0])
+		if err := smtp.SendMail(settings.Host, auth,
 			mail.Sender(), mail.Recipients(), mail.Message()); err != nil {
 			return fmt.Errorf("monsti: Could not send email: %v", err)
 		}
@@ -113,116 +135,130 @@ Subject: %v
 	return nil
 }
 
-type ConnectSignalArgs struct {
-	Id, Signal string
-}
-
-func (m *MonstiService) ConnectSignal(args *ConnectSignalArgs, ret *int) error {
-	if m.subscriptions == nil {
-		m.subscriptions = make(map[string][]string)
-		m.subscriber = make(map[string]chan *signal)
+// emitSignal emits the named signal on behalf of the daemon. See
+// service.MonstiClient.EmitSignal.
+func (i *MonstiService) emitSignal(name string, args,
+	retarg interface{}) error {
+	if i.Sessions == nil {
+		return nil
 	}
-	m.subscriptions[args.Signal] = append(m.subscriptions[args.Signal], args.Id)
-	if _, ok := m.subscriber[args.Id]; !ok {
-		m.subscriber[args.Id] = make(chan *signal)
+	session, err := i.Sessions.New()
+	if err != nil {
+		return fmt.Errorf("Could not get session: %v", err)
 	}
-	return nil
-}
-
-type Receive struct {
-	Name string
-	Args []byte
+	defer i.Sessions.Free(session)
+	return session.Monsti().EmitSignal(name, args, retarg)
 }
 
-func (m *MonstiService) EmitSignal(args *Receive, ret *[][]byte) error {
-	*ret = make([][]byte, len(m.subscriptions[args.Name]))
-	for i, id := range m.subscriptions[args.Name] {
-		retChan := make(chan emitRet)
-		done := false
-		go func() {
-			time.Sleep(time.Second)
-			for !done {
-				time.Sleep(30 * time.Second)
-				m.Logger.Printf(
-					"Waiting for signal response. Signal: %v, Subscriber: %v",
-					args.Name, id)
-			}
-		}()
-		m.subscriber[id] <- &signal{args.Name, args.Args, retChan}
-		emitRet := <-retChan
-		if len(emitRet.Error) > 0 {
-			return fmt.Errorf("Received error as signal response: %v", emitRet.Error)
-		}
-		(*ret)[i] = emitRet.Ret
-		done = true
+// emitNotification emits the named signal without return values and
+// logs any errors.
+func (i *MonstiService) emitNotification(name string, args interface{}) {
+	if err := i.emitSignal(name, args, nil); err != nil {
+		i.Logger.Printf("Could not emit signal %v: %v", name, err)
 	}
-	return nil
 }
 
-type WaitSignalRet struct {
-	Name string
-	Args []byte
+// nodeWritten updates the site's search index, publish schedule and
+// page cache after the given node has been written.
+func (i *MonstiService) nodeWritten(site, nodePath string) {
+	i.updateSearchIndex(site, nodePath)
+	i.scheduleNode(site, nodePath)
+	i.pageCache.invalidate(site)
 }
 
-func (m *MonstiService) WaitSignal(subscriber string, ret *WaitSignalRet) error {
-	signal := <-m.subscriber[subscriber]
-	ret.Name = signal.Name
-	ret.Args = signal.Args
-	if m.subscriberRet == nil {
-		m.subscriberRet = make(map[string]chan emitRet)
+// nodesRemoved updates the site's search index, publish schedule and
+// page cache after the given node and its descendants have been
+// removed.
+//
+// If target is not empty, the nodes have been moved to the target
+// path.
+func (i *MonstiService) nodesRemoved(site, nodePath, target string) {
+	i.removeFromSearchIndex(site, nodePath, target)
+	i.unscheduleTree(site, nodePath, target)
+	i.pageCache.invalidate(site)
+}
+
+// walkNodes calls fn for the given node and each of its descendants
+// with the node's path and JSON document. Paths without a node
+// document are skipped.
+func (i *MonstiService) walkNodes(site, nodePath string,
+	fn func(path string, content []byte) error) error {
+	store, err := i.getStore(site)
+	if err != nil {
+		return err
 	}
-	m.subscriberRet[subscriber] = signal.Ret
-	return nil
-}
-
-type FinishSignalArgs struct {
-	Id  string
-	Err string
-	Ret []byte
-}
-
-func (m *MonstiService) FinishSignal(args *FinishSignalArgs, _ *int) error {
-	m.subscriberRet[args.Id] <- emitRet{args.Ret, args.Err}
-	return nil
-}
-
-// getNode looks up the given node.
-// If no such node exists, return nil.
-// It adds a path attribute with the given path.
-func getNode(root, path string) (node []byte, err error) {
-	node_path := filepath.Join(root, path[1:], "node.json")
-	node, err = ioutil.ReadFile(node_path)
-	if os.IsNotExist(err) {
-		return nil, nil
+	var walk func(nodePath string, content []byte) error
+	walk = func(nodePath string, content []byte) error {
+		if content != nil {
+			if err := fn(nodePath, content); err != nil {
+				return err
+			}
+		}
+		children, err := store.GetChildren(nodePath)
+		if err != nil {
+			return fmt.Errorf("Could not get children of %q: %v", nodePath, err)
+		}
+		for _, child := range children {
+			var data struct{ Path, Type string }
+			if err := json.Unmarshal(child, &data); err != nil {
+				return fmt.Errorf("Could not decode child: %v", err)
+			}
+			if data.Type == "core.Path" {
+				child = nil
+			}
+			if err := walk(data.Path, child); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
+	content, err := store.GetNode(nodePath)
 	if err != nil {
-		return
+		return fmt.Errorf("Could not get node: %v", err)
 	}
-	pathJSON := fmt.Sprintf(`{"Path":%q,`, path)
-	node = bytes.Replace(node, []byte("{"), []byte(pathJSON), 1)
-	return
+	return walk(nodePath, content)
 }
 
-// getChildren looks up child nodes of the given node.
-func getChildren(root, path string) (nodes [][]byte, err error) {
-	files, err := ioutil.ReadDir(filepath.Join(root, path))
+// getStore returns the node store of the given site. Stores are
+// opened on first use.
+func (i *MonstiService) getStore(site string) (NodeStore, error) {
+	i.storesMutex.Lock()
+	defer i.storesMutex.Unlock()
+	if store, ok := i.stores[site]; ok {
+		return store, nil
+	}
+	if _, ok := i.Settings.getSite(site); !ok {
+		return nil, fmt.Errorf("Unknown site %q", site)
+	}
+	settings := i.Settings.getMonsti()
+	store, err := openNodeStore(&settings, site)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("Could not open node store: %v", err)
 	}
-	for _, file := range files {
-		node, _ := getNode(root, filepath.Join(path, file.Name()))
-		if err != nil {
-			return nil, err
-		}
-		if node != nil {
-			nodes = append(nodes, node)
-		} else if file.IsDir() {
-			nodes = append(nodes,
-				[]byte(fmt.Sprintf(`{"Path":%q,"Type":"core.Path"}`,
-					filepath.Join(path, file.Name()))))
-		}
+	if i.stores == nil {
+		i.stores = make(map[string]NodeStore)
 	}
-	return
+	i.stores[site] = store
+	return store, nil
+}
+
+// lockNode locks the given node for writing. Other nodes of the site
+// may be written concurrently. It returns a function to release the
+// lock.
+func (i *MonstiService) lockNode(site, nodePath string) func() {
+	unlockSite := i.siteLocks.rLock(site)
+	unlockNode := i.nodeLocks.lock(site + "\x00" + path.Clean("/"+nodePath))
+	return func() {
+		unlockNode()
+		unlockSite()
+	}
+}
+
+// lockSite locks all nodes of the given site for writing, e.g. to
+// move or remove whole subtrees. It returns a function to release the
+// lock.
+func (i *MonstiService) lockSite(site string) func() {
+	return i.siteLocks.lock(site)
 }
 
 type GetChildrenArgs struct {
@@ -231,9 +267,11 @@ type GetChildrenArgs struct {
 
 func (i *MonstiService) GetChildren(args GetChildrenArgs,
 	reply *[][]byte) error {
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	ret, err := getChildren(site, args.Path)
-	*reply = ret
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
+	}
+	*reply, err = store.GetChildren(args.Path)
 	return err
 }
 
@@ -241,9 +279,11 @@ type GetNodeArgs struct{ Site, Path string }
 
 func (i *MonstiService) GetNode(args *GetNodeDataArgs,
 	reply *[]byte) error {
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	ret, err := getNode(site, args.Path)
-	*reply = ret
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
+	}
+	*reply, err = store.GetNode(args.Path)
 	return err
 }
 
@@ -251,14 +291,23 @@ type GetNodeDataArgs struct{ Site, Path, File string }
 
 func (i *MonstiService) GetNodeData(args *GetNodeDataArgs,
 	reply *[]byte) error {
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	path := filepath.Join(site, args.Path[1:], args.File)
-	ret, err := ioutil.ReadFile(path)
-	if os.IsNotExist(err) {
-		*reply = nil
-		return nil
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
+	}
+	*reply, err = store.GetNodeData(args.Path, args.File)
+	return err
+}
+
+type ListNodeDataArgs struct{ Site, Path string }
+
+func (i *MonstiService) ListNodeData(args *ListNodeDataArgs,
+	reply *[]string) error {
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
 	}
-	*reply = ret
+	*reply, err = store.ListNodeData(args.Path)
 	return err
 }
 
@@ -269,29 +318,131 @@ type WriteNodeDataArgs struct {
 
 func (i *MonstiService) WriteNodeData(args *WriteNodeDataArgs,
 	reply *int) error {
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	path := filepath.Join(site, args.Path[1:], args.File)
-	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if args.File == "node.json" {
+		return i.writeNode(args.Site, args.Path, args.Content, time.Time{})
+	}
+	store, err := i.getStore(args.Site)
 	if err != nil {
-		return fmt.Errorf("Could not create node directory: %v", err)
+		return err
+	}
+	defer i.lockNode(args.Site, args.Path)()
+	if err := store.WriteNodeData(args.Path, args.File,
+		args.Content); err != nil {
+		return err
 	}
-	err = ioutil.WriteFile(path, []byte(args.Content), 0600)
+	i.pruneHistory(store, args.Site, args.Path)
+	return nil
+}
+
+type WriteNodeArgs struct {
+	Site, Path string
+	Node       []byte
+	// Changed is the time of the last change of the node as seen by
+	// the writer. If not zero, the node will only be written if it has
+	// not been changed since.
+	Changed time.Time
+}
+
+func (i *MonstiService) WriteNode(args *WriteNodeArgs, reply *int) error {
+	return i.writeNode(args.Site, args.Path, args.Node, args.Changed)
+}
+
+// writeNode writes the given JSON document of the node after emitting
+// monsti.BeforeWriteNode and emits monsti.NodeWritten afterwards.
+//
+// If changed is not zero, the node will only be written if it has not
+// been changed since.
+func (i *MonstiService) writeNode(site, path string, content []byte,
+	changed time.Time) error {
+	store, err := i.getStore(site)
 	if err != nil {
-		return fmt.Errorf("Could not write node data: %v", err)
+		return err
 	}
+	content, err = i.emitBeforeWriteNode(site, path, content)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		defer i.lockNode(site, path)()
+		if !changed.IsZero() {
+			current, err := store.GetNodeData(path, "node.json")
+			if err != nil {
+				return fmt.Errorf("Could not read node: %v", err)
+			}
+			if current != nil {
+				var node struct{ Changed time.Time }
+				if err := json.Unmarshal(current, &node); err != nil {
+					return fmt.Errorf("Could not decode node: %v", err)
+				}
+				if !node.Changed.Equal(changed) {
+					return service.ErrNodeChanged
+				}
+			}
+		}
+		if err := store.WriteNodeData(path, "node.json", content); err != nil {
+			return err
+		}
+		i.pruneHistory(store, site, path)
+		i.nodeWritten(site, path)
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	i.emitNotification("monsti.NodeWritten",
+		service.NodeWrittenArgs{Site: site, Path: path})
 	return nil
 }
 
+// emitBeforeWriteNode emits the monsti.BeforeWriteNode signal for the
+// given node and returns the node's JSON document as changed by the
+// signal handlers. If a handler rejects the node, it returns a
+// *service.WriteVetoedError.
+//
+// Failing handlers don't prevent the write. Their errors get logged.
+func (i *MonstiService) emitBeforeWriteNode(site, path string,
+	content []byte) ([]byte, error) {
+	var rets []service.BeforeWriteNodeRet
+	if err := i.emitSignal("monsti.BeforeWriteNode",
+		service.BeforeWriteNodeArgs{Site: site, Path: path, Node: content},
+		&rets); err != nil {
+		i.Logger.Printf("Could not emit signal monsti.BeforeWriteNode for %q: %v",
+			path, err)
+	}
+	// If several handlers change the node, the last change wins.
+	for _, ret := range rets {
+		if len(ret.Veto) > 0 {
+			return nil, &service.WriteVetoedError{Reason: ret.Veto}
+		}
+		if len(ret.Node) > 0 {
+			content = ret.Node
+		}
+	}
+	return content, nil
+}
+
 type RemoveNodeArgs struct {
 	Site, Node string
 }
 
 func (i *MonstiService) RemoveNode(args *RemoveNodeArgs, reply *int) error {
-	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	nodePath := filepath.Join(root, args.Node[1:])
-	if err := os.RemoveAll(nodePath); err != nil {
-		return fmt.Errorf("Can't remove node: %v", err)
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		defer i.lockSite(args.Site)()
+		if err := store.RemoveNode(args.Node); err != nil {
+			return err
+		}
+		i.nodesRemoved(args.Site, args.Node, "")
+		return nil
+	}()
+	if err != nil {
+		return err
 	}
+	i.emitNotification("monsti.NodeRemoved",
+		service.NodeRemovedArgs{Site: args.Site, Path: args.Node})
 	return nil
 }
 
@@ -300,16 +451,24 @@ type RenameNodeArgs struct {
 }
 
 func (i *MonstiService) RenameNode(args *RenameNodeArgs, reply *int) error {
-	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	if err := os.MkdirAll(
-		filepath.Dir(filepath.Join(root, args.Target)), 0700); err != nil {
-		return fmt.Errorf("Can't create parent directory: %v", err)
+	store, err := i.getStore(args.Site)
+	if err != nil {
+		return err
 	}
-	if err := os.Rename(
-		filepath.Join(root, args.Source),
-		filepath.Join(root, args.Target)); err != nil {
-		return fmt.Errorf("Can't move node: %v", err)
+	err = func() error {
+		defer i.lockSite(args.Site)()
+		if err := store.RenameNode(args.Source, args.Target); err != nil {
+			return err
+		}
+		i.nodesRemoved(args.Site, args.Source, args.Target)
+		return nil
+	}()
+	if err != nil {
+		return err
 	}
+	i.emitNotification("monsti.NodeRenamed",
+		service.NodeRenamedArgs{Site: args.Site, Source: args.Source,
+			Target: args.Target})
 	return nil
 }
 
@@ -356,7 +515,7 @@ type GetSiteConfigArgs struct{ Site, Name string }
 
 func (i *MonstiService) GetSiteConfig(args *GetSiteConfigArgs,
 	reply *[]byte) error {
-	configPath := i.Settings.Monsti.GetSiteConfigPath(args.Site)
+	configPath := i.Settings.getMonsti().GetSiteConfigPath(args.Site)
 	parts := strings.SplitN(args.Name, ".", 2)
 	module := parts[0]
 	name := parts[1]
@@ -410,7 +569,11 @@ func (m *MonstiService) RegisterNodeType(nodeType *service.NodeType,
 	reply *int) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if _, ok := m.Settings.Config.NodeTypes[nodeType.Id]; ok {
+	if existing, ok := m.Settings.Config.NodeTypes[nodeType.Id]; ok {
+		// Restarted modules register their node types again.
+		if m.sameNodeType(existing, nodeType) {
+			return nil
+		}
 		return fmt.Errorf("Node type with id %v does already exist", nodeType.Id)
 	}
 	if m.Settings.Config.NodeTypes == nil {
@@ -418,6 +581,7 @@ func (m *MonstiService) RegisterNodeType(nodeType *service.NodeType,
 		m.Settings.Config.NodeFields = make(map[string]*service.NodeField)
 	}
 	m.Settings.Config.NodeTypes[nodeType.Id] = nodeType
+	m.pageCache.clear()
 	for i, field := range nodeType.Fields {
 		if existing, ok := m.Settings.Config.NodeFields[field.Id]; ok {
 			nodeType.Fields[i] = existing
@@ -428,6 +592,43 @@ func (m *MonstiService) RegisterNodeType(nodeType *service.NodeType,
 	return nil
 }
 
+// sameNodeType returns true if the registered node type equals the
+// given one with its fields replaced by the registered fields of the
+// same ids.
+func (m *MonstiService) sameNodeType(registered,
+	nodeType *service.NodeType) bool {
+	candidate := *nodeType
+	candidate.Fields = make([]*service.NodeField, len(nodeType.Fields))
+	for i, field := range nodeType.Fields {
+		candidate.Fields[i] = field
+		if existing, ok := m.Settings.Config.NodeFields[field.Id]; ok {
+			candidate.Fields[i] = existing
+		}
+	}
+	return reflect.DeepEqual(registered, &candidate)
+}
+
+func (m *MonstiService) RegisterFieldType(id string, reply *int) error {
+	parts := strings.SplitN(id, ".", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return fmt.Errorf("Field type id %q must be prefixed by a namespace", id)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.fieldTypes == nil {
+		m.fieldTypes = make(map[string]bool)
+	}
+	m.fieldTypes[id] = true
+	return nil
+}
+
+func (m *MonstiService) FieldTypeRegistered(id string, reply *bool) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	*reply = m.fieldTypes[id]
+	return nil
+}
+
 func (i *MonstiService) GetRequest(id uint, req *service.Request) error {
 	if r := i.Handler.GetRequest(id); r != nil {
 		*req = *r
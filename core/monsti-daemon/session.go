@@ -17,12 +17,15 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/base32"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -40,6 +43,7 @@ import (
 
 type loginFormData struct {
 	Login, Password string
+	CSRFToken       string
 }
 
 // Login handles login requests.
@@ -50,6 +54,7 @@ func (h *nodeHandler) Login(c *reqContext) error {
 	form := htmlwidgets.NewForm(&data)
 	form.AddWidget(new(htmlwidgets.TextWidget), "Login", G("Login"), "")
 	form.AddWidget(new(htmlwidgets.PasswordWidget), "Password", G("Password"), "")
+	c.UserSession.AddCSRFWidget(form, &data.CSRFToken)
 
 	switch c.Req.Method {
 	case "GET":
@@ -57,13 +62,19 @@ func (h *nodeHandler) Login(c *reqContext) error {
 		c.Req.ParseForm()
 		if form.Fill(c.Req.Form) {
 			user, err := getUser(data.Login,
-				h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+				h.Settings.getMonsti().GetSiteDataPath(c.Site.Name))
 			if err != nil {
 				return fmt.Errorf("Could not get user: %v", err)
 			}
-			if user != nil && passwordEqual(user.Password, data.Password) {
+			if user != nil && !user.Disabled &&
+				passwordEqual(user.Password, data.Password) {
 				c.Session.Values["login"] = user.Login
 				c.Session.Save(c.Req, c.Res)
+				if err := c.Serv.Monsti().EmitSignal("monsti.UserLoggedIn",
+					service.UserLoggedInArgs{Site: c.Site.Name, Login: user.Login},
+					nil); err != nil {
+					h.Log.Printf("Could not emit signal: %v", err)
+				}
 				http.Redirect(c.Res, c.Req, c.Node.Path, http.StatusSeeOther)
 				return nil
 			}
@@ -75,7 +86,7 @@ func (h *nodeHandler) Login(c *reqContext) error {
 	data.Password = ""
 	body, err := h.Renderer.Render("actions/loginform", template.Context{
 		"Form": form.RenderData()}, c.UserSession.Locale,
-		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
 	if err != nil {
 		return fmt.Errorf("Can't render login form: %v", err)
 	}
@@ -95,8 +106,38 @@ func (h *nodeHandler) Logout(c *reqContext) error {
 	return nil
 }
 
+// sendPasswordTokenMail sends the user a mail with a link to change
+// the password.
+func (h *nodeHandler) sendPasswordTokenMail(c *reqContext,
+	user *service.User) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	site := *c.Site
+	link := getRequestPasswordToken(c.Site.Name, user.Login,
+		site.PasswordTokenKey)
+	mail := mimemail.Mail{
+		From:    mimemail.Address{site.EmailName, site.EmailAddress},
+		Subject: G("Password request"),
+		Body: []byte(fmt.Sprintf(`Hello,
+
+someone, possibly you, requested a new password for your account %v at
+"%v".
+
+To change your password, visit the following link within 24 hours.
+If you did not request a new password, you may ignore this email.
+%v
+
+This is an automatically generated email. Please don't reply to it.
+`, user.Login, site.Title, site.BaseURL+"/@@change-password?token="+link))}
+	mail.To = []mimemail.Address{mimemail.Address{user.Login, user.Email}}
+	if err := c.Serv.Monsti().SendMail(&mail); err != nil {
+		return fmt.Errorf("Could not send mail: %v", err)
+	}
+	return nil
+}
+
 type requestPasswordTokenFormData struct {
-	User string
+	User      string
+	CSRFToken string
 }
 
 // RequestPasswordToken sends the user a token to be able to change
@@ -106,6 +147,7 @@ func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 	data := requestPasswordTokenFormData{}
 	form := htmlwidgets.NewForm(&data)
 	form.AddWidget(new(htmlwidgets.TextWidget), "User", G("Login"), "")
+	c.UserSession.AddCSRFWidget(form, &data.CSRFToken)
 
 	sent := false
 	c.Req.ParseForm()
@@ -117,32 +159,13 @@ func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 	case "POST":
 		if form.Fill(c.Req.Form) {
 			user, err := getUser(data.User,
-				h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+				h.Settings.getMonsti().GetSiteDataPath(c.Site.Name))
 			if err != nil {
 				return fmt.Errorf("Could not get user: %v", err)
 			}
-			if user != nil {
-				site := h.Settings.Monsti.Sites[c.Site.Name]
-				link := getRequestPasswordToken(c.Site.Name, data.User,
-					site.PasswordTokenKey)
-				mail := mimemail.Mail{
-					From:    mimemail.Address{site.EmailName, site.EmailAddress},
-					Subject: G("Password request"),
-					Body: []byte(fmt.Sprintf(`Hello,
-
-someone, possibly you, requested a new password for your account %v at
-"%v".
-
-To change your password, visit the following link within 24 hours.
-If you did not request a new password, you may ignore this email.
-%v
-
-This is an automatically generated email. Please don't reply to it.
-`, data.User, site.Title, site.BaseURL+"/@@change-password?token="+link))}
-				mail.To = []mimemail.Address{mimemail.Address{user.Login, user.Email}}
-				err := c.Serv.Monsti().SendMail(&mail)
-				if err != nil {
-					return fmt.Errorf("Could not send mail: %v", err)
+			if user != nil && !user.Disabled {
+				if err := h.sendPasswordTokenMail(c, user); err != nil {
+					return fmt.Errorf("Could not send password token: %v", err)
 				}
 				http.Redirect(c.Res, c.Req, "@@request-password-token?sent",
 					http.StatusSeeOther)
@@ -159,7 +182,7 @@ This is an automatically generated email. Please don't reply to it.
 		template.Context{
 			"Sent": sent,
 			"Form": form.RenderData()}, c.UserSession.Locale,
-		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
 	if err != nil {
 		return fmt.Errorf("Can't render login form: %v", err)
 	}
@@ -175,6 +198,7 @@ This is an automatically generated email. Please don't reply to it.
 
 type changePasswordFormData struct {
 	OldPassword, Password string
+	CSRFToken             string
 }
 
 // ChangePassword allows to change the user's password.
@@ -191,6 +215,7 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 		VerifyLabel: G("Please repeat the password."),
 		VerifyError: G("Passwords do not match."),
 	}, "Password", G("New Password"), "")
+	c.UserSession.AddCSRFWidget(form, &data.CSRFToken)
 	var token string
 	tokenInvalid := false
 	c.Req.ParseForm()
@@ -204,7 +229,11 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 			return nil
 		}
 		getUserFn := func(login string) (*service.User, error) {
-			return getUser(login, h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+			user, err := getUser(login, h.Settings.getMonsti().GetSiteDataPath(c.Site.Name))
+			if err != nil || user == nil || user.Disabled {
+				return nil, err
+			}
+			return user, nil
 		}
 		var err error
 		user, err = verifyRequestPasswordToken(
@@ -242,7 +271,7 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 					}
 					user.PasswordChanged = time.Now().UTC()
 					user.Password = string(hashed)
-					err = writeUser(user, h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+					err = writeUser(user, h.Settings.getMonsti().GetSiteDataPath(c.Site.Name))
 					if err != nil {
 						return fmt.Errorf("Could not change user password: %v", err)
 					}
@@ -261,7 +290,7 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 			"TokenInvalid": tokenInvalid,
 			"Changed":      changed,
 			"Form":         form.RenderData()}, c.UserSession.Locale,
-		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
 	if err != nil {
 		return fmt.Errorf("Can't render ChangePassword form: %v", err)
 	}
@@ -286,6 +315,23 @@ func getSession(r *http.Request, site util.SiteSettings) (
 	return session, nil
 }
 
+// getCSRFToken returns the CSRF token of the given session. If the
+// session does not have a token yet, a new one will be generated and
+// created will be true.
+func getCSRFToken(session *sessions.Session) (
+	token string, created bool, err error) {
+	if token, ok := session.Values["csrf-token"].(string); ok && len(token) > 0 {
+		return token, false, nil
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", false, fmt.Errorf("Could not generate token: %v", err)
+	}
+	token = base64.URLEncoding.EncodeToString(random)
+	session.Values["csrf-token"] = token
+	return token, true, nil
+}
+
 // getClientSession returns the client session for the given session.
 //
 // configDir is the site's configuration directory.
@@ -306,7 +352,7 @@ func getClientSession(session *sessions.Session,
 		err = fmt.Errorf("Could not get user: %v", err)
 		return
 	}
-	if user == nil {
+	if user == nil || user.Disabled {
 		delete(session.Values, "login")
 		return
 	}
@@ -325,9 +371,32 @@ func getUserDatabase(dataDir string) (map[string]service.User, error) {
 	if err = json.Unmarshal(content, &users); err != nil {
 		return nil, fmt.Errorf("Could not unmarshal user database: %v", err)
 	}
+	// Users written before roles existed don't have a roles field at
+	// all. They are administrators.
+	var fields map[string]map[string]json.RawMessage
+	if err = json.Unmarshal(content, &fields); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal user database: %v", err)
+	}
+	for login, user := range users {
+		if !hasRolesField(fields[login]) {
+			user.Roles = []string{service.RoleAdmin}
+			users[login] = user
+		}
+	}
 	return users, nil
 }
 
+// hasRolesField returns true if the given user database entry has a
+// roles field.
+func hasRolesField(fields map[string]json.RawMessage) bool {
+	for name := range fields {
+		if strings.EqualFold(name, "roles") {
+			return true
+		}
+	}
+	return false
+}
+
 // writeUserDatabase writes the given user database to the given site
 // data directory.
 func writeUserDatabase(users map[string]service.User, dataDir string) error {
@@ -336,12 +405,16 @@ func writeUserDatabase(users map[string]service.User, dataDir string) error {
 	if err != nil {
 		return fmt.Errorf("Could not marshal user database: %v", err)
 	}
-	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+	if err = writeFileAtomic(path, content, 0600); err != nil {
 		return fmt.Errorf("Could not write user database: %v", err)
 	}
 	return nil
 }
 
+// userDatabaseLocks synchronizes writes to the user databases. Keys
+// are the sites' data directories.
+var userDatabaseLocks keyedLocks
+
 // getUser returns the user with the given login. If there is no such
 // user, returns nil.
 func getUser(login_, dataDir string) (*service.User, error) {
@@ -356,34 +429,64 @@ func getUser(login_, dataDir string) (*service.User, error) {
 	return nil, nil
 }
 
+// getUsers returns all users of the user database ordered by their
+// logins.
+func getUsers(dataDir string) ([]service.User, error) {
+	users, err := getUserDatabase(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get user database: %v", err)
+	}
+	logins := make([]string, 0, len(users))
+	for login := range users {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	ret := make([]service.User, 0, len(users))
+	for _, login := range logins {
+		user := users[login]
+		user.Login = login
+		ret = append(ret, user)
+	}
+	return ret, nil
+}
+
 // writeUser saves the given user in the user database.
 //
-// An existing entry for the given user login will be overwritten.
+// An existing entry for the given user login will be overwritten. If
+// the password of the given user is empty, the stored password will be
+// kept.
 func writeUser(user *service.User, dataDir string) error {
+	unlock := userDatabaseLocks.lock(dataDir)
+	defer unlock()
 	users, err := getUserDatabase(dataDir)
 	if err != nil {
 		return fmt.Errorf("Could not get user database: %v", err)
 	}
-	users[user.Login] = *user
+	stored := *user
+	if len(stored.Password) == 0 {
+		stored.Password = users[user.Login].Password
+	}
+	users[user.Login] = stored
 	if err = writeUserDatabase(users, dataDir); err != nil {
 		return fmt.Errorf("Could not write user database: %v", err)
 	}
 	return nil
 }
 
-// checkPermission checks if the session's user might perform the given action.
-func checkPermission(action service.Action, session *service.UserSession) bool {
-	auth := session.User != nil
-	switch action {
-	case service.RemoveAction, service.EditAction, service.AddAction,
-		service.LogoutAction:
-		if auth {
-			return true
-		}
-	default:
-		return true
+// removeUser removes the user with the given login from the user
+// database.
+func removeUser(login, dataDir string) error {
+	unlock := userDatabaseLocks.lock(dataDir)
+	defer unlock()
+	users, err := getUserDatabase(dataDir)
+	if err != nil {
+		return fmt.Errorf("Could not get user database: %v", err)
 	}
-	return false
+	delete(users, login)
+	if err = writeUserDatabase(users, dataDir); err != nil {
+		return fmt.Errorf("Could not write user database: %v", err)
+	}
+	return nil
 }
 
 // passwordEqual returns true iff the hash matches the password.
@@ -429,6 +532,9 @@ func verifyRequestPasswordToken(site string,
 	if err != nil {
 		return nil, fmt.Errorf("Could not get user: %v", err)
 	}
+	if user == nil {
+		return nil, nil
+	}
 	timeSubstring := parts[userPartsCount]
 	generated, err := strconv.Atoi(timeSubstring)
 	if err != nil || int64(generated) < user.PasswordChanged.Unix() {
@@ -28,34 +28,6 @@ import (
 	utesting "pkg.monsti.org/monsti/api/util/testing"
 )
 
-func TestCheckPermission(t *testing.T) {
-	tests := []struct {
-		Action      service.Action
-		Auth, Grant bool
-	}{
-		{service.LoginAction, false, true},
-		{service.LoginAction, true, true},
-		{service.LogoutAction, false, false},
-		{service.LogoutAction, true, true},
-		{service.EditAction, false, false},
-		{service.EditAction, true, true},
-		{service.AddAction, false, false},
-		{service.AddAction, true, true},
-		{service.RemoveAction, false, false},
-		{service.RemoveAction, true, true}}
-	for _, v := range tests {
-		var user *service.User
-		if v.Auth {
-			user = &service.User{}
-		}
-		ret := checkPermission(v.Action, &service.UserSession{User: user})
-		if ret != v.Grant {
-			t.Errorf("checkPermission(%v, %v) = %v, expected %v", v.Action,
-				user, ret, v.Grant)
-		}
-	}
-}
-
 func TestGetUser(t *testing.T) {
 	root, err := ioutil.TempDir("", "_monsti_get_user")
 	if err != nil {
@@ -63,7 +35,9 @@ func TestGetUser(t *testing.T) {
 	}
 	db := []byte(`{
 "foo":{"name":"Mr. Foo","password":"the pass","email":"foo@example.com"},
-"bar":{"name":"Mrs. Bar","email":"bar@example.com","password":"other pass"}}
+"bar":{"name":"Mrs. Bar","email":"bar@example.com","password":"other pass",
+"roles":["editor"]},
+"baz":{"name":"Mr. Baz","password":"baz pass","roles":null}}
 `)
 	if err = ioutil.WriteFile(filepath.Join(root, "users.json"),
 		db, 0600); err != nil {
@@ -75,9 +49,13 @@ func TestGetUser(t *testing.T) {
 	}{
 		{Login: "unknown", User: nil},
 		{Login: "foo", User: &service.User{Login: "foo", Password: "the pass",
-			Name: "Mr. Foo", Email: "foo@example.com"}},
+			Name: "Mr. Foo", Email: "foo@example.com",
+			Roles: []string{"admin"}}},
 		{Login: "bar", User: &service.User{Login: "bar", Password: "other pass",
-			Name: "Mrs. Bar", Email: "bar@example.com"}}}
+			Name: "Mrs. Bar", Email: "bar@example.com",
+			Roles: []string{"editor"}}},
+		{Login: "baz", User: &service.User{Login: "baz", Password: "baz pass",
+			Name: "Mr. Baz"}}}
 	for _, v := range tests {
 		user, err := getUser(v.Login, root)
 		if !reflect.DeepEqual(user, v.User) || err != nil {
@@ -87,11 +65,11 @@ func TestGetUser(t *testing.T) {
 	}
 }
 
-func WriteUser(t *testing.T) {
+func TestWriteUser(t *testing.T) {
 	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
 		"/users.json": `{"foo":{"password":"the pass"}}`}, "TestWriteUser")
 	if err != nil {
-		t.Fatalf("Could not create directory tree: ", err)
+		t.Fatalf("Could not create directory tree: %v", err)
 	}
 	defer cleanup()
 	user := service.User{Login: "foo", Password: "new pass"}
@@ -104,11 +82,37 @@ func WriteUser(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Error reading changed user: %v", err)
 	}
-	if *userChanged != user {
+	if !reflect.DeepEqual(*userChanged, user) {
 		t.Errorf("Users differ: %v\n %v", user, userChanged)
 	}
 }
 
+func TestManageUsers(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/users.json": `{
+"foo":{"name":"Mr. Foo","password":"the pass","email":"foo@example.com"},
+"bar":{"name":"Mrs. Bar","email":"bar@example.com","password":"other pass"}}`},
+		"TestManageUsers")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	err = writeUser(&service.User{Login: "foo", Name: "Mr. Foo",
+		Roles: []string{"editor"}}, root)
+	if err != nil {
+		t.Fatalf("writeUser returned error: %v", err)
+	}
+	if err = removeUser("bar", root); err != nil {
+		t.Fatalf("removeUser returned error: %v", err)
+	}
+	users, err := getUsers(root)
+	expected := []service.User{{Login: "foo", Name: "Mr. Foo",
+		Password: "the pass", Roles: []string{"editor"}}}
+	if err != nil || !reflect.DeepEqual(users, expected) {
+		t.Errorf("getUsers(_) = %v, %v, should be %v, nil", users, err, expected)
+	}
+}
+
 func TestPasswordEqual(t *testing.T) {
 	if !passwordEqual(
 		"$2a$10$1x90nccptYh/OtXQiFaom.xCisdPD7qCMoEcJa41XEnewk3NdMfGq",
@@ -0,0 +1,275 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSignalTimeout is the time in seconds to wait for a
+// subscriber to handle a signal if no timeout has been configured.
+const defaultSignalTimeout = 10
+
+// defaultMaxSignalTimeouts is the number of consecutive timeouts after
+// which a subscriber is considered unhealthy if no other number has
+// been configured.
+const defaultMaxSignalTimeouts = 3
+
+type emitRet struct {
+	Ret   []byte
+	Error string
+}
+
+type signal struct {
+	// Ticket identifies the signal sent to a subscriber.
+	Ticket uint64
+	Name   string
+	Args   []byte
+	// Ret receives the subscriber's response. It is buffered so that
+	// late responses don't block.
+	Ret chan emitRet
+}
+
+// pendingSignal is a signal waiting for the subscriber's response.
+type pendingSignal struct {
+	Subscriber string
+	Ret        chan emitRet
+}
+
+// SignalRet is the response of a subscriber to an emitted signal.
+type SignalRet struct {
+	// Subscriber is the id of the subscriber.
+	Subscriber string
+	// Ret is the encoded return value of the subscriber.
+	Ret []byte
+	// Err holds the error message if the subscriber failed to handle
+	// the signal or timed out.
+	Err string
+}
+
+type ConnectSignalArgs struct {
+	Id, Signal string
+}
+
+func (m *MonstiService) ConnectSignal(args *ConnectSignalArgs, ret *int) error {
+	m.signalMutex.Lock()
+	defer m.signalMutex.Unlock()
+	if m.subscriptions == nil {
+		m.subscriptions = make(map[string][]string)
+		m.subscriber = make(map[string]chan *signal)
+	}
+	m.subscriptions[args.Signal] = append(m.subscriptions[args.Signal], args.Id)
+	if _, ok := m.subscriber[args.Id]; !ok {
+		m.subscriber[args.Id] = make(chan *signal)
+	}
+	return nil
+}
+
+// disconnectProcess removes the subscriptions of all connections of
+// the process with the given id.
+func (m *MonstiService) disconnectProcess(pid int) {
+	prefix := fmt.Sprintf("%v#", pid)
+	m.signalMutex.Lock()
+	defer m.signalMutex.Unlock()
+	for name, subscribers := range m.subscriptions {
+		remaining := subscribers[:0]
+		for _, id := range subscribers {
+			if !strings.HasPrefix(id, prefix) {
+				remaining = append(remaining, id)
+			}
+		}
+		m.subscriptions[name] = remaining
+	}
+	for id := range m.subscriber {
+		if strings.HasPrefix(id, prefix) {
+			delete(m.subscriber, id)
+			delete(m.timeouts, id)
+		}
+	}
+}
+
+type Receive struct {
+	Name string
+	Args []byte
+}
+
+// signalTimeout returns the time to wait for a subscriber to handle
+// the named signal.
+func (m *MonstiService) signalTimeout(name string) time.Duration {
+	m.Settings.mutex.RLock()
+	defer m.Settings.mutex.RUnlock()
+	timeout := m.Settings.Signals.Timeout
+	if specific, ok := m.Settings.Signals.Timeouts[name]; ok {
+		timeout = specific
+	}
+	if timeout <= 0 {
+		timeout = defaultSignalTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// isHealthy returns false if the subscriber timed out too often.
+func (m *MonstiService) isHealthy(subscriber string) bool {
+	m.Settings.mutex.RLock()
+	max := m.Settings.Signals.MaxTimeouts
+	m.Settings.mutex.RUnlock()
+	if max <= 0 {
+		max = defaultMaxSignalTimeouts
+	}
+	m.signalMutex.RLock()
+	defer m.signalMutex.RUnlock()
+	return m.timeouts[subscriber] < max
+}
+
+// setTimedOut records a timeout of the subscriber or resets its
+// number of timeouts.
+func (m *MonstiService) setTimedOut(subscriber string, timedOut bool) {
+	m.signalMutex.Lock()
+	defer m.signalMutex.Unlock()
+	if !timedOut {
+		delete(m.timeouts, subscriber)
+		return
+	}
+	if m.timeouts == nil {
+		m.timeouts = make(map[string]int)
+	}
+	m.timeouts[subscriber] += 1
+}
+
+// sendSignal sends the signal to the subscriber and waits for the
+// response until the timeout is reached.
+func (m *MonstiService) sendSignal(subscriber string, args *Receive,
+	timeout time.Duration) SignalRet {
+	ret := SignalRet{Subscriber: subscriber}
+	if !m.isHealthy(subscriber) {
+		ret.Err = "Subscriber is unhealthy"
+		return ret
+	}
+	retChan := make(chan emitRet, 1)
+	m.signalMutex.Lock()
+	signalChan := m.subscriber[subscriber]
+	if m.pendingSignals == nil {
+		m.pendingSignals = make(map[uint64]pendingSignal)
+	}
+	m.lastTicket += 1
+	ticket := m.lastTicket
+	m.pendingSignals[ticket] = pendingSignal{subscriber, retChan}
+	m.signalMutex.Unlock()
+	defer func() {
+		m.signalMutex.Lock()
+		delete(m.pendingSignals, ticket)
+		m.signalMutex.Unlock()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case signalChan <- &signal{ticket, args.Name, args.Args, retChan}:
+	case <-timer.C:
+		ret.Err = "Timed out waiting for subscriber"
+		m.setTimedOut(subscriber, true)
+		return ret
+	}
+	select {
+	case emitRet := <-retChan:
+		ret.Ret, ret.Err = emitRet.Ret, emitRet.Error
+		m.setTimedOut(subscriber, false)
+	case <-timer.C:
+		ret.Err = "Timed out waiting for response"
+		m.setTimedOut(subscriber, true)
+	}
+	return ret
+}
+
+// EmitSignal sends the signal to all subscribers in parallel and
+// returns their responses. Subscribers which fail or time out get
+// reported in the response's Err field.
+func (m *MonstiService) EmitSignal(args *Receive, ret *[]SignalRet) error {
+	m.signalMutex.RLock()
+	subscribers := append([]string(nil), m.subscriptions[args.Name]...)
+	m.signalMutex.RUnlock()
+	timeout := m.signalTimeout(args.Name)
+	*ret = make([]SignalRet, len(subscribers))
+	var waitGroup sync.WaitGroup
+	for i, id := range subscribers {
+		waitGroup.Add(1)
+		go func(i int, id string) {
+			defer waitGroup.Done()
+			(*ret)[i] = m.sendSignal(id, args, timeout)
+			if len((*ret)[i].Err) > 0 {
+				m.Logger.Printf("Subscriber %v could not handle signal %v: %v",
+					id, args.Name, (*ret)[i].Err)
+			}
+		}(i, id)
+	}
+	waitGroup.Wait()
+	return nil
+}
+
+type WaitSignalRet struct {
+	// Ticket must be passed to FinishSignal.
+	Ticket uint64
+	Name   string
+	Args   []byte
+}
+
+// WaitSignal waits for the next signal sent to the subscriber.
+//
+// Several connections may wait for signals of the same subscriber in
+// parallel. Each signal is received by only one of them.
+func (m *MonstiService) WaitSignal(subscriber string, ret *WaitSignalRet) error {
+	m.signalMutex.RLock()
+	signalChan := m.subscriber[subscriber]
+	m.signalMutex.RUnlock()
+	// The subscriber is responsive again.
+	m.setTimedOut(subscriber, false)
+	signal := <-signalChan
+	ret.Ticket = signal.Ticket
+	ret.Name = signal.Name
+	ret.Args = signal.Args
+	return nil
+}
+
+type FinishSignalArgs struct {
+	Id     string
+	Ticket uint64
+	Err    string
+	Ret    []byte
+}
+
+// FinishSignal returns the subscriber's response to the signal with
+// the given ticket.
+func (m *MonstiService) FinishSignal(args *FinishSignalArgs, _ *int) error {
+	m.signalMutex.Lock()
+	pending, ok := m.pendingSignals[args.Ticket]
+	if ok && pending.Subscriber == args.Id {
+		delete(m.pendingSignals, args.Ticket)
+	}
+	m.signalMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("No pending signal %v for subscriber %v (timed out?)",
+			args.Ticket, args.Id)
+	}
+	if pending.Subscriber != args.Id {
+		return fmt.Errorf("Signal %v has not been sent to subscriber %v",
+			args.Ticket, args.Id)
+	}
+	pending.Ret <- emitRet{args.Ret, args.Err}
+	return nil
+}
@@ -0,0 +1,136 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmitSignal(t *testing.T) {
+	m := &MonstiService{
+		Settings: &settings{},
+		Logger:   log.New(ioutil.Discard, "", 0),
+	}
+	m.Settings.Signals.Timeout = 1
+	m.Settings.Signals.MaxTimeouts = 1
+	for _, id := range []string{"fast", "failing", "slow"} {
+		if err := m.ConnectSignal(&ConnectSignalArgs{id, "foo"}, nil); err != nil {
+			t.Fatalf("Could not connect signal: %v", err)
+		}
+	}
+	handle := func(id, err string, ret []byte) {
+		var signal WaitSignalRet
+		if err := m.WaitSignal(id, &signal); err != nil {
+			t.Errorf("WaitSignal returned error: %v", err)
+			return
+		}
+		if err := m.FinishSignal(
+			&FinishSignalArgs{id, signal.Ticket, err, ret}, nil); err != nil {
+			t.Errorf("FinishSignal returned error: %v", err)
+		}
+	}
+	go handle("fast", "", []byte("ret"))
+	go handle("failing", "failed", nil)
+	var ret []SignalRet
+	start := time.Now()
+	if err := m.EmitSignal(&Receive{"foo", nil}, &ret); err != nil {
+		t.Fatalf("EmitSignal returned error: %v", err)
+	}
+	if len(ret) != 3 {
+		t.Fatalf("EmitSignal returned %v responses, should be 3", len(ret))
+	}
+	if ret[0].Subscriber != "fast" || string(ret[0].Ret) != "ret" ||
+		ret[0].Err != "" {
+		t.Errorf("Response of fast subscriber is %v", ret[0])
+	}
+	if ret[1].Subscriber != "failing" || ret[1].Err != "failed" {
+		t.Errorf("Response of failing subscriber is %v", ret[1])
+	}
+	if ret[2].Subscriber != "slow" || ret[2].Err == "" {
+		t.Errorf("Response of slow subscriber is %v", ret[2])
+	}
+	if m.isHealthy("slow") {
+		t.Errorf("Slow subscriber should be unhealthy")
+	}
+	// The slow subscriber should be skipped now.
+	go handle("fast", "", nil)
+	go handle("failing", "", nil)
+	if err := m.EmitSignal(&Receive{"foo", nil}, &ret); err != nil {
+		t.Fatalf("EmitSignal returned error: %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("EmitSignal should not wait for unhealthy subscribers")
+	}
+	if ret[2].Err != "Subscriber is unhealthy" {
+		t.Errorf("Response of unhealthy subscriber is %v", ret[2])
+	}
+}
+
+func TestEmitSignalWorkers(t *testing.T) {
+	m := &MonstiService{
+		Settings: &settings{},
+		Logger:   log.New(ioutil.Discard, "", 0),
+	}
+	if err := m.ConnectSignal(&ConnectSignalArgs{"pool", "foo"}, nil); err != nil {
+		t.Fatalf("Could not connect signal: %v", err)
+	}
+	// Two workers receive a signal each before any of them responds.
+	var received sync.WaitGroup
+	received.Add(2)
+	worker := func() {
+		var signal WaitSignalRet
+		if err := m.WaitSignal("pool", &signal); err != nil {
+			t.Errorf("WaitSignal returned error: %v", err)
+			return
+		}
+		received.Done()
+		received.Wait()
+		if err := m.FinishSignal(&FinishSignalArgs{"other", signal.Ticket, "",
+			nil}, nil); err == nil {
+			t.Errorf("FinishSignal should fail for other subscribers")
+		}
+		if err := m.FinishSignal(&FinishSignalArgs{"pool", signal.Ticket, "",
+			signal.Args}, nil); err != nil {
+			t.Errorf("FinishSignal returned error: %v", err)
+		}
+	}
+	go worker()
+	go worker()
+	var emitted sync.WaitGroup
+	for _, arg := range []string{"a", "b"} {
+		emitted.Add(1)
+		go func(arg string) {
+			defer emitted.Done()
+			var ret []SignalRet
+			if err := m.EmitSignal(&Receive{"foo", []byte(arg)}, &ret); err != nil {
+				t.Errorf("EmitSignal returned error: %v", err)
+				return
+			}
+			if len(ret) != 1 || string(ret[0].Ret) != arg || ret[0].Err != "" {
+				t.Errorf("EmitSignal(%q) returned %v", arg, ret)
+			}
+		}(arg)
+	}
+	emitted.Wait()
+	if len(m.pendingSignals) != 0 {
+		t.Errorf("There should be no pending signals left: %v", m.pendingSignals)
+	}
+}
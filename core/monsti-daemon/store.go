@@ -0,0 +1,287 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// NodeStore stores the nodes of a site.
+//
+// Node paths are absolute, e.g. "/foo/bar". Nodes are stored as JSON
+// documents in the data file "node.json". Other data files of the
+// node, e.g. uploaded files, are stored next to it.
+type NodeStore interface {
+	// GetNode returns the JSON document of the given node with an added
+	// Path attribute. If the node does not exist, it returns nil, nil.
+	GetNode(path string) ([]byte, error)
+	// GetChildren returns the JSON documents of the node's
+	// children. Children without a document but with children of their
+	// own are returned as core.Path nodes.
+	GetChildren(path string) ([][]byte, error)
+	// GetNodeData returns the content of the given data file of the
+	// node. If the file does not exist, it returns nil, nil.
+	GetNodeData(path, file string) ([]byte, error)
+	// WriteNodeData writes the given data file of the node. If the file
+	// belongs to the node's revisions, the node will be archived
+	// before.
+	WriteNodeData(path, file string, content []byte) error
+	// RemoveNode removes the node, its data and all its descendants.
+	RemoveNode(path string) error
+	// RenameNode moves the node, its data and all its descendants.
+	RenameNode(source, target string) error
+	// GetNodeRevisions returns the archived revisions of the node,
+	// newest first.
+	GetNodeRevisions(path string) ([]service.NodeRevision, error)
+	// GetNodeRevisionData returns the content of the given data file of
+	// an archived revision. If it does not exist, it returns nil, nil.
+	GetNodeRevisionData(path string, number int, file string) ([]byte, error)
+	// RestoreNodeRevision replaces the node's data with the data of an
+	// archived revision.
+	RestoreNodeRevision(path string, number int) error
+	// PruneNodeRevisions removes the oldest revisions of the node
+	// exceeding the given number of revisions. If max is not positive,
+	// all revisions are kept.
+	PruneNodeRevisions(path string, max int) error
+	// ListNodeData returns the names of the node's data files which
+	// are accessible to clients, i.e. without node.json and internal
+	// files like the node's history. See isDataFileAccessible.
+	ListNodeData(path string) ([]string, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// nodeDataStore provides the primitive data file operations used to
+// implement the node history on top of a store.
+type nodeDataStore interface {
+	// readData returns the content of the given file below the node's
+	// data directory. If the file does not exist, it returns nil, nil.
+	readData(path, file string) ([]byte, error)
+	// writeData writes the given file below the node's data directory.
+	writeData(path, file string, content []byte) error
+	// removeData removes the given file below the node's data directory.
+	removeData(path, file string) error
+	// listData returns the names of the files and directories in the
+	// given directory below the node's data directory.
+	listData(path, dir string) ([]string, error)
+}
+
+// openNodeStore opens the node store configured for the given site.
+func openNodeStore(settings *util.MonstiSettings, site string) (
+	NodeStore, error) {
+	storage := settings.Sites[site].Storage
+	switch storage.Type {
+	case "", "filesystem":
+		return &fsNodeStore{settings.GetSiteNodesPath(site)}, nil
+	case "bolt":
+		path := storage.Path
+		if len(path) == 0 {
+			path = "nodes.db"
+		}
+		util.MakeAbsolute(&path, settings.GetSiteDataPath(site))
+		backend, err := openBoltBackend(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open bolt database: %v", err)
+		}
+		return &kvNodeStore{backend}, nil
+	case "memory":
+		return &kvNodeStore{newMemoryBackend()}, nil
+	}
+	return nil, fmt.Errorf("Unknown storage type %q", storage.Type)
+}
+
+// addNodePath adds the Path attribute to the given JSON document of a
+// node.
+func addNodePath(node []byte, path string) []byte {
+	pathJSON := fmt.Sprintf(`{"Path":%q,`, path)
+	return bytes.Replace(node, []byte("{"), []byte(pathJSON), 1)
+}
+
+// fsNodeStore stores nodes in a directory tree. Each node is
+// represented by a directory containing the node's data files.
+type fsNodeStore struct {
+	// Root is the path to the directory of the root node.
+	Root string
+}
+
+// getNode looks up the given node.
+// If no such node exists, return nil.
+// It adds a path attribute with the given path.
+func getNode(root, path string) (node []byte, err error) {
+	node_path := filepath.Join(root, path[1:], "node.json")
+	node, err = ioutil.ReadFile(node_path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	node = addNodePath(node, path)
+	return
+}
+
+// getChildren looks up child nodes of the given node.
+func getChildren(root, path string) (nodes [][]byte, err error) {
+	files, err := ioutil.ReadDir(filepath.Join(root, path))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "__") {
+			continue
+		}
+		node, _ := getNode(root, filepath.Join(path, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			nodes = append(nodes, node)
+		} else if file.IsDir() {
+			nodes = append(nodes,
+				[]byte(fmt.Sprintf(`{"Path":%q,"Type":"core.Path"}`,
+					filepath.Join(path, file.Name()))))
+		}
+	}
+	return
+}
+
+func (s *fsNodeStore) GetNode(path string) ([]byte, error) {
+	return getNode(s.Root, path)
+}
+
+func (s *fsNodeStore) GetChildren(path string) ([][]byte, error) {
+	return getChildren(s.Root, path)
+}
+
+func (s *fsNodeStore) GetNodeData(path, file string) ([]byte, error) {
+	return s.readData(path, file)
+}
+
+func (s *fsNodeStore) WriteNodeData(path, file string, content []byte) error {
+	if err := os.MkdirAll(filepath.Join(s.Root, path[1:]), 0700); err != nil {
+		return fmt.Errorf("Could not create node directory: %v", err)
+	}
+	if err := archiveNodeData(s, path, file); err != nil {
+		return fmt.Errorf("Could not archive node: %v", err)
+	}
+	if err := s.writeData(path, file, content); err != nil {
+		return fmt.Errorf("Could not write node data: %v", err)
+	}
+	return nil
+}
+
+func (s *fsNodeStore) RemoveNode(path string) error {
+	if err := os.RemoveAll(filepath.Join(s.Root, path[1:])); err != nil {
+		return fmt.Errorf("Can't remove node: %v", err)
+	}
+	return nil
+}
+
+func (s *fsNodeStore) RenameNode(source, target string) error {
+	if err := os.MkdirAll(
+		filepath.Dir(filepath.Join(s.Root, target)), 0700); err != nil {
+		return fmt.Errorf("Can't create parent directory: %v", err)
+	}
+	if err := os.Rename(
+		filepath.Join(s.Root, source),
+		filepath.Join(s.Root, target)); err != nil {
+		return fmt.Errorf("Can't move node: %v", err)
+	}
+	return nil
+}
+
+func (s *fsNodeStore) GetNodeRevisions(path string) (
+	[]service.NodeRevision, error) {
+	return getNodeRevisions(s, path)
+}
+
+func (s *fsNodeStore) GetNodeRevisionData(path string, number int,
+	file string) ([]byte, error) {
+	return getNodeRevisionData(s, path, number, file)
+}
+
+func (s *fsNodeStore) RestoreNodeRevision(path string, number int) error {
+	return restoreNodeRevision(s, path, number)
+}
+
+func (s *fsNodeStore) PruneNodeRevisions(path string, max int) error {
+	return pruneNodeRevisions(s, path, max)
+}
+
+func (s *fsNodeStore) ListNodeData(path string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.Root, path[1:]))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isDataFileAccessible(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *fsNodeStore) Close() error {
+	return nil
+}
+
+func (s *fsNodeStore) readData(path, file string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filepath.Join(s.Root, path[1:], file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (s *fsNodeStore) writeData(path, file string, content []byte) error {
+	target := filepath.Join(s.Root, path[1:], file)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(target, content, 0600)
+}
+
+func (s *fsNodeStore) removeData(path, file string) error {
+	return os.Remove(filepath.Join(s.Root, path[1:], file))
+}
+
+func (s *fsNodeStore) listData(path, dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.Root, path[1:], dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
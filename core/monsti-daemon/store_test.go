@@ -0,0 +1,203 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testBackends returns the key value backends to be tested and a
+// function to close them.
+func testBackends(t *testing.T) (map[string]kvBackend, func()) {
+	root, err := ioutil.TempDir("", "monsti_kvstore_test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	bolt, err := openBoltBackend(filepath.Join(root, "nodes.db"))
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatalf("Could not open bolt backend: %v", err)
+	}
+	return map[string]kvBackend{"memory": newMemoryBackend(), "bolt": bolt},
+		func() {
+			bolt.Close()
+			os.RemoveAll(root)
+		}
+}
+
+func TestKVNodeStore(t *testing.T) {
+	backends, cleanup := testBackends(t)
+	defer cleanup()
+	for name, backend := range backends {
+		store := &kvNodeStore{backend}
+		for path, content := range map[string]string{
+			"/":                `{"Type":"core.Document"}`,
+			"/foo":             `{"Type":"core.Document"}`,
+			"/foo-bar":         `{"Type":"core.Document"}`,
+			"/bar/baz":         `{"Type":"core.Image"}`,
+			"/foo/child":       `{"Type":"core.Document"}`,
+			"/foo/child/child": `{"Type":"core.Document"}`} {
+			if err := store.WriteNodeData(path, "node.json",
+				[]byte(content)); err != nil {
+				t.Fatalf("%v: WriteNodeData(%q) returned error: %v", name, path, err)
+			}
+		}
+		node, err := store.GetNode("/foo")
+		if err != nil || string(node) != `{"Path":"/foo","Type":"core.Document"}` {
+			t.Errorf("%v: GetNode(%q) = %s, %v", name, "/foo", node, err)
+		}
+		node, err = store.GetNode("/unknown")
+		if err != nil || node != nil {
+			t.Errorf("%v: GetNode(%q) = %s, %v, should be nil, nil", name, "/unknown", node, err)
+		}
+		tests := []struct {
+			Path     string
+			Children []string
+		}{
+			{"/", []string{
+				`{"Path":"/bar","Type":"core.Path"}`,
+				`{"Path":"/foo","Type":"core.Document"}`,
+				`{"Path":"/foo-bar","Type":"core.Document"}`}},
+			{"/foo", []string{`{"Path":"/foo/child","Type":"core.Document"}`}},
+			{"/foo/child/child", nil},
+		}
+		for _, test := range tests {
+			ret, err := store.GetChildren(test.Path)
+			if err != nil {
+				t.Errorf("%v: GetChildren(%q) returned error: %v", name, test.Path, err)
+				continue
+			}
+			var children []string
+			for _, child := range ret {
+				children = append(children, string(child))
+			}
+			if !reflect.DeepEqual(children, test.Children) {
+				t.Errorf("%v: GetChildren(%q) = %v, should be %v", name, test.Path, children,
+					test.Children)
+			}
+		}
+		if err := store.WriteNodeData("/foo", "node.json",
+			[]byte(`{"Type":"core.File"}`)); err != nil {
+			t.Fatalf("%v: WriteNodeData returned error: %v", name, err)
+		}
+		revisions, err := store.GetNodeRevisions("/foo")
+		if err != nil || len(revisions) != 1 {
+			t.Errorf("%v: GetNodeRevisions = %v, %v, should return one revision", name,
+				revisions, err)
+		}
+		if err := store.RenameNode("/foo", "/bar/foo"); err != nil {
+			t.Fatalf("%v: RenameNode returned error: %v", name, err)
+		}
+		node, err = store.GetNode("/bar/foo/child/child")
+		if err != nil || node == nil {
+			t.Errorf("%v: Renamed descendant should exist: %s, %v", name, node, err)
+		}
+		revisions, err = store.GetNodeRevisions("/bar/foo")
+		if err != nil || len(revisions) != 1 {
+			t.Errorf("%v: Renamed node should keep its history: %v, %v", name, revisions, err)
+		}
+		if node, _ = store.GetNode("/foo-bar"); node == nil {
+			t.Errorf("%v: RenameNode should not move sibling with common prefix", name)
+		}
+		if err := store.RemoveNode("/bar/foo"); err != nil {
+			t.Fatalf("%v: RemoveNode returned error: %v", name, err)
+		}
+		keys, err := store.db.Keys("/bar/foo")
+		if err != nil || len(keys) != 0 {
+			t.Errorf("%v: RemoveNode should remove all data, left %v, %v", name, keys, err)
+		}
+	}
+}
+
+func TestKVBackend(t *testing.T) {
+	backends, cleanup := testBackends(t)
+	defer cleanup()
+	for name, backend := range backends {
+		for _, key := range []string{"/a\x00node.json", "/a\x00__history/1/x",
+			"/a-b\x00node.json", "/a/c\x00node.json", "/a/d/e\x00node.json",
+			"/b", "/c\x00node.json"} {
+			if err := backend.Put(key, []byte(key)); err != nil {
+				t.Fatalf("%v: Put(%q) returned error: %v", name, key, err)
+			}
+		}
+		names, err := backend.Names("/", "/\x00")
+		expected := []string{"a", "a-b", "b", "c"}
+		if err != nil || !reflect.DeepEqual(names, expected) {
+			t.Errorf("%v: Names = %v, %v, should be %v", name, names, err,
+				expected)
+		}
+		if err := backend.Move(map[string]string{
+			"/a\x00": "/c/a\x00", "/a/": "/c/a/"}); err != nil {
+			t.Fatalf("%v: Move returned error: %v", name, err)
+		}
+		keys, err := backend.Keys("")
+		expected = []string{"/a-b\x00node.json", "/b", "/c\x00node.json",
+			"/c/a\x00__history/1/x", "/c/a\x00node.json", "/c/a/c\x00node.json",
+			"/c/a/d/e\x00node.json"}
+		if err != nil || !reflect.DeepEqual(keys, expected) {
+			t.Errorf("%v: Keys after Move = %q, %v, should be %q", name, keys, err,
+				expected)
+		}
+		value, err := backend.Get("/c/a\x00node.json")
+		if err != nil || string(value) != "/a\x00node.json" {
+			t.Errorf("%v: Moved value is %q, %v", name, value, err)
+		}
+	}
+}
+
+func TestListNodeData(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti_store_test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	stores := map[string]NodeStore{
+		"filesystem": &fsNodeStore{Root: root},
+		"kv":         &kvNodeStore{newMemoryBackend()},
+	}
+	for name, store := range stores {
+		for _, entry := range []struct{ Path, File string }{
+			{"/foo", "node.json"},
+			{"/foo", "node.json"},
+			{"/foo", "__file_image"},
+			{"/foo", "__image_100x100"},
+			{"/foo", "attachment.pdf"},
+			{"/foo/child", "node.json"},
+			{"/foo/child", "other.txt"}} {
+			if err := store.WriteNodeData(entry.Path, entry.File,
+				[]byte(`{"Type":"core.Document"}`)); err != nil {
+				t.Fatalf("%v: WriteNodeData(%q, %q) returned error: %v", name,
+					entry.Path, entry.File, err)
+			}
+		}
+		files, err := store.ListNodeData("/foo")
+		expected := []string{"__file_image", "attachment.pdf"}
+		if err != nil || !reflect.DeepEqual(files, expected) {
+			t.Errorf("%v: ListNodeData(%q) = %v, %v, should be %v", name, "/foo",
+				files, err, expected)
+		}
+		files, err = store.ListNodeData("/unknown")
+		if err != nil || len(files) != 0 {
+			t.Errorf("%v: ListNodeData(%q) = %v, %v, should be empty", name,
+				"/unknown", files, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// openThemeStatic opens the named static file in the first of the
+// given theme static directories containing it. Directories are not
+// served.
+func openThemeStatic(dirs []string, name string) (http.File, os.FileInfo,
+	error) {
+	for _, dir := range dirs {
+		file, err := http.Dir(dir).Open(name)
+		if err != nil {
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			file.Close()
+			continue
+		}
+		return file, info, nil
+	}
+	return nil, nil, fmt.Errorf("Could not find theme static file %q", name)
+}
+
+// ServeThemeStatic serves the static files of the requested site's
+// theme. Files missing in the theme are taken from its parent themes.
+func (h *nodeHandler) ServeThemeStatic(w http.ResponseWriter,
+	r *http.Request) {
+	site, ok := h.getSiteName(r.Host)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	file, info, err := openThemeStatic(
+		h.Settings.getMonsti().GetThemeStaticsPaths(site),
+		strings.TrimPrefix(r.URL.Path, "/theme-static"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
@@ -0,0 +1,62 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestOpenThemeStatic(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/child/css/style.css": "child style",
+		"/base/css/style.css":  "base style",
+		"/base/js/script.js":   "base script",
+		"/secret":              "secret"}, "TestOpenThemeStatic")
+	if err != nil {
+		t.Fatalf("Could not create test directory tree: %v", err)
+	}
+	defer cleanup()
+	dirs := []string{filepath.Join(root, "child"), filepath.Join(root, "base")}
+	tests := []struct {
+		Name, Content string
+	}{
+		{"/css/style.css", "child style"},
+		{"/js/script.js", "base script"},
+		{"/css", ""},
+		{"/missing.css", ""},
+		{"/../secret", ""},
+	}
+	for _, test := range tests {
+		file, _, err := openThemeStatic(dirs, test.Name)
+		if err != nil {
+			if len(test.Content) > 0 {
+				t.Errorf("openThemeStatic(%q) returned error: %v", test.Name, err)
+			}
+			continue
+		}
+		content, _ := ioutil.ReadAll(file)
+		file.Close()
+		if string(content) != test.Content {
+			t.Errorf("openThemeStatic(%q) opened %q, should be %q", test.Name,
+				content, test.Content)
+		}
+	}
+}
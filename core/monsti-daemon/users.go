@@ -0,0 +1,329 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+type userFormData struct {
+	Login, Name, Email string
+	Roles              struct {
+		Admin, Editor, Author, Reader bool
+	}
+	Disabled  bool
+	Password  string
+	CSRFToken string
+}
+
+// getRoles returns the roles selected in the form.
+func (d *userFormData) getRoles() []string {
+	roles := make([]string, 0)
+	for _, role := range []struct {
+		Name     string
+		Selected bool
+	}{
+		{service.RoleAdmin, d.Roles.Admin},
+		{service.RoleEditor, d.Roles.Editor},
+		{service.RoleAuthor, d.Roles.Author},
+		{service.RoleReader, d.Roles.Reader}} {
+		if role.Selected {
+			roles = append(roles, role.Name)
+		}
+	}
+	return roles
+}
+
+// Users handles the user management.
+func (h *nodeHandler) Users(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	dataDir := h.Settings.getMonsti().GetSiteDataPath(c.Site.Name)
+	if err := c.Req.ParseForm(); err != nil {
+		return fmt.Errorf("Could not parse form: %v", err)
+	}
+	self := c.UserSession.User.Login
+	query := c.Req.URL.Query()
+	_, newUser := query["new"]
+	editLogin := query.Get("edit")
+	context := mtemplate.Context{
+		"Self":      self,
+		"CSRFToken": c.UserSession.CSRFToken}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Users")}
+
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		if login := c.Req.PostForm.Get("Remove"); len(login) > 0 {
+			if login == self {
+				return fmt.Errorf("User %q tried to remove itself", self)
+			}
+			if err := removeUser(login, dataDir); err != nil {
+				return fmt.Errorf("Could not remove user: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, "@@users", http.StatusSeeOther)
+			return nil
+		}
+		if login := c.Req.PostForm.Get("Reset"); len(login) > 0 {
+			user, err := getUser(login, dataDir)
+			if err != nil {
+				return fmt.Errorf("Could not get user: %v", err)
+			}
+			if user == nil {
+				return fmt.Errorf("Unknown user %q", login)
+			}
+			if err := h.sendPasswordTokenMail(c, user); err != nil {
+				return fmt.Errorf("Could not send password token: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, "@@users?reset", http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	if newUser || len(editLogin) > 0 {
+		form, done, err := h.userForm(c, newUser, editLogin)
+		if err != nil || done {
+			return err
+		}
+		if form == nil {
+			http.Error(c.Res, "User not found", http.StatusNotFound)
+			return nil
+		}
+		context["Form"] = form.RenderData()
+		if newUser {
+			env.Title = G("Add user")
+		} else {
+			env.Title = fmt.Sprintf(G("Edit user \"%v\""), editLogin)
+		}
+	} else {
+		users, err := getUsers(dataDir)
+		if err != nil {
+			return fmt.Errorf("Could not get users: %v", err)
+		}
+		context["Users"] = users
+		_, context["Reset"] = query["reset"]
+	}
+
+	body, err := h.Renderer.Render("actions/users", context,
+		c.UserSession.Locale,
+		h.Settings.getMonsti().GetSiteTemplatesPaths(c.Site.Name)...)
+	if err != nil {
+		return fmt.Errorf("Can't render users: %v", err)
+	}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
+
+// userForm handles the form to add or edit users.
+//
+// If the form has been processed successfully, done will be true and
+// the response has been written. If the user to edit does not exist,
+// form will be nil.
+func (h *nodeHandler) userForm(c *reqContext, newUser bool,
+	login string) (form *htmlwidgets.Form, done bool, err error) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	dataDir := h.Settings.getMonsti().GetSiteDataPath(c.Site.Name)
+	self := c.UserSession.User.Login
+	data := userFormData{}
+	var user *service.User
+	if !newUser {
+		user, err = getUser(login, dataDir)
+		if err != nil || user == nil {
+			return nil, false, err
+		}
+		data.Name = user.Name
+		data.Email = user.Email
+		data.Disabled = user.Disabled
+		roles := getRoles(&service.UserSession{User: user})
+		data.Roles.Admin = inStringSlice(service.RoleAdmin, roles)
+		data.Roles.Editor = inStringSlice(service.RoleEditor, roles)
+		data.Roles.Author = inStringSlice(service.RoleAuthor, roles)
+		data.Roles.Reader = inStringSlice(service.RoleReader, roles)
+	}
+
+	form = htmlwidgets.NewForm(&data)
+	passwordDescription := G("Leave empty to keep the current password.")
+	if newUser {
+		form.AddWidget(&htmlwidgets.TextWidget{
+			Regexp:          `^[-\w.@]+$`,
+			ValidationError: G("Please enter a login consisting only of the characters A-Z, a-z, 0-9, '.', '@', '_' and '-'")},
+			"Login", G("Login"), "")
+		passwordDescription = G("Leave empty to send the user a link to set the password.")
+	}
+	form.AddWidget(new(htmlwidgets.TextWidget), "Name", G("Name"), "")
+	form.AddWidget(&htmlwidgets.TextWidget{MinLength: 1,
+		ValidationError: G("Required.")}, "Email", G("Email"), "")
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Roles.Admin",
+		G("Administrator"), G("May perform any action, including user management."))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Roles.Editor",
+		G("Editor"), G("May add, edit and remove content."))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Roles.Author",
+		G("Author"), G("May add and edit content."))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Roles.Reader",
+		G("Reader"), G("May view non public content."))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Disabled",
+		G("Disabled"), G("Disabled users can't login."))
+	form.AddWidget(&htmlwidgets.PasswordWidget{
+		VerifyLabel: G("Please repeat the password."),
+		VerifyError: G("Passwords do not match."),
+	}, "Password", G("Password"), passwordDescription)
+	c.UserSession.AddCSRFWidget(form, &data.CSRFToken)
+
+	if c.Req.Method != "POST" || !form.Fill(c.Req.Form) {
+		return form, false, nil
+	}
+	valid := true
+	if newUser {
+		existing, err := getUser(data.Login, dataDir)
+		if err != nil {
+			return nil, false, fmt.Errorf("Could not get user: %v", err)
+		}
+		if existing != nil {
+			form.AddError("Login", G("A user with this login does already exist."))
+			valid = false
+		}
+	}
+	roles := data.getRoles()
+	if len(roles) == 0 {
+		form.AddError("", G("Please select at least one role."))
+		valid = false
+	}
+	if !newUser && user.Login == self && (data.Disabled || !data.Roles.Admin) {
+		form.AddError("", G("You can't disable yourself or revoke your own administrator role."))
+		valid = false
+	}
+	if !valid {
+		return form, false, nil
+	}
+	changed := service.User{
+		Login:    data.Login,
+		Name:     data.Name,
+		Email:    data.Email,
+		Roles:    roles,
+		Disabled: data.Disabled}
+	if !newUser {
+		changed.Login = user.Login
+		changed.PasswordChanged = user.PasswordChanged
+	}
+	if len(data.Password) > 0 {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(data.Password), 0)
+		if err != nil {
+			return nil, false, fmt.Errorf("Could not hash user password: %v", err)
+		}
+		changed.Password = string(hashed)
+		changed.PasswordChanged = time.Now().UTC()
+	}
+	if err := writeUser(&changed, dataDir); err != nil {
+		return nil, false, fmt.Errorf("Could not write user: %v", err)
+	}
+	if newUser && len(data.Password) == 0 {
+		if err := h.sendPasswordTokenMail(c, &changed); err != nil {
+			return nil, false, fmt.Errorf("Could not send password token: %v", err)
+		}
+	}
+	http.Redirect(c.Res, c.Req, "@@users", http.StatusSeeOther)
+	return nil, true, nil
+}
+
+// getSiteDataPath returns the data directory of the given site.
+func (i *MonstiService) getSiteDataPath(site string) (string, error) {
+	if _, ok := i.Settings.getSite(site); !ok {
+		return "", fmt.Errorf("Unknown site %q", site)
+	}
+	return i.Settings.getMonsti().GetSiteDataPath(site), nil
+}
+
+type GetUserArgs struct{ Site, Login string }
+
+func (i *MonstiService) GetUser(args *GetUserArgs, reply *service.User) error {
+	dataDir, err := i.getSiteDataPath(args.Site)
+	if err != nil {
+		return err
+	}
+	user, err := getUser(args.Login, dataDir)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		*reply = *user
+	}
+	return nil
+}
+
+func (i *MonstiService) ListUsers(site string, reply *[]service.User) error {
+	dataDir, err := i.getSiteDataPath(site)
+	if err != nil {
+		return err
+	}
+	*reply, err = getUsers(dataDir)
+	return err
+}
+
+// isKnownRole returns true if the given role may be assigned to users.
+func isKnownRole(role string) bool {
+	switch role {
+	case service.RoleAdmin, service.RoleEditor, service.RoleAuthor,
+		service.RoleReader:
+		return true
+	}
+	return false
+}
+
+type WriteUserArgs struct {
+	Site string
+	User *service.User
+}
+
+func (i *MonstiService) WriteUser(args *WriteUserArgs, reply *int) error {
+	dataDir, err := i.getSiteDataPath(args.Site)
+	if err != nil {
+		return err
+	}
+	if args.User == nil || len(args.User.Login) == 0 {
+		return fmt.Errorf("Missing user login")
+	}
+	if len(args.User.Roles) == 0 {
+		return fmt.Errorf("User %q has no roles", args.User.Login)
+	}
+	for _, role := range args.User.Roles {
+		if !isKnownRole(role) {
+			return fmt.Errorf("User %q has unknown role %q", args.User.Login, role)
+		}
+	}
+	return writeUser(args.User, dataDir)
+}
+
+type RemoveUserArgs struct{ Site, Login string }
+
+func (i *MonstiService) RemoveUser(args *RemoveUserArgs, reply *int) error {
+	dataDir, err := i.getSiteDataPath(args.Site)
+	if err != nil {
+		return err
+	}
+	return removeUser(args.Login, dataDir)
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
 // inStringSlice checks if the string value is in the given string slice.
 func inStringSlice(value string, slice []string) bool {
 	for _, v := range slice {
@@ -9,3 +16,100 @@ func inStringSlice(value string, slice []string) bool {
 	}
 	return false
 }
+
+// writeFileAtomic writes the content to a temporary file in the
+// target's directory and renames it to the target path afterwards. A
+// reader will see either the old or the new content, never a partially
+// written file.
+//
+// The temporary file's name starts with "__tmp_" to be ignored by
+// node listings.
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "__tmp_")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// keyedLocks holds a read/write mutex for each key. Mutexes are
+// removed once nobody holds or waits for them anymore.
+//
+// The zero value is ready to use.
+type keyedLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is a mutex of keyedLocks with the number of its users.
+type keyedLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// acquire returns the mutex of the given key and registers the caller
+// as its user.
+func (k *keyedLocks) acquire(key string) *keyedLock {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = new(keyedLock)
+		k.locks[key] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+// release unregisters a user of the given key's mutex and removes the
+// mutex if it was the last one.
+func (k *keyedLocks) release(key string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	lock := k.locks[key]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// lock locks the given key for writing. It returns a function to
+// release the lock.
+func (k *keyedLocks) lock(key string) func() {
+	lock := k.acquire(key)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		k.release(key)
+	}
+}
+
+// rLock locks the given key for reading. It returns a function to
+// release the lock.
+func (k *keyedLocks) rLock(key string) func() {
+	lock := k.acquire(key)
+	lock.RLock()
+	return func() {
+		lock.RUnlock()
+		k.release(key)
+	}
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
 )
 
 func TestInStringSlice(t *testing.T) {
@@ -25,3 +31,56 @@ func TestInStringSlice(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo": "old"}, "TestWriteFileAtomic")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	path := filepath.Join(root, "foo")
+	if err := writeFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatalf("writeFileAtomic returned error: %v", err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != "new" {
+		t.Errorf("File content is %q, %v, should be %q", content, err, "new")
+	}
+	files, err := ioutil.ReadDir(root)
+	if err != nil || len(files) != 1 {
+		t.Errorf("writeFileAtomic should not leave temporary files: %v, %v",
+			files, err)
+	}
+}
+
+func TestKeyedLocks(t *testing.T) {
+	var locks keyedLocks
+	unlockFoo := locks.lock("foo")
+	unlockBar := locks.rLock("bar")
+	unlockBar2 := locks.rLock("bar")
+
+	var wg sync.WaitGroup
+	locked := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		unlock := locks.lock("foo")
+		locked <- true
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("lock should block while the key is locked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlockFoo()
+	<-locked
+	wg.Wait()
+	unlockBar()
+	unlockBar2()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("Released locks should be removed, got %v", locks.locks)
+	}
+}
@@ -44,6 +44,8 @@ func setup(c *module.ModuleContext) error {
 				Id:   "example.Foo",
 				Name: util.GenLanguageMap(G("Foo"), availableLocales),
 				Type: "Text",
+				// Foo holds a value per locale on multilingual sites.
+				Translatable: true,
 			},
 			{
 				Id:   "example.Bar",
@@ -79,6 +81,8 @@ func setup(c *module.ModuleContext) error {
 	if err := m.AddSignalHandler(handler); err != nil {
 		c.Logger.Fatalf("Could not add signal handler: %v", err)
 	}
+	// Handle up to two signals at once.
+	c.SignalWorkers = 2
 
 	return nil
 }
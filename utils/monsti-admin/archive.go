@@ -0,0 +1,382 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// Names of the archive's entries besides the manifest.
+const (
+	usersName     = "users.json"
+	nodesDir      = "nodes"
+	configDir     = "config"
+	templatesDir  = "templates"
+	siteStaticDir = "site-static"
+)
+
+// archiveWriter writes the entries of a site archive.
+type archiveWriter struct {
+	tar *tar.Writer
+	now time.Time
+}
+
+// addFile adds a file with the given content to the archive.
+func (w *archiveWriter) addFile(name string, content []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: w.now,
+	}
+	if err := w.tar.WriteHeader(header); err != nil {
+		return fmt.Errorf("Could not write header of %q: %v", name, err)
+	}
+	if _, err := w.tar.Write(content); err != nil {
+		return fmt.Errorf("Could not write %q: %v", name, err)
+	}
+	return nil
+}
+
+// addDirectory adds the files below the given directory to the
+// archive, prefixing their names with prefix. Missing directories
+// are skipped.
+func (w *archiveWriter) addDirectory(prefix, dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("Could not read %q: %v", file, err)
+		}
+		return w.addFile(path.Join(prefix, filepath.ToSlash(rel)), content)
+	})
+}
+
+// walkNodes calls fn for the node at the given path and all its
+// descendants. The node is nil for paths without node data.
+func walkNodes(monsti *service.MonstiClient, site, nodePath string,
+	fn func(nodePath string, node *service.Node) error) error {
+	node, err := monsti.GetNode(site, nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not get node %q: %v", nodePath, err)
+	}
+	if err := fn(nodePath, node); err != nil {
+		return err
+	}
+	children, err := monsti.GetChildren(site, nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not get children of %q: %v", nodePath, err)
+	}
+	for _, child := range children {
+		if err := walkNodes(monsti, site, child.Path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportSite writes an archive of the site's nodes, users,
+// configuration, templates and static files.
+func exportSite(settings *util.MonstiSettings, monsti *service.MonstiClient,
+	site string, out io.Writer) error {
+	now := time.Now().UTC()
+	manifest := manifest{
+		Format:   archiveFormat,
+		Version:  archiveVersion,
+		Site:     site,
+		Exported: now,
+	}
+	var paths []string
+	err := walkNodes(monsti, site, "/", func(nodePath string,
+		node *service.Node) error {
+		paths = append(paths, nodePath)
+		if node != nil {
+			manifest.addNodeType(node.Type)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	users, err := monsti.ListUsers(site)
+	if err != nil {
+		return fmt.Errorf("Could not get users: %v", err)
+	}
+
+	zipper := gzip.NewWriter(out)
+	w := &archiveWriter{tar.NewWriter(zipper), now}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not encode manifest: %v", err)
+	}
+	if err := w.addFile(manifestName, manifestJSON); err != nil {
+		return err
+	}
+	usersJSON, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not encode users: %v", err)
+	}
+	if err := w.addFile(usersName, usersJSON); err != nil {
+		return err
+	}
+	for prefix, dir := range map[string]string{
+		configDir:     settings.GetSiteConfigPath(site),
+		templatesDir:  settings.GetSiteTemplatesPath(site),
+		siteStaticDir: settings.GetSiteStaticsPath(site),
+	} {
+		if err := w.addDirectory(prefix, dir); err != nil {
+			return fmt.Errorf("Could not add %v: %v", prefix, err)
+		}
+	}
+	for _, nodePath := range paths {
+		files, err := monsti.ListNodeData(site, nodePath)
+		if err != nil {
+			return fmt.Errorf("Could not list data of node %q: %v", nodePath, err)
+		}
+		for _, file := range append([]string{"node.json"}, files...) {
+			content, err := monsti.GetNodeData(site, nodePath, file)
+			if err != nil {
+				return fmt.Errorf("Could not get data %q of node %q: %v", file,
+					nodePath, err)
+			}
+			if content == nil {
+				continue
+			}
+			if err := w.addFile(path.Join(nodesDir, nodePath, file),
+				content); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.tar.Close(); err != nil {
+		return fmt.Errorf("Could not close archive: %v", err)
+	}
+	if err := zipper.Close(); err != nil {
+		return fmt.Errorf("Could not close archive: %v", err)
+	}
+	return nil
+}
+
+// readArchive calls fn for each file of the archive. It fails if the
+// first file is not the manifest.
+func readArchive(archive string,
+	fn func(name string, content []byte) error) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("Could not open archive: %v", err)
+	}
+	defer file.Close()
+	zipped, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("Could not read archive: %v", err)
+	}
+	r := tar.NewReader(zipped)
+	first := true
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if first && header.Name != manifestName {
+			return fmt.Errorf("Archive does not start with a manifest")
+		}
+		first = false
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("Could not read %q: %v", header.Name, err)
+		}
+		if err := fn(header.Name, content); err != nil {
+			return err
+		}
+	}
+	if first {
+		return fmt.Errorf("Archive is empty")
+	}
+	return nil
+}
+
+// archiveFilePath returns the path of the given archive entry
+// relative to the directory dir of the archive. It returns false if
+// the entry is not below the directory or if its name is not clean.
+func archiveFilePath(name, dir string) (string, bool) {
+	if path.Clean(name) != name || !strings.HasPrefix(name, dir+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(name, dir+"/"), true
+}
+
+// archiveNodePath returns the node path and file name of the given
+// archive entry. It returns false if the entry is not node data, e.g.
+// if any of the node's path segments starts with "__" like the history
+// directory does.
+func archiveNodePath(name string) (string, string, bool) {
+	rel, ok := archiveFilePath(name, nodesDir)
+	if !ok {
+		return "", "", false
+	}
+	dir, file := path.Split(rel)
+	if file != "node.json" && (strings.HasPrefix(file, "__") &&
+		!strings.HasPrefix(file, "__file_")) {
+		return "", "", false
+	}
+	for _, segment := range strings.Split(dir, "/") {
+		if strings.HasPrefix(segment, "__") {
+			return "", "", false
+		}
+	}
+	return "/" + strings.TrimSuffix(dir, "/"), file, true
+}
+
+// writeFile writes the content to the file below the given directory.
+func writeFile(dir, name string, content []byte) error {
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("Could not create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(file, content, 0644); err != nil {
+		return fmt.Errorf("Could not write %q: %v", file, err)
+	}
+	return nil
+}
+
+// importSite imports the archive into the given site.
+//
+// The site must be known to Monsti. If config is true, the site's
+// configuration gets overwritten by the archived one. If the site is
+// unknown, only the configuration will be written. Monsti has to
+// reload its settings before the import can be run again to import
+// the remaining data.
+func importSite(settings *util.MonstiSettings, monsti *service.MonstiClient,
+	site, archive string, config bool) error {
+	_, known := settings.Sites[site]
+	if !known && !config {
+		return fmt.Errorf("Unknown site %q. Use -config to import its "+
+			"configuration first.", site)
+	}
+	// Check the whole archive before writing anything.
+	err := readArchive(archive, func(name string, content []byte) error {
+		if name == manifestName {
+			var manifest manifest
+			if err := json.Unmarshal(content, &manifest); err != nil {
+				return fmt.Errorf("Could not decode manifest: %v", err)
+			}
+			if err := manifest.validate(monsti.GetNodeType); err != nil {
+				return fmt.Errorf("Incompatible archive: %v", err)
+			}
+			return nil
+		}
+		if !known {
+			return nil
+		}
+		if nodePath, file, ok := archiveNodePath(name); ok {
+			if file != "node.json" {
+				return nil
+			}
+			if _, err := monsti.UnmarshalNode(site, content); err != nil {
+				return fmt.Errorf("Invalid node %q: %v", nodePath, err)
+			}
+			return nil
+		}
+		if name == usersName {
+			var users []service.User
+			if err := json.Unmarshal(content, &users); err != nil {
+				return fmt.Errorf("Could not decode users: %v", err)
+			}
+			return nil
+		}
+		for _, dir := range []string{configDir, templatesDir, siteStaticDir} {
+			if _, ok := archiveFilePath(name, dir); ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("Unexpected archive entry %q", name)
+	})
+	if err != nil {
+		return err
+	}
+	return readArchive(archive, func(name string, content []byte) error {
+		if rel, ok := archiveFilePath(name, configDir); ok {
+			if config {
+				return writeFile(settings.GetSiteConfigPath(site), rel, content)
+			}
+			return nil
+		}
+		if !known {
+			return nil
+		}
+		if nodePath, file, ok := archiveNodePath(name); ok {
+			if err := monsti.WriteNodeData(site, nodePath, file,
+				content); err != nil {
+				return fmt.Errorf("Could not write data %q of node %q: %v", file,
+					nodePath, err)
+			}
+			return nil
+		}
+		if name == usersName {
+			var users []service.User
+			if err := json.Unmarshal(content, &users); err != nil {
+				return fmt.Errorf("Could not decode users: %v", err)
+			}
+			for i := range users {
+				if err := monsti.WriteUser(site, &users[i]); err != nil {
+					return fmt.Errorf("Could not write user %q: %v", users[i].Login,
+						err)
+				}
+			}
+			return nil
+		}
+		if rel, ok := archiveFilePath(name, templatesDir); ok {
+			return writeFile(settings.GetSiteTemplatesPath(site), rel, content)
+		}
+		if rel, ok := archiveFilePath(name, siteStaticDir); ok {
+			return writeFile(settings.GetSiteStaticsPath(site), rel, content)
+		}
+		return nil
+	})
+}
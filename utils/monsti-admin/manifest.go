@@ -0,0 +1,125 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+const (
+	// archiveFormat identifies site archives.
+	archiveFormat = "monsti-site"
+	// archiveVersion is the version of the archive layout.
+	archiveVersion = 1
+	// manifestName is the name of the manifest in the archive. It's
+	// always the first entry.
+	manifestName = "manifest.json"
+)
+
+// manifest describes the content of a site archive.
+type manifest struct {
+	Format  string
+	Version int
+	// Site is the name of the exported site.
+	Site string
+	// Exported is the time of the export.
+	Exported time.Time
+	// NodeTypes maps the ids of the node types used by the exported
+	// nodes to their fields.
+	NodeTypes map[string]manifestNodeType
+}
+
+// manifestNodeType describes a node type as it has been registered
+// at export time.
+type manifestNodeType struct {
+	// Fields maps field ids to field types.
+	Fields map[string]string
+}
+
+// addNodeType adds the given node type to the manifest.
+func (m *manifest) addNodeType(nodeType *service.NodeType) {
+	if m.NodeTypes == nil {
+		m.NodeTypes = make(map[string]manifestNodeType)
+	}
+	if _, ok := m.NodeTypes[nodeType.Id]; ok {
+		return
+	}
+	fields := make(map[string]string)
+	for _, field := range nodeType.Fields {
+		fields[field.Id] = field.Type
+	}
+	m.NodeTypes[nodeType.Id] = manifestNodeType{fields}
+}
+
+// validate checks that the archive can be imported, i.e. that all
+// node types of the manifest are registered and that their fields
+// have the same types as at export time. getNodeType returns the
+// registered node type with the given id.
+func (m *manifest) validate(
+	getNodeType func(id string) (*service.NodeType, error)) error {
+	if m.Format != archiveFormat {
+		return fmt.Errorf("Not a site archive")
+	}
+	if m.Version != archiveVersion {
+		return fmt.Errorf("Unsupported archive version %v", m.Version)
+	}
+	ids := make([]string, 0, len(m.NodeTypes))
+	for id := range m.NodeTypes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var problems []string
+	for _, id := range ids {
+		nodeType, err := getNodeType(id)
+		if err != nil {
+			problems = append(problems,
+				fmt.Sprintf("Node type %q is not registered", id))
+			continue
+		}
+		registered := make(map[string]string)
+		for _, field := range nodeType.Fields {
+			registered[field.Id] = field.Type
+		}
+		fields := make([]string, 0, len(m.NodeTypes[id].Fields))
+		for field := range m.NodeTypes[id].Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			fieldType := m.NodeTypes[id].Fields[field]
+			current, ok := registered[field]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf(
+					"Field %q of node type %q is not registered", field, id))
+			case current != fieldType:
+				problems = append(problems, fmt.Sprintf(
+					"Field %q of node type %q has type %q, should be %q",
+					field, id, current, fieldType))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%v", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestManifestValidate(t *testing.T) {
+	registered := map[string]*service.NodeType{
+		"core.Document": &service.NodeType{
+			Id: "core.Document",
+			Fields: []*service.NodeField{
+				{Id: "core.Title", Type: "Text"},
+				{Id: "core.Body", Type: "HTMLArea"}}},
+	}
+	getNodeType := func(id string) (*service.NodeType, error) {
+		if nodeType, ok := registered[id]; ok {
+			return nodeType, nil
+		}
+		return nil, fmt.Errorf("Unknown node type %q", id)
+	}
+	tests := []struct {
+		Manifest manifest
+		Error    string
+	}{
+		{manifest{Format: "other", Version: archiveVersion},
+			"Not a site archive"},
+		{manifest{Format: archiveFormat, Version: 2},
+			"Unsupported archive version 2"},
+		{manifest{Format: archiveFormat, Version: archiveVersion}, ""},
+		{manifest{Format: archiveFormat, Version: archiveVersion,
+			NodeTypes: map[string]manifestNodeType{
+				"core.Document": {map[string]string{"core.Title": "Text"}}}}, ""},
+		{manifest{Format: archiveFormat, Version: archiveVersion,
+			NodeTypes: map[string]manifestNodeType{
+				"core.Document": {map[string]string{
+					"core.Body":   "Text",
+					"core.Teaser": "Text"}},
+				"foo.Bar": {}}},
+			`Field "core.Body" of node type "core.Document" has type "HTMLArea", ` +
+				`should be "Text"; ` +
+				`Field "core.Teaser" of node type "core.Document" is not registered; ` +
+				`Node type "foo.Bar" is not registered`},
+	}
+	for i, test := range tests {
+		err := test.Manifest.validate(getNodeType)
+		switch {
+		case err == nil && len(test.Error) > 0:
+			t.Errorf("Test %v: validate should fail with %q", i, test.Error)
+		case err != nil && err.Error() != test.Error:
+			t.Errorf("Test %v: validate returned %q, should be %q", i, err,
+				test.Error)
+		}
+	}
+}
+
+func TestArchiveNodePath(t *testing.T) {
+	tests := []struct {
+		Name, Path, File string
+		Ok               bool
+	}{
+		{"nodes/node.json", "/", "node.json", true},
+		{"nodes/foo/bar/__file_image", "/foo/bar", "__file_image", true},
+		{"nodes/foo/../../etc/passwd", "", "", false},
+		{"nodes/foo/__history/1/node.json", "", "", false},
+		{"nodes/__tmp_123/__file_image", "", "", false},
+		{"nodes/foo/", "", "", false},
+		{"users.json", "", "", false},
+	}
+	for _, test := range tests {
+		nodePath, file, ok := archiveNodePath(test.Name)
+		if nodePath != test.Path || file != test.File || ok != test.Ok {
+			t.Errorf("archiveNodePath(%q) = %q, %q, %v, should be %q, %q, %v",
+				test.Name, nodePath, file, ok, test.Path, test.File, test.Ok)
+		}
+	}
+}
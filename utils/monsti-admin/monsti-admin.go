@@ -0,0 +1,154 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+// Tool to administrate Monsti sites.
+//
+// Usage:
+//
+//	monsti-admin <config_directory> export <site> <archive>
+//	monsti-admin <config_directory> import [-config] <site> <archive>
+//	monsti-admin <config_directory> migrate [-dry-run] [-backup] <site>
+//
+// All commands need a running Monsti instance.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  %[1]v <config_directory> export <site> <archive>
+  %[1]v <config_directory> import [-config] <site> <archive>
+  %[1]v <config_directory> migrate [-dry-run] [-backup] <site>
+`, filepath.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+func exit(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	os.Exit(1)
+}
+
+// printMigrateResult prints the applied migrations and the changed
+// nodes.
+func printMigrateResult(result *service.MigrateSiteResult, dryRun bool) {
+	if len(result.Migrations) == 0 {
+		fmt.Println("The site is up to date.")
+		return
+	}
+	for _, migration := range result.Migrations {
+		fmt.Printf("%v %v: %v (%v nodes)\n", migration.Namespace,
+			migration.Version, migration.Description, len(migration.Nodes))
+		if dryRun {
+			for _, node := range migration.Nodes {
+				fmt.Println("  " + node)
+			}
+		}
+	}
+	if dryRun {
+		fmt.Println("Dry run, nothing has been changed.")
+	}
+	if len(result.Backup) > 0 {
+		fmt.Println("Original nodes have been saved to", result.Backup)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+	}
+	cfgPath := util.GetConfigPath(flag.Arg(0))
+	settings, err := util.LoadMonstiSettings(cfgPath)
+	if err != nil {
+		exit("Could not load settings:", err)
+	}
+	if err := settings.LoadSiteSettings(); err != nil {
+		exit("Could not load site settings:", err)
+	}
+	monsti, err := service.NewMonstiConnection(
+		settings.GetServicePath(service.MonstiService.String()))
+	if err != nil {
+		exit("Could not connect to Monsti:", err)
+	}
+	defer monsti.Close()
+
+	commands := flag.NewFlagSet(flag.Arg(1), flag.ExitOnError)
+	commands.Usage = usage
+	switch flag.Arg(1) {
+	case "export":
+		commands.Parse(flag.Args()[2:])
+		if commands.NArg() != 2 {
+			usage()
+		}
+		site, archive := commands.Arg(0), commands.Arg(1)
+		if _, ok := settings.Sites[site]; !ok {
+			exit("Unknown site", site)
+		}
+		file, err := os.Create(archive)
+		if err != nil {
+			exit("Could not create archive:", err)
+		}
+		if err := exportSite(settings, monsti, site, file); err != nil {
+			file.Close()
+			os.Remove(archive)
+			exit("Could not export site:", err)
+		}
+		if err := file.Close(); err != nil {
+			exit("Could not write archive:", err)
+		}
+	case "import":
+		config := commands.Bool("config", false,
+			"Overwrite the site's configuration by the archived one.")
+		commands.Parse(flag.Args()[2:])
+		if commands.NArg() != 2 {
+			usage()
+		}
+		site, archive := commands.Arg(0), commands.Arg(1)
+		if err := importSite(settings, monsti, site, archive,
+			*config); err != nil {
+			exit("Could not import site:", err)
+		}
+		if _, ok := settings.Sites[site]; !ok {
+			fmt.Println("The site's configuration has been written. Reload " +
+				"Monsti (SIGHUP) and run the import again to import its data.")
+		}
+	case "migrate":
+		dryRun := commands.Bool("dry-run", false,
+			"Show the changes without writing anything.")
+		backup := commands.Bool("backup", false,
+			"Save the original node documents of changed nodes.")
+		commands.Parse(flag.Args()[2:])
+		if commands.NArg() != 1 {
+			usage()
+		}
+		result, err := monsti.MigrateSite(commands.Arg(0), *dryRun, *backup)
+		if err != nil {
+			exit("Could not migrate site:", err)
+		}
+		printMigrateResult(result, *dryRun)
+	default:
+		usage()
+	}
+}